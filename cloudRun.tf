@@ -25,7 +25,7 @@ resource "google_cloud_run_v2_service" "autoscaler" {
     max_instance_request_concurrency = var.max_concurrency
     timeout                          = format("%ds", var.autoscaler_timeout)
     scaling {
-      min_instance_count = 0
+      min_instance_count = local.keepAutoscalerRunning ? 1 : 0
       max_instance_count = 1
     }
     containers {
@@ -86,6 +86,22 @@ resource "google_cloud_run_v2_service" "autoscaler" {
         name  = "GITHUB_REPOS"
         value = local.hasRepo ? join(",", [for i, v in var.github_repositories : format("%s;%s", v, base64encode(random_password.webhook_repo_secret[v].result))]) : ""
       }
+      env {
+        name  = "SOURCE_SETTINGS"
+        value = jsonencode(var.github_source_settings)
+      }
+      env {
+        name  = "STUCK_JOB_TIMEOUT"
+        value = var.stuck_job_timeout
+      }
+      env {
+        name  = "POLL_INTERVAL"
+        value = var.poll_interval
+      }
+      env {
+        name  = "CALLBACK_HOST"
+        value = local.callbackHost
+      }
       env {
         name  = "SOURCE_QUERY_PARAM_NAME"
         value = local.sourceQueryParamName
@@ -94,6 +110,13 @@ resource "google_cloud_run_v2_service" "autoscaler" {
         name  = "AUTOSCALER_VERSION"
         value = local.autoscaler_version
       }
+      dynamic "env" {
+        for_each = var.autoscaler_extra_env
+        content {
+          name  = env.key
+          value = env.value
+        }
+      }
       dynamic "env" {
         for_each = var.force_cloud_run_deployment ? [0] : []
         content {
@@ -117,7 +140,7 @@ resource "google_cloud_run_v2_service" "autoscaler" {
       }
       resources {
         startup_cpu_boost = false
-        cpu_idle          = true
+        cpu_idle          = !local.keepAutoscalerRunning // polling and held workflow jobs need CPU always allocated
         limits = {
           cpu    = "1"
           memory = "128Mi"
@@ -48,32 +48,49 @@ resource "google_compute_instance_template" "runner_instance" {
   }
 }
 
-// First parameter has to be the registration token
-/*
+// Parameters: <registration_token> <url> <labels> <runner_group_name> <config_flags>
 resource "google_compute_project_metadata_item" "startup_scripts_register_runner" {
   key   = "startup_script_register_runner"
   value = <<EOT
 #!/bin/bash
-echo "Setup of agent '$(hostname)' started"
-apt-get update && apt-get -y install docker.io docker-buildx curl
+agent_name=$(hostname)
+echo "Setup of agent '$agent_name' started"
+apt-get update && apt-get -y install docker.io docker-buildx curl sed jq ${local.github_runner_package_install}
 useradd -d /home/agent -u ${var.github_runner_uid} agent
 usermod -aG docker agent
 newgrp docker
-curl -s -o /tmp/agent.tar.gz -L '${var.github_runner_download_url}'
+RUNNER_DOWNLOAD_URL='${var.github_runner_download_url}'
+if [ -z "$${RUNNER_DOWNLOAD_URL}" ]; then
+  RUNNER_VERSION=$(curl -s "https://github.com/actions/runner/tags/" | grep -Eo "$Version v[0-9]+.[0-9]+.[0-9]+" | sort -r | head -n1 | tr -d ' ' | tr -d 'v')
+  echo "Downloading latest runner v$${RUNNER_VERSION}"
+  RUNNER_DOWNLOAD_URL="https://github.com/actions/runner/releases/download/v$${RUNNER_VERSION}/actions-runner-linux-x64-$${RUNNER_VERSION}.tar.gz"
+fi
+curl -s -o /tmp/agent.tar.gz -L $${RUNNER_DOWNLOAD_URL}
 mkdir -p /home/agent
 chown -R agent:agent /home/agent
 pushd /home/agent
 sudo -u agent tar zxf /tmp/agent.tar.gz
 registration_token=$1
-sudo -u agent ./config.sh --unattended --disableupdate --ephemeral --name $(hostname) ${local.runnerLabelInstanceTemplate} --url 'https://github.com/${var.github_organization}' --token $${registration_token} --runnergroup '${var.github_runner_group_name}' || shutdown now
+runner_url=$2
+runner_labels=$3
+runner_group=$4
+config_flags=$5
+runner_group_flag=()
+if [ -n "$runner_group" ]; then
+  runner_group_flag=(--runnergroup "$runner_group")
+fi
+sudo -u agent ./config.sh --unattended --ephemeral --name "$agent_name" --no-default-labels --labels "$runner_labels" --url "$runner_url" --token "$registration_token" "$${runner_group_flag[@]}" $config_flags || shutdown now
 ./bin/installdependencies.sh || shutdown now
 ./svc.sh install agent || shutdown now
 ./svc.sh start || shutdown now
 popd
 rm /tmp/agent.tar.gz
-echo "Setup finished"
+echo "Setup finished - waiting for Workflow Job"
+sleep 60
+journalctl -u actions.runner.* -o json --no-pager | jq -e '.|.MESSAGE|match("Running job:")' || shutdown now
+echo "Accepted Workflow Job - processing"
 EOT
-}*/
+}
 
 // First parameter has to be the base64 encoded jit_config
 resource "google_compute_project_metadata_item" "startup_scripts_register_jit_runner" {
@@ -27,7 +27,14 @@ resource "google_service_account" "autoscaler_sa" {
 resource "google_project_iam_custom_role" "manage_vm_instances" {
   role_id     = "ManageVmInstances"
   title       = "Manage VM instance(s)"
-  permissions = ["compute.instances.get", "compute.instances.start", "compute.instances.stop", "compute.instances.delete", "compute.instances.create", "compute.instances.setMetadata", "compute.instances.setTags", "compute.instances.setServiceAccount"]
+  permissions = ["compute.instances.get", "compute.instances.list", "compute.instances.start", "compute.instances.stop", "compute.instances.delete", "compute.instances.create", "compute.instances.setMetadata", "compute.instances.setLabels", "compute.instances.setTags", "compute.instances.setServiceAccount", "compute.instances.getSerialPortOutput", "compute.zoneOperations.get"]
+}
+
+// only needed with BACKEND "mig"
+resource "google_project_iam_custom_role" "manage_instance_group" {
+  role_id     = "ManageInstanceGroup"
+  title       = "Create/Delete instances of a managed instance group"
+  permissions = ["compute.instanceGroupManagers.get", "compute.instanceGroupManagers.update", "compute.regionOperations.get"]
 }
 
 resource "google_project_iam_custom_role" "create_delete_cloud_task" {
@@ -74,6 +81,12 @@ resource "google_project_iam_member" "manage_vm_instances_member" {
   }
 }
 
+resource "google_project_iam_member" "manage_instance_group_member" {
+  project = local.projectId
+  member  = "serviceAccount:${google_service_account.autoscaler_sa.email}"
+  role    = google_project_iam_custom_role.manage_instance_group.id
+}
+
 resource "google_project_iam_member" "create_delete_cloud_task_member" {
   project = local.projectId
   member  = "serviceAccount:${google_service_account.autoscaler_sa.email}"
@@ -25,8 +25,11 @@ locals {
   hasOrg                      = length(var.github_organization) > 0
   hasRepo                     = length(var.github_repositories) > 0
   sourceQueryParamName        = "src"
+  callbackHost                = format("github-runner-autoscaler-%s.%s.run.app", local.projectNumber, local.region) // deterministic Cloud Run url
   runnerDockerImage           = "privatehive/github-runner-autoscaler"
   runnerDockerTag             = local.autoscaler_version
+  // polling, MAX_CONCURRENCY and SCALING_SCHEDULE keep workflow jobs in memory - the autoscaler has to keep running with CPU always allocated
+  keepAutoscalerRunning       = var.poll_interval > 0 || length(setintersection(keys(var.autoscaler_extra_env), ["MAX_CONCURRENCY", "SCALING_SCHEDULE"])) > 0
 }
 
 resource "google_project_service" "compute_api" {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"os"
 	"strconv"
 	"strings"
@@ -38,6 +40,22 @@ func mustGetEnv(name string) string {
 	}
 }
 
+// the env is only mandatory if required is set
+func mustGetEnvIf(required bool, name string) string {
+
+	if required {
+		return mustGetEnv(name)
+	}
+	return getEnvDefault(name, "")
+}
+
+func mustGetEnvJson(name string, defaultValue string, target any) {
+
+	if err := json.Unmarshal([]byte(getEnvDefault(name, defaultValue)), target); err != nil {
+		panic("Env " + name + " is not valid json: " + err.Error())
+	}
+}
+
 func mustBase64Decode(data string) string {
 
 	if data, err := base64.StdEncoding.DecodeString(data); err != nil {
@@ -49,6 +67,13 @@ func mustBase64Decode(data string) string {
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	logrus.SetFormatter(&logrus.JSONFormatter{
 		DisableTimestamp: true,
 		FieldMap: logrus.FieldMap{
@@ -63,23 +88,72 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 
+	backend := pkg.BackendType(getEnvDefault("BACKEND", string(pkg.BackendInstances)))
+	// the container backends run without GCE (e.g. locally or on GKE)
+	gce := backend != pkg.BackendDocker && backend != pkg.BackendKubernetes
+	// without GCP (docker backend) the PAT may be given as env var instead of a Secret Manager secret version
+	pat := ""
+	if backend == pkg.BackendDocker {
+		pat = getEnvDefault("GITHUB_PAT", "")
+	}
+	zones := []string{}
+	if zonesEnv := mustGetEnvIf(gce, "ZONES"); len(zonesEnv) > 0 {
+		zones = strings.Split(zonesEnv, ",")
+	}
+
 	config := pkg.AutoscalerConfig{
-		RouteWebhook:      getEnvDefault("ROUTE_WEBHOOK", "/webhook"),
-		RouteDeleteVm:     getEnvDefault("ROUTE_DELETE_VM", "/delete_vm"),
-		RouteCreateVm:     getEnvDefault("ROUTE_CREATE_VM", "/create_vm"),
-		ProjectId:         mustGetEnv("PROJECT_ID"),
-		Zones:             strings.Split(mustGetEnv("ZONES"), ","),
-		TaskQueue:         mustGetEnv("TASK_QUEUE"),
-		TaskTimeout:       getEnvDefaultInt64("TASK_DISPATCH_TIMEOUT", 180),
-		InstanceTemplate:  mustGetEnv("INSTANCE_TEMPLATE"),
-		SecretVersion:     mustGetEnv("SECRET_VERSION"),
-		RunnerPrefix:      getEnvDefault("RUNNER_PREFIX", "runner"),
-		RunnerGroupId:     getEnvDefaultInt64("RUNNER_GROUP_ID", 1),
-		RunnerLabels:      []string{},
-		RegisteredSources: map[string]pkg.Source{},
-		SourceQueryParam:  getEnvDefault("SOURCE_QUERY_PARAM_NAME", "src"),
-		CreateVmDelay:     getEnvDefaultInt64("CREATE_VM_DELAY", 10),
-		Simulate:          getEnvDefaultInt64("SIMULATE", 0) == 1,
+		RouteWebhook:         getEnvDefault("ROUTE_WEBHOOK", "/webhook"),
+		RouteDeleteVm:        getEnvDefault("ROUTE_DELETE_VM", "/delete_vm"),
+		RouteCreateVm:        getEnvDefault("ROUTE_CREATE_VM", "/create_vm"),
+		RouteCheckJob:        getEnvDefault("ROUTE_CHECK_JOB", "/check_job"),
+		RouteVerifyVm:        getEnvDefault("ROUTE_VERIFY_VM", "/verify_vm"),
+		ProjectId:            mustGetEnvIf(gce, "PROJECT_ID"),
+		Zones:                zones,
+		TaskQueue:            mustGetEnv("TASK_QUEUE"),
+		TaskTimeout:          getEnvDefaultInt64("TASK_DISPATCH_TIMEOUT", 180),
+		InstanceTemplate:     mustGetEnvIf(gce, "INSTANCE_TEMPLATE"),
+		SecretVersion:        mustGetEnvIf(len(pat) == 0, "SECRET_VERSION"),
+		GitHubPat:            pat,
+		RunnerPrefix:         getEnvDefault("RUNNER_PREFIX", "runner"),
+		RunnerGroupId:        getEnvDefaultInt64("RUNNER_GROUP_ID", 1),
+		RunnerLabels:         []string{},
+		LabelMatchMode:       pkg.LabelMatchMode(getEnvDefault("LABEL_MATCH_MODE", string(pkg.MatchAll))),
+		RunnerProfiles:       []pkg.RunnerProfile{},
+		RunnerGroupRoutes:    []pkg.RunnerGroupRoute{},
+		RegisteredSources:    map[string]pkg.Source{},
+		SourceQueryParam:     getEnvDefault("SOURCE_QUERY_PARAM_NAME", "src"),
+		CreateVmDelay:        getEnvDefaultInt64("CREATE_VM_DELAY", 10),
+		MaxConcurrency:       getEnvDefaultInt64("MAX_CONCURRENCY", 0),
+		PriorityRules:        []pkg.PriorityRule{},
+		StuckJobTimeout:      getEnvDefaultInt64("STUCK_JOB_TIMEOUT", 0),
+		StuckJobAttempts:     getEnvDefaultInt64("STUCK_JOB_ATTEMPTS", 3),
+		SerialOutputSink:     getEnvDefault("SERIAL_OUTPUT_SINK", ""),
+		SerialOutputComment:  getEnvDefaultInt64("SERIAL_OUTPUT_COMMENT", 0) == 1,
+		AuditSink:            getEnvDefault("AUDIT_SINK", "stdout"),
+		PriceTable:           pkg.PriceTable{},
+		CostRetention:        getEnvDefaultInt64("COST_RETENTION_DAYS", 35),
+		InstanceTemplateSpot: getEnvDefaultInt64("INSTANCE_TEMPLATE_SPOT", 0) == 1,
+		ApiToken:             getEnvDefault("API_TOKEN", ""),
+		AdminToken:           getEnvDefault("ADMIN_TOKEN", ""),
+		CallbackHost:         getEnvDefault("CALLBACK_HOST", ""),
+		PollInterval:         getEnvDefaultInt64("POLL_INTERVAL", 0),
+		GitHubTimeout:        getEnvDefaultInt64("GITHUB_API_TIMEOUT", 10),
+		GitHubApiUrl:         getEnvDefault("GITHUB_API_URL", ""),
+		GitHubMaxRetries:     getEnvDefaultInt64("GITHUB_API_MAX_RETRIES", 3),
+		BulkCreateWindow:     getEnvDefaultInt64("BULK_CREATE_WINDOW", 0),
+		Backend:              backend,
+		InstanceGroupManager: getEnvDefault("INSTANCE_GROUP_MANAGER", ""),
+		DockerHost:           getEnvDefault("DOCKER_HOST", "unix:///var/run/docker.sock"),
+		RunnerImage:          getEnvDefault("RUNNER_IMAGE", "ghcr.io/actions/actions-runner:latest"),
+		KubernetesNamespace:  getEnvDefault("KUBERNETES_NAMESPACE", "default"),
+		Kubeconfig:           getEnvDefault("KUBECONFIG", ""),
+		PatCacheTtl:          getEnvDefaultInt64("PAT_CACHE_TTL", 300),
+		AsyncCreate:          getEnvDefaultInt64("ASYNC_CREATE", 0) == 1,
+		VerifyVmDelay:        getEnvDefaultInt64("VERIFY_VM_DELAY", 30),
+		CreateVmAttempts:     getEnvDefaultInt64("CREATE_VM_ATTEMPTS", 3),
+		ShutdownTimeout:      getEnvDefaultInt64("SHUTDOWN_TIMEOUT", 7),
+		Drain:                getEnvDefaultInt64("DRAIN", 0) == 1,
+		Simulate:             getEnvDefaultInt64("SIMULATE", 0) == 1,
 	}
 
 	if enterpriseEnv := strings.Split(getEnvDefault("GITHUB_ENTERPRISE", ""), ";"); len(enterpriseEnv) == 2 {
@@ -123,17 +197,53 @@ func main() {
 		}
 	}
 
+	mustGetEnvJson("PRICE_TABLE", "{}", &config.PriceTable)
+	mustGetEnvJson("RUNNER_PROFILES", "[]", &config.RunnerProfiles)
+	mustGetEnvJson("RUNNER_GROUP_ROUTES", "[]", &config.RunnerGroupRoutes)
+	mustGetEnvJson("SECURITY_POLICY", "{}", &config.SecurityPolicy)
+	mustGetEnvJson("PRIORITY_RULES", "[]", &config.PriorityRules)
+	mustGetEnvJson("SCALING_SCHEDULE", "{}", &config.ScalingSchedule)
+
+	sourceSettings := map[string]pkg.SourceSettings{}
+	mustGetEnvJson("SOURCE_SETTINGS", "{}", &sourceSettings)
+	for name, settings := range sourceSettings {
+		if source, ok := config.RegisteredSources[name]; ok {
+			if settings.RegistrationMode != "" && settings.RegistrationMode != pkg.RegistrationJit && settings.RegistrationMode != pkg.RegistrationToken {
+				panic("Unknown registration mode \"" + string(settings.RegistrationMode) + "\" for source " + name)
+			}
+			source.SourceSettings = settings
+			config.RegisteredSources[name] = source
+			log.Infof("Applied settings to webhook source: %s", name)
+		} else {
+			log.Warnf("Found settings for unknown webhook source - will be ignored: %s", name)
+		}
+	}
+
 	if labels := strings.Split(getEnvDefault("RUNNER_LABELS", "self-hosted"), ","); len(labels) == 0 {
 		log.Warn("No workflow runner labels were provided. You should at least add the label \"self-hosted\"")
 	} else {
 		config.RunnerLabels = labels
 	}
 
+	logrus.AddHook(&pkg.TraceHook{ProjectId: config.ProjectId})
+	if shutdownTracing, err := pkg.InitTracing(context.Background(), pkg.SERVICE_NAME, getEnvDefault("K_REVISION", "dev")); err != nil {
+		panic("Could not initialize tracing: " + err.Error())
+	} else {
+		defer shutdownTracing(context.Background())
+	}
+
 	if config.Simulate {
 		log.Warn("Simulation mode is active - no VMs will be created/deleted")
 	}
+	if config.Drain {
+		log.Warn("Drain mode is active - workflow jobs are held until draining is stopped via the admin API")
+	}
 
 	port, _ := strconv.Atoi(getEnvDefault("PORT", "8080"))
-	log.Infof("Starting autoscaler on port %d observing workflow jobs with labels \"%s\"", port, strings.Join(config.RunnerLabels, ", "))
+	if len(config.RunnerProfiles) > 0 {
+		log.Infof("Starting autoscaler on port %d observing workflow jobs matching %d runner profile(s)", port, len(config.RunnerProfiles))
+	} else {
+		log.Infof("Starting autoscaler on port %d observing workflow jobs with labels \"%s\"", port, strings.Join(config.RunnerLabels, ", "))
+	}
 	pkg.NewAutoscaler(config).Srv(port)
 }
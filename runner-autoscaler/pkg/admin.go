@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+)
+
+const REDACTED string = "<redacted>"
+
+const WORKFLOW_JOB_ENDPOINT string = "https://api.github.com/repos/%s/actions/jobs/%d" // format USER/REPO
+
+// A runner VM created by the autoscaler
+type ManagedVm struct {
+	Name        string    `json:"name"`
+	Zone        string    `json:"zone"`
+	Status      string    `json:"status"`
+	MachineType string    `json:"machine_type"`
+	CreatedAt   time.Time `json:"created_at"`
+	AgeSec      float64   `json:"age_sec"`
+	Source      string    `json:"source,omitempty"`
+	Repository  string    `json:"repository,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	JobId       int64     `json:"job_id,omitempty"`
+	JobState    JobState  `json:"job_state,omitempty"` // the state of the job as seen by the autoscaler (empty if unknown)
+}
+
+type AdminStatus struct {
+	Draining      bool        `json:"draining"`
+	PausedSources []string    `json:"paused_sources"`
+	Queue         QueueStatus `json:"queue"`
+}
+
+type ReconcileResult struct {
+	Released   int      `json:"released"`    // pending jobs that were released
+	DeletedVms []string `json:"deleted_vms"` // VMs of completed or failed jobs
+	Errors     []string `json:"errors,omitempty"`
+}
+
+func (s *Autoscaler) requireAdminToken(ctx *gin.Context) {
+
+	token, _ := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if len(s.conf.AdminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.AdminToken)) != 1 {
+		log.WithContext(ctx.Request.Context()).Warnf("%s did not provide a valid admin token", ctx.RemoteIP())
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// true if no VMs are created right now - the jobs are held until the autoscaler stops draining
+func (s *Autoscaler) IsDraining() bool {
+
+	return s.draining.Load()
+}
+
+func (s *Autoscaler) SetDraining(draining bool) {
+
+	if s.draining.Swap(draining) != draining {
+		log.Infof("Draining: %t", draining)
+	}
+	if !draining {
+		s.wakeScheduler()
+	}
+}
+
+// true if the create requests of the source are held by the scheduler (draining or the source is paused)
+func (s *Autoscaler) isHeld(src Source) bool {
+
+	return s.IsDraining() || s.scheduler.IsPaused(src.Name)
+}
+
+// Lists the VMs labeled as managed by the autoscaler in all zones
+func (s *Autoscaler) ListInstances(ctx context.Context) ([]ManagedVm, error) {
+
+	ret := []ManagedVm{}
+	if s.conf.Simulate {
+		return ret, nil
+	}
+	client := s.computeClient()
+	for _, zone := range s.conf.Zones {
+		it := client.List(ctx, &computepb.ListInstancesRequest{
+			Project: s.conf.ProjectId,
+			Zone:    zone,
+			Filter:  proto.String(fmt.Sprintf("labels.%s = %s", VM_LABEL_MANAGED_BY, VM_LABEL_MANAGED_BY_VALUE)),
+		})
+		for {
+			instance, err := it.Next()
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				log.WithContext(ctx).Errorf("Could not list instances in zone %s: %s", zone, err.Error())
+				return nil, err
+			}
+			ret = append(ret, s.managedVm(zone, instance))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+	return ret, nil
+}
+
+func (s *Autoscaler) managedVm(zone string, instance *computepb.Instance) ManagedVm {
+
+	created, _ := time.Parse(time.RFC3339, instance.GetCreationTimestamp())
+	return runnerVm(instance.GetName(), zone, instance.GetStatus(), path.Base(instance.GetMachineType()), created, instance.GetLabels())
+}
+
+// a runner described by the labels the autoscaler set (see runnerVmLabels). The job state is filled in by listRunners
+func runnerVm(name string, zone string, status string, machineType string, created time.Time, labels map[string]string) ManagedVm {
+
+	vm := ManagedVm{
+		Name:        name,
+		Zone:        zone,
+		Status:      status,
+		MachineType: machineType,
+		Source:      labels[VM_LABEL_SOURCE],
+		Repository:  labels[VM_LABEL_REPOSITORY],
+		Profile:     labels[VM_LABEL_PROFILE],
+	}
+	if !created.IsZero() {
+		vm.CreatedAt = created
+		vm.AgeSec = time.Since(created).Seconds()
+	}
+	if jobId, err := strconv.ParseInt(labels[VM_LABEL_JOB_ID], 10, 64); err == nil {
+		vm.JobId = jobId
+	}
+	return vm
+}
+
+// Lists the runners of the backend with the state of their jobs as seen by the autoscaler
+func (s *Autoscaler) listRunners(ctx context.Context) ([]ManagedVm, error) {
+
+	vms, err := s.backend.ListRunners(ctx)
+	for i := range vms {
+		if record, ok := s.jobs.Get(vms[i].JobId); ok && vms[i].JobId > 0 {
+			vms[i].JobState = record.State
+		}
+	}
+	return vms, err
+}
+
+// deletes a runner VM regardless of the state of its job
+func (s *Autoscaler) forceDeleteVm(ctx context.Context, vmName string) error {
+
+	if !strings.HasPrefix(vmName, s.conf.RunnerPrefix+"-") {
+		return fmt.Errorf("%s is not a runner VM (expected prefix \"%s-\")", vmName, s.conf.RunnerPrefix)
+	}
+	src, job := s.vmJob(vmName)
+	return s.deleteVm(ctx, src, job, vmName, "deleted by admin")
+}
+
+// Looks up the workflow job of a runner VM the autoscaler does not know (e.g. the autoscaler restarted) on GitHub. The repository is
+// taken from the sanitized labels of the VM (see runnerVmLabels): the owner can't contain "_", so the first "_" separates owner and
+// name. GitHub resolves repositories case-insensitively, so only repository names containing "." (or longer than the label) can't be
+// looked up
+func (s *Autoscaler) lookupVmJob(ctx context.Context, vm ManagedVm) (Source, Job, error) {
+
+	for _, src := range s.conf.RegisteredSources {
+		if SanitizeLabelValue(src.Name) != vm.Source {
+			continue
+		}
+		repo := src.Name
+		if src.SourceType != TypeRepository {
+			if owner, name, ok := strings.Cut(vm.Repository, "_"); ok {
+				repo = owner + "/" + name
+			} else {
+				return src, Job{}, fmt.Errorf("the repository of VM %s is unknown", vm.Name)
+			}
+		}
+		job := Job{}
+		err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(WORKFLOW_JOB_ENDPOINT, repo, vm.JobId), nil, &job, http.StatusOK)
+		return src, job, err
+	}
+	return Source{}, Job{}, fmt.Errorf("source %s of VM %s is not registered", vm.Source, vm.Name)
+}
+
+// Releases the pending jobs, checks the tracked jobs and queued jobs on GitHub (see polling - only if POLL_INTERVAL is set) and
+// deletes the VMs of jobs that already completed or failed (e.g. the delete-vm callback got lost). The jobs of VMs the autoscaler
+// does not know are looked up on GitHub
+func (s *Autoscaler) Reconcile(ctx context.Context) ReconcileResult {
+
+	result := ReconcileResult{DeletedVms: []string{}}
+	pending := len(s.scheduler.Pending())
+	s.releaseJobs(ctx)
+	result.Released = pending - len(s.scheduler.Pending())
+	if s.conf.PollInterval > 0 {
+		s.PollOnce(ctx, 0)
+	}
+	if vms, err := s.listRunners(ctx); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	} else {
+		for _, vm := range vms {
+			if len(vm.JobState) == 0 && vm.JobId > 0 {
+				if src, job, err := s.lookupVmJob(ctx, vm); err != nil {
+					log.WithContext(ctx).Warnf("Reconcile: could not look up workflow job Id %d of VM %s: %s", vm.JobId, vm.Name, err.Error())
+					result.Errors = append(result.Errors, fmt.Sprintf("could not look up workflow job Id %d of VM %s: %s", vm.JobId, vm.Name, err.Error()))
+				} else if job.Status == string(COMPLETED) {
+					log.WithContext(ctx).Infof("Reconcile: deleting VM %s of completed workflow job Id %d", vm.Name, vm.JobId)
+					s.jobs.SetState(src.Name, job, JobCompleted)
+					if err := s.deleteVm(ctx, src, job, vm.Name, "deleted by admin"); err != nil {
+						result.Errors = append(result.Errors, err.Error())
+					} else {
+						result.DeletedVms = append(result.DeletedVms, vm.Name)
+					}
+				}
+				continue
+			}
+			if vm.JobState != JobCompleted && vm.JobState != JobFailed {
+				continue
+			}
+			log.WithContext(ctx).Infof("Reconcile: deleting VM %s of %s workflow job Id %d", vm.Name, vm.JobState, vm.JobId)
+			if err := s.forceDeleteVm(ctx, vm.Name); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			} else {
+				result.DeletedVms = append(result.DeletedVms, vm.Name)
+			}
+		}
+	}
+	return result
+}
+
+// the config with the webhook secrets and tokens redacted
+func (s *Autoscaler) redactedConfig() AutoscalerConfig {
+
+	redact := func(secret string) string {
+		if len(secret) == 0 {
+			return ""
+		}
+		return REDACTED
+	}
+	config := s.conf
+	config.ApiToken = redact(config.ApiToken)
+	config.AdminToken = redact(config.AdminToken)
+	config.GitHubPat = redact(config.GitHubPat)
+	config.RegisteredSources = map[string]Source{}
+	for name, src := range s.conf.RegisteredSources {
+		src.Secret = redact(src.Secret)
+		config.RegisteredSources[name] = src
+	}
+	return config
+}
+
+func (s *Autoscaler) handleAdminStatus(ctx *gin.Context) {
+
+	ctx.JSON(http.StatusOK, AdminStatus{Draining: s.IsDraining(), PausedSources: s.scheduler.Paused(), Queue: s.queueStatus(false)})
+}
+
+func (s *Autoscaler) handleAdminListVms(ctx *gin.Context) {
+
+	if vms, err := s.listRunners(ctx.Request.Context()); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		ctx.JSON(http.StatusOK, vms)
+	}
+}
+
+func (s *Autoscaler) handleAdminDeleteVm(ctx *gin.Context) {
+
+	log.WithContext(ctx.Request.Context()).Warnf("Admin %s requested to delete VM %s", ctx.RemoteIP(), ctx.Param("name"))
+	if !strings.HasPrefix(ctx.Param("name"), s.conf.RunnerPrefix+"-") {
+		ctx.AbortWithStatus(http.StatusNotFound)
+	} else if err := s.forceDeleteVm(ctx.Request.Context(), ctx.Param("name")); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (s *Autoscaler) handleAdminDrain(ctx *gin.Context) {
+
+	s.SetDraining(ctx.Request.Method == http.MethodPost)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Autoscaler) handleAdminPauseSource(ctx *gin.Context) {
+
+	name := ctx.Query("source")
+	if _, ok := s.conf.RegisteredSources[name]; !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+	} else if ctx.Request.Method == http.MethodPost {
+		log.WithContext(ctx.Request.Context()).Infof("Pausing source %s", name)
+		s.scheduler.Pause(name)
+		ctx.Status(http.StatusNoContent)
+	} else {
+		log.WithContext(ctx.Request.Context()).Infof("Resuming source %s", name)
+		s.scheduler.Resume(name)
+		s.wakeScheduler()
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func (s *Autoscaler) handleAdminReconcile(ctx *gin.Context) {
+
+	ctx.JSON(http.StatusOK, s.Reconcile(ctx.Request.Context()))
+}
+
+func (s *Autoscaler) handleAdminConfig(ctx *gin.Context) {
+
+	ctx.JSON(http.StatusOK, s.redactedConfig())
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// the verify-vm callback is re-enqueued (every VERIFY_VM_DELAY seconds) this often while the insert operation is running
+const VERIFY_VM_MAX_CHECKS int64 = 10
+
+// a failed VM creation is retried after this delay if the VM could not be created in any zone
+const CREATE_VM_RETRY_DELAY time.Duration = 30 * time.Second
+
+const SIMULATED_OPERATION string = "simulated"
+
+var ErrOperationRunning = errors.New("operation is still running")
+
+// The insert operation of a VM finished with an error (e.g. the zone is out of resources)
+type OperationError struct {
+	Operation string
+	Messages  []string
+}
+
+func (e *OperationError) Error() string {
+
+	return fmt.Sprintf("operation %s failed: %s", e.Operation, strings.Join(e.Messages, "; "))
+}
+
+// A random VM name. The zone is derived from the name (see PickRandomZone), so names are drawn until the zone is none of the zones to
+// avoid. If all zones have to be avoided any zone is picked
+func (s *Autoscaler) newVmName(avoidZones []string) string {
+
+	name := fmt.Sprintf("%s-%s", s.conf.RunnerPrefix, RandStringRunes(10))
+	if !slices.ContainsFunc(s.conf.Zones, func(zone string) bool { return !slices.Contains(avoidZones, zone) }) {
+		return name
+	}
+	for slices.Contains(avoidZones, s.PickRandomZone(name)) {
+		name = fmt.Sprintf("%s-%s", s.conf.RunnerPrefix, RandStringRunes(10))
+	}
+	return name
+}
+
+// creates the VM instance. Blocking unless ASYNC_CREATE is enabled - then the name of the insert operation is returned
+func (s *Autoscaler) insertVm(ctx context.Context, settings VmSettings, metadata ...*computepb.Items) (string, error) {
+
+	if s.conf.AsyncCreate {
+		return s.InsertInstanceFromTemplate(ctx, settings, metadata...)
+	}
+	return "", s.CreateInstanceFromTemplate(ctx, settings, metadata...)
+}
+
+// Starts the creation of the instance without waiting for it. Returns the name of the insert operation
+func (s *Autoscaler) InsertInstanceFromTemplate(ctx context.Context, settings VmSettings, metadata ...*computepb.Items) (_ string, err error) {
+
+	ctx, span := startSpan(ctx, "compute.InsertInstance", ATTR_VM_NAME.String(settings.Name))
+	defer func() { endSpan(span, err) }()
+
+	if s.conf.Simulate {
+		log.WithContext(ctx).Infof("(SIMULATE) Inserted instance %s from template", settings.Name)
+		return SIMULATED_OPERATION, nil
+	} else if res, err := s.insertInstance(ctx, settings, metadata); err != nil {
+		return "", err
+	} else {
+		log.WithContext(ctx).Infof("Insert operation %s of instance %s (%s) accepted", res.Name(), settings.Name, s.PickRandomZone(settings.Name))
+		return res.Name(), nil
+	}
+}
+
+// Returns nil if the operation finished successfully, ErrOperationRunning if it did not finish yet and an OperationError if it failed
+func OperationResult(op *computepb.Operation) error {
+
+	if op.GetStatus() != computepb.Operation_DONE {
+		return ErrOperationRunning
+	} else if op.GetError() != nil && len(op.GetError().GetErrors()) > 0 {
+		opErr := &OperationError{Operation: op.GetName()}
+		for _, e := range op.GetError().GetErrors() {
+			opErr.Messages = append(opErr.Messages, fmt.Sprintf("%s: %s", e.GetCode(), e.GetMessage()))
+		}
+		return opErr
+	} else if op.GetHttpErrorStatusCode() >= http.StatusBadRequest {
+		return &OperationError{Operation: op.GetName(), Messages: []string{op.GetHttpErrorMessage()}}
+	}
+	return nil
+}
+
+// Reads the insert operation of the VM instance (see OperationResult)
+func (s *Autoscaler) GetInsertOperation(ctx context.Context, instanceName string, operation string) (err error) {
+
+	ctx, span := startSpan(ctx, "compute.GetOperation", ATTR_VM_NAME.String(instanceName))
+	defer func() {
+		if errors.Is(err, ErrOperationRunning) {
+			endSpan(span, nil)
+		} else {
+			endSpan(span, err)
+		}
+	}()
+
+	if s.conf.Simulate {
+		return nil
+	}
+	zone := s.PickRandomZone(instanceName)
+	client := s.zoneOperationsClient()
+	if op, err := client.Get(ctx, &computepb.GetZoneOperationRequest{
+		Project:   s.conf.ProjectId,
+		Zone:      zone,
+		Operation: operation,
+	}); err != nil {
+		log.WithContext(ctx).Errorf("Could not read operation %s of instance %s (%s): %s", operation, instanceName, zone, err.Error())
+		return err
+	} else {
+		return OperationResult(op)
+	}
+}
+
+// enqueues the verify-vm callback that checks the insert operation of the VM in VERIFY_VM_DELAY seconds
+func (s *Autoscaler) enqueueVerifyVm(ctx context.Context, host string, src Source, task RunnerTask, profile *RunnerProfile, vmName string, operation string, start time.Time) error {
+
+	s.jobs.SetVm(src.Name, task.Job, vmName, profile.Name, task.Attempt)
+	task.VmName = vmName
+	task.Operation = operation
+	task.InsertedAt = &start
+	verifyUrl := createCallbackUrl(host, s.conf.RouteVerifyVm, s.conf.SourceQueryParam, src.Name)
+	taskId := fmt.Sprintf("%d-verify-%d-%d-%d", task.Id, task.Attempt, len(task.FailedZones), task.Checks)
+	if err := s.createCallbackTask(ctx, verifyUrl, src.Secret, taskId, task.Id, task, time.Duration(s.conf.VerifyVmDelay)*time.Second); err != nil {
+		// without the callback nobody notices if the VM could not be created - Cloud Tasks retries the create-vm callback
+		log.WithContext(ctx).Errorf("Can not enqueue verify-vm cloud task callback for workflow job Id %d: %s", task.Id, err.Error())
+		s.creating.Delete(task.Id)
+		return err
+	}
+	return nil
+}
+
+// Falls back to another zone after the VM could not be created (or retries in any zone after CREATE_VM_RETRY_DELAY if all zones failed).
+// Gives up after CREATE_VM_ATTEMPTS failed VMs
+func (s *Autoscaler) retryCreateVm(ctx context.Context, host string, src Source, task RunnerTask, vmName string, cause error) error {
+
+	if record, ok := s.jobs.Get(task.Id); ok && record.State != JobQueued {
+		log.WithContext(ctx).Infof("Workflow job Id %d is %s - not retrying to create a VM", task.Id, record.State)
+		return nil
+	}
+	task.FailedZones = append(task.FailedZones, s.PickRandomZone(vmName))
+	task.VmName = ""
+	task.Operation = ""
+	task.InsertedAt = nil
+	task.Checks = 0
+	if int64(len(task.FailedZones)) >= s.conf.CreateVmAttempts {
+		log.WithContext(ctx).Errorf("Could not create a VM for workflow job Id %d in %d attempts - giving up", task.Id, len(task.FailedZones))
+		s.jobs.SetState(src.Name, task.Job, JobFailed)
+		event := newJobEvent(AuditJobFailed, OutcomeFailure, src, task.Job)
+		event.Attempt = task.Attempt
+		event.Reason = fmt.Sprintf("no VM could be created in %d attempts (zones %s): %s", len(task.FailedZones), strings.Join(task.FailedZones, ", "), cause.Error())
+		s.audit(ctx, event)
+		return nil
+	}
+	delay := time.Duration(0)
+	if !slices.ContainsFunc(s.conf.Zones, func(zone string) bool { return !slices.Contains(task.FailedZones, zone) }) {
+		delay = CREATE_VM_RETRY_DELAY
+	}
+	log.WithContext(ctx).Warnf("Retrying to create a VM for workflow job Id %d in %s (attempt %d/%d)", task.Id, delay.String(), len(task.FailedZones)+1, s.conf.CreateVmAttempts)
+	createUrl := createCallbackUrl(host, s.conf.RouteCreateVm, s.conf.SourceQueryParam, src.Name)
+	if err := s.createCallbackTask(ctx, createUrl, src.Secret, fmt.Sprintf("%d-create-%d-%d", task.Id, task.Attempt, len(task.FailedZones)), task.Id, task, delay); err != nil {
+		log.WithContext(ctx).Errorf("Can not enqueue create-vm cloud task callback for workflow job Id %d: %s", task.Id, err.Error())
+		return err
+	}
+	return nil
+}
+
+// checks the insert operation of the VM: the VM is either created, still being created (the check is repeated) or failed (zone fallback)
+func (s *Autoscaler) verifyVm(ctx context.Context, host string, src Source, task RunnerTask) error {
+
+	profile, _ := s.resolveProfile(task)
+	start := time.Now()
+	if task.InsertedAt != nil {
+		start = *task.InsertedAt
+	}
+	err := s.GetInsertOperation(ctx, task.VmName, task.Operation)
+	if errors.Is(err, ErrOperationRunning) && task.Checks+1 < VERIFY_VM_MAX_CHECKS {
+		log.WithContext(ctx).Infof("VM %s of workflow job Id %d is still being created", task.VmName, task.Id)
+		task.Checks++
+		verifyUrl := createCallbackUrl(host, s.conf.RouteVerifyVm, s.conf.SourceQueryParam, src.Name)
+		taskId := fmt.Sprintf("%d-verify-%d-%d-%d", task.Id, task.Attempt, len(task.FailedZones), task.Checks)
+		return s.createCallbackTask(ctx, verifyUrl, src.Secret, taskId, task.Id, task, time.Duration(s.conf.VerifyVmDelay)*time.Second)
+	} else if errors.Is(err, ErrOperationRunning) {
+		err = &OperationError{Operation: task.Operation, Messages: []string{fmt.Sprintf("not done after %d checks", task.Checks+1)}}
+		// the VM may still come up
+		if err := s.deleteVm(ctx, src, task.Job, task.VmName, err.Error()); err != nil {
+			log.WithContext(ctx).Warnf("Could not delete VM %s: %s", task.VmName, err.Error())
+		}
+	}
+	var opErr *OperationError
+	if err != nil && !errors.As(err, &opErr) {
+		// could not read the operation - Cloud Tasks retries the verify-vm callback
+		return err
+	}
+	s.creating.Delete(task.Id)
+	event := s.vmCreatedEvent(ctx, src, profile, task, task.VmName, start)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Could not create VM %s for workflow job Id %d: %s", task.VmName, task.Id, err.Error())
+		event.Type = AuditVmCreateFailed
+		event.Outcome = OutcomeFailure
+		event.Reason = err.Error()
+		s.audit(ctx, event)
+		return s.retryCreateVm(ctx, host, src, task, task.VmName, err)
+	}
+	log.WithContext(ctx).Infof("Created VM %s for workflow job Id %d", task.VmName, task.Id)
+	s.runnerCreated(ctx, host, src, task, event)
+	return nil
+}
+
+// Invoked by Cloud Tasks VERIFY_VM_DELAY seconds after the insert operation of a VM was accepted (see ASYNC_CREATE)
+func (s *Autoscaler) handleVerifyVm(ctx *gin.Context) {
+
+	log.WithContext(ctx.Request.Context()).Info("Received verify-vm cloud task callback")
+	if data, src, err := s.verifySignature(ctx); err == nil {
+		task := RunnerTask{}
+		json.Unmarshal(data, &task)
+		reqCtx, span := startHandlerSpan(ctx, "verify-vm", task.Id, ATTR_SOURCE.String(src.Name), ATTR_VM_NAME.String(task.VmName))
+		defer endHandlerSpan(ctx, span)
+		if err := s.verifyVm(reqCtx, ctx.Request.Host, src, task); err != nil {
+			abortWithError(ctx, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	}
+}
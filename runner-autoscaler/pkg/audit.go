@@ -0,0 +1,307 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The version of the audit event schema. It is increased on every incompatible change (removed/renamed fields or changed semantic).
+// Adding fields is not considered an incompatible change
+const AUDIT_SCHEMA_VERSION string = "1"
+
+// the http sink delivers the events in the background - once this many events are waiting for delivery new events are dropped
+const AUDIT_QUEUE_SIZE int = 1000
+
+// how long the shutdown waits for the http sink to deliver the queued events
+const AUDIT_FLUSH_TIMEOUT time.Duration = 5 * time.Second
+
+type AuditEventType string
+
+const (
+	AuditJobPending     AuditEventType = "job.pending"
+	AuditJobQueued      AuditEventType = "job.queued"
+	AuditJobRejected    AuditEventType = "job.rejected"
+	AuditJobIsolated    AuditEventType = "job.isolated"
+	AuditJobWaiting     AuditEventType = "job.waiting"
+	AuditJobInProgress  AuditEventType = "job.in_progress"
+	AuditJobCompleted   AuditEventType = "job.completed"
+	AuditJobStuck       AuditEventType = "job.stuck"
+	AuditJobFailed      AuditEventType = "job.failed"
+	AuditVmCreated      AuditEventType = "vm.created"
+	AuditVmCreateFailed AuditEventType = "vm.create_failed"
+	AuditVmDeleted      AuditEventType = "vm.deleted"
+	AuditVmDeleteFailed AuditEventType = "vm.delete_failed"
+	AuditCallbackFailed AuditEventType = "callback.enqueue_failed"
+)
+
+type AuditOutcome string
+
+const (
+	OutcomeSuccess AuditOutcome = "success"
+	OutcomeFailure AuditOutcome = "failure"
+	OutcomeIgnored AuditOutcome = "ignored"
+)
+
+// A single audit event. See the "Audit log" section of the README for the documentation of the fields
+type AuditEvent struct {
+	SchemaVersion string         `json:"schema_version"`
+	Time          time.Time      `json:"time"`
+	Type          AuditEventType `json:"type"`
+	Outcome       AuditOutcome   `json:"outcome"`
+	Reason        string         `json:"reason,omitempty"`
+	Source        string         `json:"source,omitempty"`
+	JobId         int64          `json:"job_id,omitempty"`
+	JobName       string         `json:"job_name,omitempty"`
+	JobUrl        string         `json:"job_url,omitempty"`
+	Repository    string         `json:"repository,omitempty"`
+	Workflow      string         `json:"workflow,omitempty"`
+	RunId         int64          `json:"run_id,omitempty"`
+	RunAttempt    int64          `json:"run_attempt,omitempty"`
+	HeadBranch    string         `json:"head_branch,omitempty"`
+	HeadSha       string         `json:"head_sha,omitempty"`
+	Organization  string         `json:"organization,omitempty"`
+	Sender        string         `json:"sender,omitempty"`
+	Labels        []string       `json:"labels,omitempty"`
+	Profile       string         `json:"profile,omitempty"`
+	RunnerGroupId int64          `json:"runner_group_id,omitempty"`
+	VmName        string         `json:"vm_name,omitempty"`
+	Zone          string         `json:"zone,omitempty"`
+	MachineType   string         `json:"machine_type,omitempty"`
+	Spot          bool           `json:"spot,omitempty"`
+	Attempt       int64          `json:"attempt,omitempty"`
+	DurationSec   float64        `json:"duration_sec,omitempty"`
+	TraceId       string         `json:"trace_id,omitempty"`
+}
+
+// Receives the audit events. Implementations must be safe for concurrent use
+type AuditSink interface {
+	Emit(ctx context.Context, event AuditEvent) error
+	// Delivers the events that were emitted before (e.g. on shutdown). Returns once they are delivered or ctx is done. Events emitted
+	// afterwards may be rejected
+	Flush(ctx context.Context) error
+}
+
+// Creates a sink from an AUDIT_SINK value: "" or "stdout" (json lines on stdout), "none", "file:///some/file.jsonl" or "http(s)://host/path"
+func NewAuditSink(sink string) (AuditSink, error) {
+
+	if len(sink) == 0 || sink == "stdout" {
+		return &stdoutAuditSink{}, nil
+	} else if sink == "none" {
+		return nil, nil
+	} else if file, ok := strings.CutPrefix(sink, "file://"); ok {
+		if f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640); err != nil {
+			return nil, err
+		} else {
+			return &fileAuditSink{file: f}, nil
+		}
+	} else if strings.HasPrefix(sink, "http://") || strings.HasPrefix(sink, "https://") {
+		return newHttpAuditSink(sink, &http.Client{Timeout: 5 * time.Second, Transport: newTracingTransport()}), nil
+	}
+	return nil, fmt.Errorf("unsupported audit sink: %s", sink)
+}
+
+// Writes one json object per line to stdout. The event is nested in the field "audit", so Cloud Logging picks up the severity and
+// a log sink (e.g. to BigQuery) can filter for jsonPayload.audit.schema_version
+type stdoutAuditSink struct {
+	mu sync.Mutex
+}
+
+func (s *stdoutAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+
+	data, err := json.Marshal(map[string]any{
+		"severity": "INFO",
+		"message":  fmt.Sprintf("audit: %s", event.Type),
+		"audit":    event,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+func (s *stdoutAuditSink) Flush(ctx context.Context) error {
+
+	return nil
+}
+
+// Appends one json event per line to a file
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (f *fileAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(data, '\n'))
+	return err
+}
+
+func (f *fileAuditSink) Flush(ctx context.Context) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+type queuedAuditEvent struct {
+	ctx   context.Context
+	event AuditEvent
+}
+
+// POSTs every event as json. The events are delivered one after another by a background worker, so a slow or unreachable endpoint
+// does not delay the webhook and the callbacks. Events that can't be delivered are logged
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+	mu     sync.Mutex
+	closed bool
+	queue  chan queuedAuditEvent
+	done   chan struct{}
+}
+
+func newHttpAuditSink(url string, client *http.Client) *httpAuditSink {
+
+	h := &httpAuditSink{url: url, client: client, queue: make(chan queuedAuditEvent, AUDIT_QUEUE_SIZE), done: make(chan struct{})}
+	go h.deliver()
+	return h
+}
+
+// Queues the event for delivery. Fails if the queue is full (see AUDIT_QUEUE_SIZE) or the sink was flushed
+func (h *httpAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return fmt.Errorf("audit sink %s is closed", h.url)
+	}
+	select {
+	// the request that emitted the event may be done before the event is delivered - only its trace is kept
+	case h.queue <- queuedAuditEvent{ctx: context.WithoutCancel(ctx), event: event}:
+		return nil
+	default:
+		return fmt.Errorf("audit sink %s is not keeping up - %d events are waiting for delivery", h.url, AUDIT_QUEUE_SIZE)
+	}
+}
+
+func (h *httpAuditSink) Flush(ctx context.Context) error {
+
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mu.Unlock()
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audit sink %s: %d events were not delivered: %w", h.url, len(h.queue), ctx.Err())
+	}
+}
+
+func (h *httpAuditSink) deliver() {
+
+	defer close(h.done)
+	for queued := range h.queue {
+		if err := h.post(queued.ctx, queued.event); err != nil {
+			log.WithContext(queued.ctx).Errorf("Could not emit audit event %s for workflow job Id %d: %s", queued.event.Type, queued.event.JobId, err.Error())
+		}
+	}
+}
+
+func (h *httpAuditSink) post(ctx context.Context, event AuditEvent) error {
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("audit sink %s responded with status %d", h.url, res.StatusCode)
+	}
+	return nil
+}
+
+// creates an audit event pre-filled with the fields of the workflow job
+func newJobEvent(eventType AuditEventType, outcome AuditOutcome, src Source, job Job) AuditEvent {
+
+	event := AuditEvent{
+		Type:       eventType,
+		Outcome:    outcome,
+		Source:     src.Name,
+		JobId:      job.Id,
+		JobName:    job.Name,
+		JobUrl:     job.HtmlUrl,
+		Repository: job.repository(),
+		Workflow:   job.WorkflowName,
+		RunId:      job.RunId,
+		RunAttempt: job.RunAttempt,
+		HeadBranch: job.HeadBranch,
+		HeadSha:    job.HeadSha,
+		Labels:     job.Labels,
+	}
+	if job.Organization != nil {
+		event.Organization = job.Organization.Login
+	}
+	if job.Sender != nil {
+		event.Sender = job.Sender.Login
+	}
+	return event
+}
+
+// emits the audit event - failing to emit an event is logged but not considered an error
+func (s *Autoscaler) audit(ctx context.Context, event AuditEvent) {
+
+	event.SchemaVersion = AUDIT_SCHEMA_VERSION
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		event.TraceId = spanCtx.TraceID().String()
+	}
+	s.costs.Record(event)
+	s.activity.Record(event)
+	if s.auditSink == nil {
+		return
+	}
+	if err := s.auditSink.Emit(ctx, event); err != nil {
+		log.WithContext(ctx).Errorf("Could not emit audit event %s for workflow job Id %d: %s", event.Type, event.JobId, err.Error())
+	}
+}
+
+// the time since the job was queued (0 if unknown)
+func (s *Autoscaler) jobDuration(job Job) float64 {
+
+	if record, ok := s.jobs.Get(job.Id); ok && !record.QueuedAt.IsZero() {
+		return time.Since(record.QueuedAt).Seconds()
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+)
+
+type BackendType string
+
+const (
+	BackendInstances  BackendType = "instances"  // individual VM instances (default)
+	BackendMig        BackendType = "mig"        // instances of a regional managed instance group
+	BackendDocker     BackendType = "docker"     // containers on a Docker Engine
+	BackendKubernetes BackendType = "kubernetes" // Pods in a Kubernetes namespace
+)
+
+// A runner to create. The GCE backends pass the metadata to the VM, the container backends only need the jit config
+type RunnerSpec struct {
+	Settings  VmSettings
+	Metadata  []*computepb.Items // the guest metadata incl. the startup script that registers the runner
+	JitConfig string             // empty in registration mode "token"
+}
+
+// A Backend creates and deletes the runners. The rest of the job handling does not depend on the backend
+type Backend interface {
+	// Creates the runner. Returns the name of the operation if the runner is still being created (see ASYNC_CREATE)
+	CreateRunner(ctx context.Context, runner RunnerSpec) (string, error)
+	// Deletes the runner. A runner that is already gone is not an error
+	DeleteRunner(ctx context.Context, name string) error
+	// The zone of the runner or an empty string if it is not known (or the runner has no zone)
+	Zone(ctx context.Context, name string) string
+	// The state of the runner
+	RunnerState(ctx context.Context, name string) (State, error)
+	// The tail of the console output of the runner. Empty if it is not available
+	RunnerOutput(ctx context.Context, name string) string
+	// Lists the runners created by the autoscaler
+	ListRunners(ctx context.Context) ([]ManagedVm, error)
+}
+
+func newBackend(s *Autoscaler) (Backend, error) {
+
+	// GITHUB_PAT and the in-process task queue stand in for Secret Manager and Cloud Tasks where there is no GCP project (locally or
+	// on-prem). The other backends run on GCP and keep the PAT in Secret Manager and the callbacks in Cloud Tasks
+	if s.conf.Backend != BackendDocker {
+		if len(s.conf.GitHubPat) > 0 {
+			return nil, fmt.Errorf("GITHUB_PAT is only supported by the %s backend, use SECRET_VERSION", BackendDocker)
+		}
+		if s.conf.TaskQueue == LOCAL_TASK_QUEUE {
+			return nil, fmt.Errorf("TASK_QUEUE %q is only supported by the %s backend", LOCAL_TASK_QUEUE, BackendDocker)
+		}
+	}
+	switch s.conf.Backend {
+	case "", BackendInstances:
+		return &instanceBackend{s}, nil
+	case BackendMig:
+		return newMigBackend(s)
+	case BackendDocker, BackendKubernetes:
+		// the container backends pass the jit config to the runner image and create each runner right away
+		for name, src := range s.conf.RegisteredSources {
+			if src.RegistrationMode == RegistrationToken {
+				return nil, fmt.Errorf("source %s: the %s backend only supports registration mode \"jit\"", name, s.conf.Backend)
+			}
+		}
+		if s.conf.AsyncCreate || s.conf.BulkCreateWindow > 0 {
+			return nil, fmt.Errorf("ASYNC_CREATE and BULK_CREATE_WINDOW are not supported by the %s backend", s.conf.Backend)
+		}
+		if s.conf.Backend == BackendDocker {
+			return NewDockerBackend(s.conf.DockerHost, s.conf.RunnerImage)
+		}
+		if client, err := NewKubernetesClient(s.conf.Kubeconfig); err != nil {
+			return nil, err
+		} else {
+			return NewKubernetesBackend(client, s.conf.KubernetesNamespace, s.conf.RunnerImage)
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %s", s.conf.Backend)
+	}
+}
+
+// Creates individual VM instances from the instance template in the zone picked by the VM name
+type instanceBackend struct {
+	s *Autoscaler
+}
+
+func (b *instanceBackend) CreateRunner(ctx context.Context, runner RunnerSpec) (string, error) {
+
+	if b.s.bulk != nil && len(runner.JitConfig) > 0 {
+		return "", b.s.bulkInsertVm(ctx, runner.Settings, runner.JitConfig)
+	}
+	return b.s.insertVm(ctx, runner.Settings, runner.Metadata...)
+}
+
+func (b *instanceBackend) DeleteRunner(ctx context.Context, name string) error {
+
+	return b.s.DeleteInstance(ctx, name)
+}
+
+func (b *instanceBackend) Zone(ctx context.Context, name string) string {
+
+	return b.s.PickRandomZone(name)
+}
+
+func (b *instanceBackend) RunnerState(ctx context.Context, name string) (State, error) {
+
+	return b.s.GetInstanceState(ctx, name)
+}
+
+func (b *instanceBackend) RunnerOutput(ctx context.Context, name string) string {
+
+	return b.s.GetSerialOutput(ctx, name)
+}
+
+func (b *instanceBackend) ListRunners(ctx context.Context) ([]ManagedVm, error) {
+
+	return b.s.ListInstances(ctx)
+}
@@ -0,0 +1,275 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// a batch is inserted right away once it reaches this size
+const BULK_CREATE_MAX int = 100
+
+// The jit config is added to the instance metadata after the bulk insert. The startup script waits until it is available
+const runner_script_bulk_wrapper = `
+#!/bin/bash
+attr() {
+  curl -sf "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1" -H "Metadata-Flavor: Google"
+}
+until val=$(attr "%s"); do
+  sleep 2
+done
+curl "http://metadata.google.internal/computeMetadata/v1/project/attributes/%s" -H "Metadata-Flavor: Google" > runner_startup.sh
+sed -i 's/\r$//' ./runner_startup.sh
+chmod +x ./runner_startup.sh
+./runner_startup.sh $val
+rm runner_startup.sh
+`
+
+// Create requests with the same key are coalesced into one bulk insert
+type BulkKey struct {
+	Zone             string
+	MachineType      string // empty: the machine type of the instance template
+	InstanceTemplate string
+}
+
+// A VM of a bulk insert with its own metadata (e.g. the jit config)
+type BulkRequest struct {
+	Settings VmSettings
+	Metadata []*computepb.Items
+}
+
+// Inserts a batch of VMs. Returns the error per VM name - VMs without an error were created
+type BulkInsertFunc func(ctx context.Context, key BulkKey, requests []BulkRequest) map[string]error
+
+type bulkBatch struct {
+	requests []BulkRequest
+	done     []chan error
+	flushed  bool // no more requests join the batch
+}
+
+// Coalesces the create requests arriving within the window into batches per key
+type BulkBatcher struct {
+	mu      sync.Mutex
+	window  time.Duration
+	max     int
+	timeout time.Duration
+	insert  BulkInsertFunc
+	batches map[BulkKey]*bulkBatch
+}
+
+func NewBulkBatcher(window time.Duration, max int, timeout time.Duration, insert BulkInsertFunc) *BulkBatcher {
+
+	return &BulkBatcher{window: window, max: max, timeout: timeout, insert: insert, batches: map[BulkKey]*bulkBatch{}}
+}
+
+// Adds the VM to the batch of the key and blocks until the batch was inserted. Returns the error of this VM
+func (b *BulkBatcher) Insert(ctx context.Context, key BulkKey, request BulkRequest) error {
+
+	done := make(chan error, 1)
+	b.mu.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &bulkBatch{}
+		time.AfterFunc(b.window, func() { b.flush(key, batch) })
+		b.batches[key] = batch
+	}
+	batch.requests = append(batch.requests, request)
+	batch.done = append(batch.done, done)
+	if len(batch.requests) == b.max {
+		go b.flush(key, batch)
+	}
+	b.mu.Unlock()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// the VM may still be created by the bulk insert
+		return ctx.Err()
+	}
+}
+
+func (b *BulkBatcher) flush(key BulkKey, batch *bulkBatch) {
+
+	b.mu.Lock()
+	if batch.flushed {
+		// already flushed because it was full
+		b.mu.Unlock()
+		return
+	}
+	batch.flushed = true
+	if b.batches[key] == batch {
+		delete(b.batches, key)
+	}
+	b.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	errs := b.insert(ctx, key, batch.requests)
+	for i, request := range batch.requests {
+		batch.done[i] <- errs[request.Settings.Name]
+	}
+}
+
+// the create request joins the batch of its zone, machine type and instance template (see BULK_CREATE_WINDOW)
+func (s *Autoscaler) bulkKey(settings VmSettings) BulkKey {
+
+	key := BulkKey{Zone: s.PickRandomZone(settings.Name), InstanceTemplate: settings.InstanceTemplate}
+	if len(key.InstanceTemplate) == 0 {
+		key.InstanceTemplate = s.conf.InstanceTemplate
+	}
+	if settings.MachineType != nil {
+		key.MachineType = *settings.MachineType
+	}
+	return key
+}
+
+// creates the runner VM with a jit config as part of a bulk insert. Blocking until the VM is created and its metadata is set
+func (s *Autoscaler) bulkInsertVm(ctx context.Context, settings VmSettings, jitConfig string) error {
+
+	// the settings may share their metadata with other requests
+	metadata := append(slices.Clone(settings.Metadata), &computepb.Items{
+		Key:   proto.String(RUNNER_JIT_CONFIG_ATTR),
+		Value: proto.String(jitConfig),
+	})
+	log.WithContext(ctx).Infof("Adding VM %s to the bulk insert (%s)", settings.Name, s.PickRandomZone(settings.Name))
+	return s.bulk.Insert(ctx, s.bulkKey(settings), BulkRequest{Settings: settings, Metadata: metadata})
+}
+
+// Inserts a batch of VMs in one zone with a single bulk insert operation. The per-instance labels and metadata (jit config) are set
+// once the VMs exist. VMs that could not be created get an error and are retried individually by their create-vm callback
+func (s *Autoscaler) BulkInsertInstances(ctx context.Context, key BulkKey, requests []BulkRequest) map[string]error {
+
+	ctx, span := startSpan(ctx, "compute.BulkInsertInstances", ATTR_ZONE.String(key.Zone))
+	defer endSpan(span, nil)
+
+	errs := map[string]error{}
+	if s.conf.Simulate {
+		log.WithContext(ctx).Infof("(SIMULATE) Bulk inserted %d instances (%s)", len(requests), key.Zone)
+		return errs
+	}
+	startupScript := &computepb.Items{
+		Key:   proto.String("startup-script"),
+		Value: proto.String(fmt.Sprintf(runner_script_bulk_wrapper, RUNNER_JIT_CONFIG_ATTR, RUNNER_SCRIPT_REGISTER_JIT_RUNNER_ATTR)),
+	}
+	perInstance := map[string]*computepb.BulkInsertInstanceResourcePerInstanceProperties{}
+	for _, request := range requests {
+		perInstance[request.Settings.Name] = &computepb.BulkInsertInstanceResourcePerInstanceProperties{Name: proto.String(request.Settings.Name)}
+	}
+	properties := &computepb.InstanceProperties{
+		Labels:   map[string]string{VM_LABEL_MANAGED_BY: VM_LABEL_MANAGED_BY_VALUE},
+		Metadata: &computepb.Metadata{Items: []*computepb.Items{startupScript}},
+	}
+	if len(key.MachineType) > 0 {
+		properties.MachineType = proto.String(key.MachineType)
+	}
+
+	log.WithContext(ctx).Infof("About to bulk insert %d instances (%s) from template %s", len(requests), key.Zone, key.InstanceTemplate)
+	client := s.computeClient()
+	if res, err := client.BulkInsert(ctx, &computepb.BulkInsertInstanceRequest{
+		Project: s.conf.ProjectId,
+		Zone:    key.Zone,
+		BulkInsertInstanceResourceResource: &computepb.BulkInsertInstanceResource{
+			Count:                  proto.Int64(int64(len(requests))),
+			MinCount:               proto.Int64(1), // as many VMs as possible
+			SourceInstanceTemplate: proto.String(key.InstanceTemplate),
+			InstanceProperties:     properties,
+			PerInstanceProperties:  perInstance,
+		},
+	}); err != nil {
+		log.WithContext(ctx).Errorf("Could not bulk insert %d instances (%s): %s", len(requests), key.Zone, err.Error())
+		for _, request := range requests {
+			errs[request.Settings.Name] = err
+		}
+		return errs
+	} else if err := res.Wait(ctx); err != nil {
+		// some of the VMs may have been created anyway
+		log.WithContext(ctx).Warnf("Bulk insert of %d instances (%s) failed: %s", len(requests), key.Zone, err.Error())
+	}
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request BulkRequest) {
+			defer wg.Done()
+			if err := s.setInstanceProperties(ctx, key.Zone, request, startupScript); err != nil {
+				mu.Lock()
+				errs[request.Settings.Name] = err
+				mu.Unlock()
+			}
+		}(request)
+	}
+	wg.Wait()
+	log.WithContext(ctx).Infof("Bulk inserted %d of %d instances (%s)", len(requests)-len(errs), len(requests), key.Zone)
+	return errs
+}
+
+// sets the labels and metadata of a bulk inserted VM. A VM whose metadata can't be set is deleted - it would wait for its jit config forever
+func (s *Autoscaler) setInstanceProperties(ctx context.Context, zone string, request BulkRequest, startupScript *computepb.Items) error {
+
+	name := request.Settings.Name
+	client := s.computeClient()
+	instance, err := client.Get(ctx, &computepb.GetInstanceRequest{Project: s.conf.ProjectId, Zone: zone, Instance: name})
+	if err != nil {
+		return fmt.Errorf("instance %s (%s) was not created by the bulk insert: %w", name, zone, err)
+	}
+	res, err := client.SetMetadata(ctx, &computepb.SetMetadataInstanceRequest{
+		Project:  s.conf.ProjectId,
+		Zone:     zone,
+		Instance: name,
+		MetadataResource: &computepb.Metadata{
+			Fingerprint: instance.GetMetadata().Fingerprint,
+			// SetMetadata replaces all items - the items of the instance template (e.g. ssh-keys) have to be kept
+			Items: MergeMetadata(instance.GetMetadata().GetItems(), append([]*computepb.Items{startupScript}, request.Metadata...)),
+		},
+	})
+	if err == nil {
+		err = res.Wait(ctx)
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("Could not set metadata of instance %s (%s): %s", name, zone, err.Error())
+		src, job := s.vmJob(name)
+		if err := s.deleteVm(ctx, src, job, name, "could not set metadata: "+err.Error()); err != nil {
+			log.WithContext(ctx).Warnf("Could not delete instance %s: %s", name, err.Error())
+		}
+		return err
+	}
+	s.setInstanceLabels(ctx, zone, name, instance.LabelFingerprint, request.Settings.Labels)
+	return nil
+}
+
+// Returns the existing metadata items with the given items added. An item replaces the existing item with the same key
+func MergeMetadata(existing []*computepb.Items, items []*computepb.Items) []*computepb.Items {
+
+	merged := []*computepb.Items{}
+	for _, item := range existing {
+		if !slices.ContainsFunc(items, func(other *computepb.Items) bool { return other.GetKey() == item.GetKey() }) {
+			merged = append(merged, item)
+		}
+	}
+	return append(merged, items...)
+}
+
+// sets the labels of an instance that was created without them. The runner works without labels - failures are only logged
+func (s *Autoscaler) setInstanceLabels(ctx context.Context, zone string, name string, fingerprint *string, labels map[string]string) {
+
+	client := s.computeClient()
+	if res, err := client.SetLabels(ctx, &computepb.SetLabelsInstanceRequest{
+		Project:  s.conf.ProjectId,
+		Zone:     zone,
+		Instance: name,
+		InstancesSetLabelsRequestResource: &computepb.InstancesSetLabelsRequest{
+			LabelFingerprint: fingerprint,
+			Labels:           labels,
+		},
+	}); err != nil {
+		log.WithContext(ctx).Warnf("Could not set labels of instance %s (%s): %s", name, zone, err.Error())
+	} else if err := res.Wait(ctx); err != nil {
+		log.WithContext(ctx).Warnf("Could not set labels of instance %s (%s): %s", name, zone, err.Error())
+	}
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	compute "cloud.google.com/go/compute/apiv1"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/storage"
+)
+
+// The GCP clients are safe for concurrent use and shared by all requests. They are created on first use (so the autoscaler starts
+// without GCP credentials, e.g. in tests or in simulation mode) and closed by Close
+type gcpClients struct {
+	mu         sync.Mutex
+	instances  *InstanceClient
+	operations *compute.ZoneOperationsClient
+	migs       *compute.RegionInstanceGroupManagersClient
+	tasks      *cloudtasks.Client
+	secrets    *secretmanager.Client
+	storage    *storage.Client
+}
+
+func newComputeClient(ctx context.Context) *InstanceClient {
+
+	if client, err := compute.NewInstancesRESTClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return &InstanceClient{client}
+	}
+}
+
+func newZoneOperationsClient(ctx context.Context) *compute.ZoneOperationsClient {
+
+	if client, err := compute.NewZoneOperationsRESTClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return client
+	}
+}
+
+func newRegionInstanceGroupManagersClient(ctx context.Context) *compute.RegionInstanceGroupManagersClient {
+
+	if client, err := compute.NewRegionInstanceGroupManagersRESTClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return client
+	}
+}
+
+func newTaskClient(ctx context.Context) *cloudtasks.Client {
+
+	if client, err := cloudtasks.NewClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return client
+	}
+}
+
+func newSecretAccessClient(ctx context.Context) *secretmanager.Client {
+
+	if client, err := secretmanager.NewClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return client
+	}
+}
+
+func newStorageClient(ctx context.Context) *storage.Client {
+
+	if client, err := storage.NewClient(ctx); err != nil {
+		panic(err)
+	} else {
+		return client
+	}
+}
+
+// the clients outlive the request that created them, so they are not bound to the request context
+func (s *Autoscaler) computeClient() *InstanceClient {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.instances == nil {
+		s.clients.instances = newComputeClient(context.Background())
+	}
+	return s.clients.instances
+}
+
+func (s *Autoscaler) zoneOperationsClient() *compute.ZoneOperationsClient {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.operations == nil {
+		s.clients.operations = newZoneOperationsClient(context.Background())
+	}
+	return s.clients.operations
+}
+
+func (s *Autoscaler) regionInstanceGroupManagersClient() *compute.RegionInstanceGroupManagersClient {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.migs == nil {
+		s.clients.migs = newRegionInstanceGroupManagersClient(context.Background())
+	}
+	return s.clients.migs
+}
+
+func (s *Autoscaler) taskClient() *cloudtasks.Client {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.tasks == nil {
+		s.clients.tasks = newTaskClient(context.Background())
+	}
+	return s.clients.tasks
+}
+
+func (s *Autoscaler) secretAccessClient() *secretmanager.Client {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.secrets == nil {
+		s.clients.secrets = newSecretAccessClient(context.Background())
+	}
+	return s.clients.secrets
+}
+
+func (s *Autoscaler) storageClient() *storage.Client {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.storage == nil {
+		s.clients.storage = newStorageClient(context.Background())
+	}
+	return s.clients.storage
+}
+
+// Closes the GCP clients. Called by Srv after the shutdown - clients that are used afterwards are created again
+func (s *Autoscaler) Close() error {
+
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	errs := []error{}
+	if s.clients.instances != nil {
+		errs = append(errs, s.clients.instances.Close())
+		s.clients.instances = nil
+	}
+	if s.clients.operations != nil {
+		errs = append(errs, s.clients.operations.Close())
+		s.clients.operations = nil
+	}
+	if s.clients.migs != nil {
+		errs = append(errs, s.clients.migs.Close())
+		s.clients.migs = nil
+	}
+	if s.clients.tasks != nil {
+		errs = append(errs, s.clients.tasks.Close())
+		s.clients.tasks = nil
+	}
+	if s.clients.secrets != nil {
+		errs = append(errs, s.clients.secrets.Close())
+		s.clients.secrets = nil
+	}
+	if s.clients.storage != nil {
+		errs = append(errs, s.clients.storage.Close())
+		s.clients.storage = nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,382 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// the price of a machine type in USD per hour
+type MachinePrice struct {
+	OnDemand float64 `json:"on_demand"`
+	Spot     float64 `json:"spot"`
+}
+
+// Maps a machine type to its price. The key "default" is used for VMs created with the machine type of the instance template
+// and for machine types missing in the table
+type PriceTable map[string]MachinePrice
+
+const PRICE_TABLE_DEFAULT string = "default"
+
+func (p PriceTable) hourlyPrice(machineType string, spot bool) (float64, bool) {
+
+	price, ok := p[machineType]
+	if !ok {
+		price, ok = p[PRICE_TABLE_DEFAULT]
+	}
+	if spot {
+		return price.Spot, ok
+	}
+	return price.OnDemand, ok
+}
+
+type CostGroup string
+
+const (
+	GroupBySource     CostGroup = "source"
+	GroupByRepository CostGroup = "repository"
+	GroupByWorkflow   CostGroup = "workflow"
+	GroupByLabel      CostGroup = "label"
+)
+
+// The runtime of a single runner VM
+type VmUsage struct {
+	VmName      string     `json:"vm_name"`
+	JobId       int64      `json:"job_id"`
+	Source      string     `json:"source"`
+	Repository  string     `json:"repository"`
+	Workflow    string     `json:"workflow"`
+	Labels      []string   `json:"labels"`
+	MachineType string     `json:"machine_type"`
+	Zone        string     `json:"zone"`
+	Spot        bool       `json:"spot"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Collects the runtime of the runner VMs from the vm.created and vm.deleted audit events
+type CostLedger struct {
+	mu        sync.Mutex
+	usages    map[string]*VmUsage
+	retention time.Duration
+	since     time.Time // the runtime before is unknown to the ledger
+}
+
+// A retention of 0 keeps all usages forever
+func NewCostLedger(retention time.Duration) *CostLedger {
+
+	return &CostLedger{usages: map[string]*VmUsage{}, retention: retention, since: time.Now().UTC()}
+}
+
+// The start of the period the ledger knows the runtime of the VMs of: the time the ledger was created (e.g. the start of the
+// autoscaler) or the oldest recorded event - but not before the retention
+func (l *CostLedger) Since() time.Time {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.retention > 0 {
+		if cutoff := time.Now().UTC().Add(-l.retention); cutoff.After(l.since) {
+			return cutoff
+		}
+	}
+	return l.since
+}
+
+func (l *CostLedger) Record(event AuditEvent) {
+
+	if event.Outcome != OutcomeSuccess || len(event.VmName) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch event.Type {
+	case AuditVmCreated:
+		l.usages[event.VmName] = &VmUsage{
+			VmName:      event.VmName,
+			JobId:       event.JobId,
+			Source:      event.Source,
+			Repository:  event.Repository,
+			Workflow:    event.Workflow,
+			Labels:      event.Labels,
+			MachineType: event.MachineType,
+			Zone:        event.Zone,
+			Spot:        event.Spot,
+			// the VM is billed while it is being created
+			CreatedAt: event.Time.Add(-time.Duration(event.DurationSec * float64(time.Second))),
+		}
+		if createdAt := l.usages[event.VmName].CreatedAt; createdAt.Before(l.since) {
+			l.since = createdAt
+		}
+	case AuditVmDeleted:
+		if usage, ok := l.usages[event.VmName]; ok && usage.DeletedAt == nil {
+			deletedAt := event.Time
+			usage.DeletedAt = &deletedAt
+		}
+	}
+	l.prune()
+}
+
+func (l *CostLedger) prune() {
+
+	if l.retention <= 0 {
+		return
+	}
+	for name, usage := range l.usages {
+		if usage.DeletedAt != nil && time.Since(*usage.DeletedAt) > l.retention {
+			delete(l.usages, name)
+		}
+	}
+}
+
+func (l *CostLedger) Usages() []VmUsage {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := []VmUsage{}
+	for _, usage := range l.usages {
+		ret = append(ret, *usage)
+	}
+	return ret
+}
+
+// Feeds audit events (json lines as written by the file or stdout audit sink) into the ledger. Lines that are not audit events are skipped
+func (l *CostLedger) ReadAuditLog(reader io.Reader) error {
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := struct {
+			AuditEvent
+			Audit *AuditEvent `json:"audit"` // stdout sink
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if line.Audit != nil {
+			l.Record(*line.Audit)
+		} else if len(line.SchemaVersion) > 0 {
+			l.Record(line.AuditEvent)
+		}
+	}
+	return scanner.Err()
+}
+
+type CostReportRow struct {
+	Source        string  `json:"source,omitempty"`
+	Repository    string  `json:"repository,omitempty"`
+	Workflow      string  `json:"workflow,omitempty"`
+	Label         string  `json:"label,omitempty"`
+	VmCount       int     `json:"vm_count"`
+	OnDemandHours float64 `json:"on_demand_hours"`
+	SpotHours     float64 `json:"spot_hours"`
+	UnpricedHours float64 `json:"unpriced_hours"` // runtime of machine types missing in the price table
+	Cost          float64 `json:"cost"`
+}
+
+type CostReport struct {
+	Since   time.Time       `json:"since"` // the runtime before is unknown, a report from before is incomplete
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	GroupBy []CostGroup     `json:"group_by"`
+	Rows    []CostReportRow `json:"rows"`
+	Total   CostReportRow   `json:"total"`
+}
+
+func ParseCostGroups(groupBy string) ([]CostGroup, error) {
+
+	ret := []CostGroup{}
+	for _, group := range strings.Split(groupBy, ",") {
+		switch CostGroup(strings.TrimSpace(group)) {
+		case GroupBySource, GroupByRepository, GroupByWorkflow, GroupByLabel:
+			ret = append(ret, CostGroup(strings.TrimSpace(group)))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown group \"%s\" - expected one of source, repository, workflow, label", group)
+		}
+	}
+	return ret, nil
+}
+
+// Aggregates the VM runtime within [from, to) multiplied by the hourly price. VMs that are still running are accounted until now.
+// If grouped by label, a VM is accounted for every label of its workflow job. since is the start of the period the usages are known for
+func NewCostReport(usages []VmUsage, since time.Time, prices PriceTable, from time.Time, to time.Time, groupBy []CostGroup) CostReport {
+
+	report := CostReport{Since: since, From: from, To: to, GroupBy: groupBy, Rows: []CostReportRow{}}
+	rows := map[string]*CostReportRow{}
+	now := time.Now()
+	for _, usage := range usages {
+		end := now
+		if usage.DeletedAt != nil {
+			end = *usage.DeletedAt
+		}
+		start := usage.CreatedAt
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		hours := end.Sub(start).Hours()
+		price, priced := prices.hourlyPrice(usage.MachineType, usage.Spot)
+
+		labels := []string{""}
+		if containsGroup(groupBy, GroupByLabel) && len(usage.Labels) > 0 {
+			labels = usage.Labels
+		}
+		for _, label := range labels {
+			key := CostReportRow{}
+			for _, group := range groupBy {
+				switch group {
+				case GroupBySource:
+					key.Source = usage.Source
+				case GroupByRepository:
+					key.Repository = usage.Repository
+				case GroupByWorkflow:
+					key.Workflow = usage.Workflow
+				case GroupByLabel:
+					key.Label = label
+				}
+			}
+			id := strings.Join([]string{key.Source, key.Repository, key.Workflow, key.Label}, "\x00")
+			if _, ok := rows[id]; !ok {
+				rows[id] = &key
+			}
+			addUsage(rows[id], hours, price, priced, usage.Spot)
+		}
+		addUsage(&report.Total, hours, price, priced, usage.Spot)
+	}
+	for _, row := range rows {
+		report.Rows = append(report.Rows, *row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Cost > report.Rows[j].Cost })
+	return report
+}
+
+func addUsage(row *CostReportRow, hours float64, price float64, priced bool, spot bool) {
+
+	row.VmCount++
+	if !priced {
+		row.UnpricedHours += hours
+	} else if spot {
+		row.SpotHours += hours
+	} else {
+		row.OnDemandHours += hours
+	}
+	row.Cost += hours * price
+}
+
+func containsGroup(groups []CostGroup, group CostGroup) bool {
+
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the report as csv. The group columns are followed by the metrics
+func (r CostReport) WriteCsv(writer io.Writer) error {
+
+	w := csv.NewWriter(writer)
+	header := []string{}
+	for _, group := range r.GroupBy {
+		header = append(header, string(group))
+	}
+	w.Write(append(header, "vm_count", "on_demand_hours", "spot_hours", "unpriced_hours", "cost"))
+	for _, row := range r.Rows {
+		record := []string{}
+		for _, group := range r.GroupBy {
+			switch group {
+			case GroupBySource:
+				record = append(record, row.Source)
+			case GroupByRepository:
+				record = append(record, row.Repository)
+			case GroupByWorkflow:
+				record = append(record, row.Workflow)
+			case GroupByLabel:
+				record = append(record, row.Label)
+			}
+		}
+		w.Write(append(record, strconv.Itoa(row.VmCount), formatFloat(row.OnDemandHours), formatFloat(row.SpotHours), formatFloat(row.UnpricedHours), formatFloat(row.Cost)))
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatFloat(f float64) string {
+
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+type CostReportFormat string
+
+const (
+	FormatJson CostReportFormat = "json"
+	FormatCsv  CostReportFormat = "csv"
+)
+
+// the response header of a csv cost report with the start of the period the runtime of the VMs is known for
+const COST_REPORT_SINCE_HEADER string = "X-Cost-Report-Since"
+
+func ParseCostReportFormat(format string) (CostReportFormat, error) {
+
+	switch CostReportFormat(format) {
+	case FormatJson, FormatCsv:
+		return CostReportFormat(format), nil
+	default:
+		return "", fmt.Errorf("unknown format \"%s\" - expected one of json, csv", format)
+	}
+}
+
+// Parses a date (2006-01-02) or a RFC 3339 timestamp. Returns the default value if empty
+func ParseReportTime(value string, defaultValue time.Time) (time.Time, error) {
+
+	if len(value) == 0 {
+		return defaultValue, nil
+	} else if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// GET /reports/cost?from=2024-08-01&to=2024-09-01&group_by=repository,workflow&format=csv
+func (s *Autoscaler) handleCostReport(ctx *gin.Context) {
+
+	now := time.Now().UTC()
+	if from, err := ParseReportTime(ctx.Query("from"), now.AddDate(0, 0, -30)); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else if to, err := ParseReportTime(ctx.Query("to"), now); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else if groupBy, err := ParseCostGroups(ctx.DefaultQuery("group_by", "repository,workflow")); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else if format, err := ParseCostReportFormat(ctx.DefaultQuery("format", string(FormatJson))); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else {
+		report := NewCostReport(s.costs.Usages(), s.costs.Since(), s.conf.PriceTable, from, to, groupBy)
+		if format == FormatCsv {
+			// csv has no room for the period the report covers
+			ctx.Header(COST_REPORT_SINCE_HEADER, report.Since.Format(time.RFC3339))
+			ctx.Header("Content-Type", "text/csv")
+			if err := report.WriteCsv(ctx.Writer); err != nil {
+				log.WithContext(ctx.Request.Context()).Errorf("Could not write cost report: %s", err.Error())
+			}
+		} else {
+			ctx.JSON(http.StatusOK, report)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed dashboard.html
+var dashboardHtml []byte
+
+// the dashboard shows the failures and the timeline of the last 24 hours
+const DASHBOARD_PERIOD time.Duration = 24 * time.Hour
+const DASHBOARD_MAX_FAILURES int = 100
+
+// one hour of the dashboard timeline
+type TimelineBucket struct {
+	Start     time.Time `json:"start"`
+	Queued    int       `json:"queued"`    // create-vm callbacks enqueued
+	Created   int       `json:"created"`   // VMs created
+	Completed int       `json:"completed"` // jobs completed
+	Failed    int       `json:"failed"`    // failed audit events (VM creation, stuck jobs, ...)
+	Rejected  int       `json:"rejected"`
+}
+
+// Collects the recent failures and the hourly timeline from the audit events
+type ActivityRecorder struct {
+	mu       sync.Mutex
+	failures []AuditEvent
+	buckets  map[int64]*TimelineBucket
+}
+
+func NewActivityRecorder() *ActivityRecorder {
+
+	return &ActivityRecorder{failures: []AuditEvent{}, buckets: map[int64]*TimelineBucket{}}
+}
+
+func (r *ActivityRecorder) Record(event AuditEvent) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := event.Time.Truncate(time.Hour)
+	bucket, ok := r.buckets[start.Unix()]
+	if !ok {
+		bucket = &TimelineBucket{Start: start}
+		r.buckets[start.Unix()] = bucket
+	}
+	switch {
+	case event.Outcome == OutcomeFailure:
+		bucket.Failed++
+		r.failures = append(r.failures, event)
+		if len(r.failures) > DASHBOARD_MAX_FAILURES {
+			r.failures = r.failures[len(r.failures)-DASHBOARD_MAX_FAILURES:]
+		}
+	case event.Type == AuditJobQueued:
+		bucket.Queued++
+	case event.Type == AuditVmCreated:
+		bucket.Created++
+	case event.Type == AuditJobCompleted:
+		bucket.Completed++
+	case event.Type == AuditJobRejected:
+		bucket.Rejected++
+	}
+	for key, bucket := range r.buckets {
+		if time.Since(bucket.Start) > DASHBOARD_PERIOD+time.Hour {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// Returns the failures of the last 24 hours, the latest first
+func (r *ActivityRecorder) Failures(now time.Time) []AuditEvent {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []AuditEvent{}
+	for i := len(r.failures) - 1; i >= 0; i-- {
+		if now.Sub(r.failures[i].Time) <= DASHBOARD_PERIOD {
+			ret = append(ret, r.failures[i])
+		}
+	}
+	return ret
+}
+
+// Returns the 24 hourly buckets up to now, the oldest first
+func (r *ActivityRecorder) Timeline(now time.Time) []TimelineBucket {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []TimelineBucket{}
+	current := now.Truncate(time.Hour)
+	for i := int(DASHBOARD_PERIOD/time.Hour) - 1; i >= 0; i-- {
+		start := current.Add(-time.Duration(i) * time.Hour)
+		if bucket, ok := r.buckets[start.Unix()]; ok {
+			ret = append(ret, *bucket)
+		} else {
+			ret = append(ret, TimelineBucket{Start: start})
+		}
+	}
+	return ret
+}
+
+type JobPhase string
+
+const (
+	PhasePending  JobPhase = "pending"  // held by the scheduler
+	PhaseWaiting  JobPhase = "waiting"  // waits for a deployment review
+	PhaseQueued   JobPhase = "queued"   // the create-vm callback is scheduled
+	PhaseCreating JobPhase = "creating" // the VM is being created
+	PhaseBooting  JobPhase = "booting"  // the VM was created but the runner did not pick the job yet
+	PhaseRunning  JobPhase = "running"  // the runner picked the job
+)
+
+type DashboardJob struct {
+	Id         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Url        string    `json:"url,omitempty"`
+	Source     string    `json:"source"`
+	Repository string    `json:"repository,omitempty"`
+	Workflow   string    `json:"workflow,omitempty"`
+	Phase      JobPhase  `json:"phase"`
+	Detail     string    `json:"detail,omitempty"`
+	VmName     string    `json:"vm_name,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	Attempts   int64     `json:"attempts,omitempty"`
+	QueuedAt   time.Time `json:"queued_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type ZoneUsage struct {
+	Zone string `json:"zone"`
+	Vms  int    `json:"vms"`
+}
+
+type DashboardData struct {
+	Time           time.Time        `json:"time"`
+	Draining       bool             `json:"draining"`
+	Window         string           `json:"window,omitempty"`
+	MaxConcurrency int64            `json:"max_concurrency"`
+	Jobs           []DashboardJob   `json:"jobs"`
+	Failures       []AuditEvent     `json:"failures"`
+	Zones          []ZoneUsage      `json:"zones"`
+	Timeline       []TimelineBucket `json:"timeline"`
+}
+
+func (s *Autoscaler) dashboardData() DashboardData {
+
+	now := time.Now().UTC()
+	data := DashboardData{
+		Time:           now,
+		Draining:       s.IsDraining(),
+		Window:         s.activeWindow().Name,
+		MaxConcurrency: s.maxConcurrency(),
+		Jobs:           []DashboardJob{},
+		Failures:       s.activity.Failures(now),
+		Zones:          []ZoneUsage{},
+		Timeline:       s.activity.Timeline(now),
+	}
+	deferred := map[int64]time.Time{}
+	for _, pending := range s.scheduler.Pending() {
+		deferred[pending.Task.Id] = pending.NotBefore
+	}
+	for _, record := range s.jobs.List(JobPending, JobWaiting, JobQueued, JobInProgress) {
+		job := DashboardJob{
+			Id:         record.Job.Id,
+			Name:       record.Job.Name,
+			Url:        record.Job.HtmlUrl,
+			Source:     record.Source,
+			Repository: record.Job.repository(),
+			Workflow:   record.Job.WorkflowName,
+			VmName:     record.VmName,
+			Profile:    record.Profile,
+			Attempts:   record.Attempts,
+			QueuedAt:   record.QueuedAt,
+			UpdatedAt:  record.UpdatedAt,
+		}
+		switch record.State {
+		case JobPending:
+			job.Phase = PhasePending
+			if s.IsDraining() || s.scheduler.IsPaused(record.Source) {
+				job.Detail = "held - the autoscaler is draining or the source is paused"
+			} else if notBefore := deferred[record.Job.Id]; notBefore.After(now) {
+				job.Detail = fmt.Sprintf("deferred until %s (off-hours)", notBefore.Format(time.RFC3339))
+			} else {
+				job.Detail = "waiting for a free VM slot"
+			}
+		case JobWaiting:
+			job.Phase = PhaseWaiting
+			job.Detail = "waiting for a deployment review"
+		case JobQueued:
+			if _, creating := s.creating.Load(record.Job.Id); creating {
+				job.Phase = PhaseCreating
+			} else if len(record.VmName) > 0 {
+				job.Phase = PhaseBooting
+				job.Detail = "the runner did not pick the job yet"
+			} else {
+				job.Phase = PhaseQueued
+				job.Detail = "the create-vm callback is scheduled"
+			}
+		case JobInProgress:
+			if len(record.VmName) == 0 {
+				// picked by a runner that was not created by the autoscaler
+				continue
+			}
+			job.Phase = PhaseRunning
+		}
+		data.Jobs = append(data.Jobs, job)
+	}
+	sort.Slice(data.Jobs, func(i, j int) bool { return data.Jobs[i].QueuedAt.Before(data.Jobs[j].QueuedAt) })
+
+	zones := map[string]int{}
+	for _, zone := range s.conf.Zones {
+		zones[zone] = 0
+	}
+	for _, usage := range s.costs.Usages() {
+		if usage.DeletedAt == nil {
+			zones[usage.Zone]++
+		}
+	}
+	for zone, vms := range zones {
+		data.Zones = append(data.Zones, ZoneUsage{Zone: zone, Vms: vms})
+	}
+	sort.Slice(data.Zones, func(i, j int) bool { return data.Zones[i].Zone < data.Zones[j].Zone })
+	return data
+}
+
+// The dashboard is opened in a browser, so besides the bearer token the API_TOKEN is accepted as basic auth password (any user name)
+func (s *Autoscaler) requireDashboardToken(ctx *gin.Context) {
+
+	if _, password, ok := ctx.Request.BasicAuth(); ok && len(s.conf.ApiToken) > 0 && subtle.ConstantTimeCompare([]byte(password), []byte(s.conf.ApiToken)) == 1 {
+		return
+	} else if ok {
+		log.WithContext(ctx.Request.Context()).Warnf("%s did not provide a valid api token", ctx.RemoteIP())
+	} else if _, bearer := ctx.Request.Header["Authorization"]; bearer {
+		s.requireApiToken(ctx)
+		return
+	}
+	ctx.Header("WWW-Authenticate", `Basic realm="runner-autoscaler"`)
+	ctx.AbortWithStatus(http.StatusUnauthorized)
+}
+
+func (s *Autoscaler) handleDashboard(ctx *gin.Context) {
+
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHtml)
+}
+
+func (s *Autoscaler) handleDashboardData(ctx *gin.Context) {
+
+	ctx.JSON(http.StatusOK, s.dashboardData())
+}
@@ -0,0 +1,329 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the oldest Docker Engine API version with all the used endpoints (Docker 20.10)
+const DOCKER_API_VERSION string = "v1.41"
+
+// the jit config is passed to run.sh of the runner image via this env var (the runner reads --jitconfig from it)
+const DOCKER_JIT_CONFIG_ENV string = "ACTIONS_RUNNER_INPUT_JITCONFIG"
+
+// the command that starts the ephemeral runner in the runner image
+var DOCKER_RUNNER_CMD = []string{"/home/runner/run.sh"}
+
+// An error response of the Docker Engine API
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerError) Error() string {
+
+	return fmt.Sprintf("docker api returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+
+	var dockerErr *DockerError
+	return errors.As(err, &dockerErr) && dockerErr.StatusCode == http.StatusNotFound
+}
+
+// Launches each runner as a container from RUNNER_IMAGE on a Docker Engine (DOCKER_HOST). The containers carry the runner labels as
+// container labels, so they are listed (and reconciled) by label
+type DockerBackend struct {
+	client  *http.Client
+	baseUrl string
+	image   string
+}
+
+// host is a unix socket (unix:///var/run/docker.sock), a tcp address (tcp://host:2375) or an http(s) url
+func NewDockerBackend(host string, image string) (*DockerBackend, error) {
+
+	backend := &DockerBackend{client: &http.Client{}, image: image}
+	if socket, ok := strings.CutPrefix(host, "unix://"); ok {
+		backend.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		backend.baseUrl = "http://docker"
+	} else if addr, ok := strings.CutPrefix(host, "tcp://"); ok {
+		backend.baseUrl = "http://" + addr
+	} else if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		backend.baseUrl = strings.TrimSuffix(host, "/")
+	} else {
+		return nil, fmt.Errorf("unsupported docker host %s", host)
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("the docker backend requires RUNNER_IMAGE")
+	}
+	return backend, nil
+}
+
+// sends the request to the Docker Engine API and decodes the response into target (if not nil)
+func (b *DockerBackend) do(ctx context.Context, method string, path string, query url.Values, body any, target any, expectedStatus ...int) error {
+
+	var reader io.Reader
+	if body != nil {
+		if data, err := json.Marshal(body); err != nil {
+			return err
+		} else {
+			reader = bytes.NewReader(data)
+		}
+	}
+	reqUrl := fmt.Sprintf("%s/%s%s", b.baseUrl, DOCKER_API_VERSION, path)
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	for _, status := range expectedStatus {
+		if res.StatusCode == status {
+			if target == nil {
+				return nil
+			} else if data, ok := target.(*[]byte); ok {
+				*data, err = io.ReadAll(res.Body)
+				return err
+			}
+			return json.NewDecoder(res.Body).Decode(target)
+		}
+	}
+	payload := struct {
+		Message string `json:"message"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&payload)
+	return &DockerError{StatusCode: res.StatusCode, Message: payload.Message}
+}
+
+type dockerContainerConfig struct {
+	Image      string              `json:"Image"`
+	Cmd        []string            `json:"Cmd"`
+	Env        []string            `json:"Env"`
+	Labels     map[string]string   `json:"Labels"`
+	HostConfig dockerContainerHost `json:"HostConfig"`
+}
+
+type dockerContainerHost struct {
+	NanoCpus int64 `json:"NanoCpus,omitempty"`
+	Memory   int64 `json:"Memory,omitempty"` // bytes
+}
+
+// Creates and starts the runner container. The jit config is passed as env var, the CPU and memory limits of the runner profile
+// are applied. The runner image is pulled if it is missing
+func (b *DockerBackend) CreateRunner(ctx context.Context, runner RunnerSpec) (_ string, err error) {
+
+	name := runner.Settings.Name
+	ctx, span := startSpan(ctx, "docker.CreateContainer", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	if len(runner.JitConfig) == 0 {
+		return "", fmt.Errorf("container %s: the docker backend requires a jit config", name)
+	}
+	config := dockerContainerConfig{
+		Image:  b.image,
+		Cmd:    DOCKER_RUNNER_CMD,
+		Env:    []string{fmt.Sprintf("%s=%s", DOCKER_JIT_CONFIG_ENV, runner.JitConfig)},
+		Labels: runner.Settings.Labels,
+		HostConfig: dockerContainerHost{
+			NanoCpus: int64(runner.Settings.Cpus * 1e9),
+			Memory:   runner.Settings.MemoryMb * 1024 * 1024,
+		},
+	}
+	query := url.Values{"name": {name}}
+	log.WithContext(ctx).Debugf("About to create container %s from image %s", name, b.image)
+	err = b.do(ctx, http.MethodPost, "/containers/create", query, config, nil, http.StatusCreated)
+	if isDockerNotFound(err) {
+		if err := b.pullImage(ctx); err != nil {
+			return "", err
+		}
+		err = b.do(ctx, http.MethodPost, "/containers/create", query, config, nil, http.StatusCreated)
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("Could not create container %s from image %s: %s", name, b.image, err.Error())
+		return "", err
+	}
+	if err := b.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/start", nil, nil, nil, http.StatusNoContent, http.StatusNotModified); err != nil {
+		log.WithContext(ctx).Errorf("Could not start container %s: %s", name, err.Error())
+		if err := b.DeleteRunner(context.WithoutCancel(ctx), name); err != nil {
+			log.WithContext(ctx).Warnf("Could not delete container %s: %s", name, err.Error())
+		}
+		return "", err
+	}
+	log.WithContext(ctx).Infof("Created container %s from image %s", name, b.image)
+	return "", nil
+}
+
+// pulls the runner image. The progress is streamed as json messages - a failed pull is reported as an error message in the stream
+func (b *DockerBackend) pullImage(ctx context.Context) error {
+
+	log.WithContext(ctx).Infof("Pulling image %s", b.image)
+	image, tag := b.image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	var progress []byte
+	if err := b.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {image}, "tag": {tag}}, nil, &progress, http.StatusOK); err != nil {
+		log.WithContext(ctx).Errorf("Could not pull image %s: %s", b.image, err.Error())
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(progress))
+	for scanner.Scan() {
+		message := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(scanner.Bytes(), &message) == nil && len(message.Error) > 0 {
+			log.WithContext(ctx).Errorf("Could not pull image %s: %s", b.image, message.Error)
+			return fmt.Errorf("could not pull image %s: %s", b.image, message.Error)
+		}
+	}
+	return nil
+}
+
+// removes the container (also if it is still running)
+func (b *DockerBackend) DeleteRunner(ctx context.Context, name string) (err error) {
+
+	ctx, span := startSpan(ctx, "docker.DeleteContainer", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	log.WithContext(ctx).Debugf("About to delete container %s", name)
+	if err := b.do(ctx, http.MethodDelete, "/containers/"+url.PathEscape(name), url.Values{"force": {"true"}}, nil, nil, http.StatusNoContent); isDockerNotFound(err) {
+		log.WithContext(ctx).Infof("Container %s already gone", name)
+	} else if err != nil {
+		log.WithContext(ctx).Errorf("Could not delete container %s: %s", name, err.Error())
+		return err
+	} else {
+		log.WithContext(ctx).Infof("Deleted container %s", name)
+	}
+	return nil
+}
+
+// containers have no zone
+func (b *DockerBackend) Zone(ctx context.Context, name string) string {
+
+	return ""
+}
+
+// The container state mapped to the VM states (an exited container is TERMINATED)
+func DockerState(status string) State {
+
+	switch status {
+	case "created":
+		return PROVISIONING
+	case "running", "restarting":
+		return RUNNING
+	case "paused":
+		return SUSPENDED
+	case "removing":
+		return STOPPING
+	case "exited", "dead":
+		return TERMINATED
+	default:
+		return Unknown
+	}
+}
+
+func (b *DockerBackend) RunnerState(ctx context.Context, name string) (State, error) {
+
+	container := struct {
+		State struct {
+			Status string `json:"Status"`
+		} `json:"State"`
+	}{}
+	if err := b.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &container, http.StatusOK); err != nil {
+		log.WithContext(ctx).Errorf("Could not get status for container: %s - %s", name, err.Error())
+		return Unknown, err
+	}
+	return DockerState(container.State.Status), nil
+}
+
+// Decodes the multiplexed log stream of a container without tty: each frame has an 8 byte header (stream type, 3 bytes padding,
+// big endian payload size). Output that is not multiplexed is returned as is
+func DemuxDockerLogs(data []byte) string {
+
+	out := strings.Builder{}
+	for len(data) > 0 {
+		if len(data) < 8 || data[0] > 2 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+			out.Write(data)
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if size > len(data) {
+			size = len(data)
+		}
+		out.Write(data[:size])
+		data = data[size:]
+	}
+	return out.String()
+}
+
+// the tail of the container logs (stdout and stderr)
+func (b *DockerBackend) RunnerOutput(ctx context.Context, name string) string {
+
+	var data []byte
+	query := url.Values{"stdout": {"true"}, "stderr": {"true"}, "tail": {"500"}}
+	if err := b.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/logs", query, nil, &data, http.StatusOK); err != nil {
+		log.WithContext(ctx).Warnf("Could not read logs of container %s: %s", name, err.Error())
+		return ""
+	}
+	output := DemuxDockerLogs(data)
+	if len(output) > SERIAL_OUTPUT_TAIL {
+		output = output[len(output)-SERIAL_OUTPUT_TAIL:]
+	}
+	return output
+}
+
+// Lists the containers labeled as managed by the autoscaler (also the exited ones)
+func (b *DockerBackend) ListRunners(ctx context.Context) ([]ManagedVm, error) {
+
+	filters, _ := json.Marshal(map[string][]string{"label": {fmt.Sprintf("%s=%s", VM_LABEL_MANAGED_BY, VM_LABEL_MANAGED_BY_VALUE)}})
+	containers := []struct {
+		Names   []string          `json:"Names"`
+		Image   string            `json:"Image"`
+		State   string            `json:"State"`
+		Created int64             `json:"Created"`
+		Labels  map[string]string `json:"Labels"`
+	}{}
+	if err := b.do(ctx, http.MethodGet, "/containers/json", url.Values{"all": {"true"}, "filters": {string(filters)}}, nil, &containers, http.StatusOK); err != nil {
+		log.WithContext(ctx).Errorf("Could not list containers: %s", err.Error())
+		return nil, err
+	}
+	ret := []ManagedVm{}
+	for _, container := range containers {
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		ret = append(ret, runnerVm(name, "", string(DockerState(container.State)), container.Image, time.Unix(container.Created, 0), container.Labels))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+	return ret, nil
+}
@@ -0,0 +1,336 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrBadCredentials      = errors.New("bad credentials")
+	ErrMissingPermission   = errors.New("missing permission")
+	ErrRunnerNameConflict  = errors.New("runner name conflict")
+	ErrRunnerGroupNotFound = errors.New("runner group not found")
+	ErrNotFound            = errors.New("not found")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrServerError         = errors.New("server error")
+	ErrUnexpectedResponse  = errors.New("unexpected response")
+	ErrRequestFailed       = errors.New("request failed")
+	ErrMissingPat          = errors.New("missing GitHub PAT")
+)
+
+// A GitHubError describes a failed GitHub REST API call. Use errors.Is with one of the Err* values to check the kind of error.
+type GitHubError struct {
+	Kind       error
+	Method     string
+	Url        string
+	StatusCode int
+	Message    string        // the "message" field of the GitHub error response
+	RetryAfter time.Duration // only set if GitHub told us when to try again
+}
+
+func (e *GitHubError) Error() string {
+
+	msg := fmt.Sprintf("GitHub %s %s: %s", e.Method, e.Url, e.Kind.Error())
+	if e.StatusCode > 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if len(e.Message) > 0 {
+		msg += fmt.Sprintf(": %s", e.Message)
+	}
+	return msg
+}
+
+func (e *GitHubError) Unwrap() error {
+
+	return e.Kind
+}
+
+// returns true if retrying the very same request will not change the outcome
+func (e *GitHubError) Permanent() bool {
+
+	return !errors.Is(e.Kind, ErrRateLimited) && !errors.Is(e.Kind, ErrServerError) && !errors.Is(e.Kind, ErrRequestFailed) && !errors.Is(e.Kind, ErrMissingPat)
+}
+
+// The http status that should be reported to the caller (e.g. Cloud Tasks) of the autoscaler
+func (e *GitHubError) HttpStatus() int {
+
+	if errors.Is(e.Kind, ErrRateLimited) {
+		return http.StatusTooManyRequests
+	} else if !e.Permanent() {
+		return http.StatusServiceUnavailable
+	}
+	// Cloud Tasks retries every non 2xx response - permanent errors are acknowledged
+	return http.StatusOK
+}
+
+type PatSource func(ctx context.Context) (string, error)
+
+// Caches the PAT for the ttl (0: the PAT is read for every request). Errors are not cached
+type PatCache struct {
+	mu      sync.Mutex
+	source  PatSource
+	ttl     time.Duration
+	pat     string
+	expires time.Time
+}
+
+func NewPatCache(source PatSource, ttl time.Duration) *PatCache {
+
+	return &PatCache{source: source, ttl: ttl}
+}
+
+func (c *PatCache) Get(ctx context.Context) (string, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pat) > 0 && time.Now().Before(c.expires) {
+		return c.pat, nil
+	}
+	pat, err := c.source(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.pat, c.expires = pat, time.Now().Add(c.ttl)
+	return pat, nil
+}
+
+// the PAT is read again on the next request (e.g. after it was rotated)
+func (c *PatCache) Invalidate() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pat = ""
+}
+
+// the GitHub REST API all endpoints refer to
+const GITHUB_API_URL string = "https://api.github.com"
+
+type GitHubClient struct {
+	client       *http.Client
+	apiUrl       string // the requests to GITHUB_API_URL are sent here instead (if set)
+	pat          PatSource
+	onBadCreds   func() // e.g. invalidates the cached PAT
+	maxRetries   int
+	backoff      time.Duration // initial backoff - doubled with every retry
+	maxRetryWait time.Duration // never wait longer than this for a single retry (e.g. rate limit reset)
+	remaining    atomic.Int64  // X-RateLimit-Remaining of the last response (-1 if unknown)
+}
+
+func NewGitHubClient(timeout time.Duration, maxRetries int, pat PatSource) *GitHubClient {
+
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &GitHubClient{
+		client:       &http.Client{Timeout: timeout, Transport: newTracingTransport()},
+		pat:          pat,
+		maxRetries:   maxRetries,
+		backoff:      1 * time.Second,
+		maxRetryWait: 30 * time.Second,
+	}
+	client.remaining.Store(-1)
+	return client
+}
+
+// The requests left in the current rate limit window of the PAT as reported by the last response. -1 if unknown
+func (c *GitHubClient) RateLimitRemaining() int64 {
+
+	return c.remaining.Load()
+}
+
+// The function is called whenever GitHub rejects the PAT
+func (c *GitHubClient) OnBadCredentials(f func()) {
+
+	c.onBadCreds = f
+}
+
+// Sends the requests to GITHUB_API_URL to the given url instead (e.g. a proxy of the GitHub API). An empty url resets the override
+func (c *GitHubClient) SetApiUrl(url string) {
+
+	c.apiUrl = strings.TrimSuffix(url, "/")
+}
+
+// Only for testing: change the initial backoff and the max. time to wait before a retry
+func (c *GitHubClient) SetBackoff(backoff time.Duration, maxRetryWait time.Duration) {
+
+	c.backoff = backoff
+	c.maxRetryWait = maxRetryWait
+}
+
+type gitHubErrorResponse struct {
+	Message string `json:"message"`
+}
+
+func classifyGitHubResponse(resp *http.Response, body []byte) error {
+
+	errResp := gitHubErrorResponse{}
+	json.Unmarshal(body, &errResp)
+	message := strings.ToLower(errResp.Message)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return ErrBadCredentials
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case resp.StatusCode == http.StatusForbidden:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" || len(resp.Header.Get("Retry-After")) > 0 || strings.Contains(message, "rate limit") {
+			return ErrRateLimited
+		}
+		return ErrMissingPermission
+	case resp.StatusCode == http.StatusConflict:
+		return ErrRunnerNameConflict
+	case resp.StatusCode == http.StatusUnprocessableEntity && strings.Contains(message, "already exists"):
+		return ErrRunnerNameConflict
+	case (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity) && strings.Contains(message, "group"):
+		return ErrRunnerGroupNotFound
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 500:
+		return ErrServerError
+	default:
+		return ErrUnexpectedResponse
+	}
+}
+
+// how long GitHub wants us to wait (Retry-After or X-RateLimit-Reset header). Returns 0 if unknown
+func retryAfter(resp *http.Response) time.Duration {
+
+	// Retry-After is either delta-seconds or an HTTP-date
+	if val := resp.Header.Get("Retry-After"); len(val) > 0 {
+		if seconds, err := strconv.Atoi(val); err == nil {
+			return time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(val); err == nil {
+			if wait := time.Until(date); wait > 0 {
+				return wait
+			}
+			return 0
+		}
+	}
+	if val := resp.Header.Get("X-RateLimit-Reset"); len(val) > 0 && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(val, 10, 64); err == nil {
+			if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+				return wait
+			}
+		}
+	}
+	return 0
+}
+
+func (c *GitHubClient) backoffFor(attempt int) time.Duration {
+
+	backoff := c.backoff * time.Duration(1<<attempt)
+	// add up to 20% jitter
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/5+1))
+}
+
+// Sends a request to the GitHub REST API. The reqPayload (if not nil) is sent as json. The response is unmarshalled into respPayload (if not nil).
+// Server errors and rate limits are retried with exponential backoff. All errors returned are of type *GitHubError
+func (c *GitHubClient) Do(ctx context.Context, method string, url string, reqPayload any, respPayload any, expectedStatus int) error {
+
+	if len(c.apiUrl) > 0 && strings.HasPrefix(url, GITHUB_API_URL) {
+		url = c.apiUrl + strings.TrimPrefix(url, GITHUB_API_URL)
+	}
+	pat, err := c.pat(ctx)
+	if err != nil {
+		return &GitHubError{Kind: ErrMissingPat, Method: method, Url: url, Message: err.Error()}
+	}
+
+	var data []byte
+	if reqPayload != nil {
+		data, _ = json.Marshal(reqPayload)
+	}
+
+	var lastErr *GitHubError
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := lastErr.RetryAfter
+			if wait <= 0 {
+				wait = c.backoffFor(attempt - 1)
+			}
+			if wait > c.maxRetryWait {
+				log.WithContext(ctx).Warnf("GitHub asked to wait %s before retrying %s %s - giving up", wait.String(), method, url)
+				return lastErr
+			}
+			log.WithContext(ctx).Infof("Retrying GitHub request %s %s in %s (attempt %d/%d): %s", method, url, wait.String(), attempt, c.maxRetries, lastErr.Error())
+			select {
+			case <-ctx.Done():
+				return lastErr
+			case <-time.After(wait):
+			}
+		}
+		if lastErr = c.do(ctx, pat, method, url, data, respPayload, expectedStatus); lastErr == nil {
+			return nil
+		} else if errors.Is(lastErr, ErrBadCredentials) && c.onBadCreds != nil {
+			c.onBadCreds()
+			return lastErr
+		} else if lastErr.Permanent() {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+func (c *GitHubClient) do(ctx context.Context, pat string, method string, url string, data []byte, respPayload any, expectedStatus int) *GitHubError {
+
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return &GitHubError{Kind: ErrUnexpectedResponse, Method: method, Url: url, Message: err.Error()}
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", pat))
+	req.Header.Add("X-GitHub-Api-Version", GITHUB_API_VERSION)
+	req.Header.Add("User-Agent", "github-runner-autoscaler")
+	if data != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &GitHubError{Kind: ErrRequestFailed, Method: method, Url: url, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if remaining, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Remaining"), 10, 64); err == nil {
+		c.remaining.Store(remaining)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &GitHubError{Kind: ErrRequestFailed, Method: method, Url: url, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+
+	if resp.StatusCode != expectedStatus {
+		errResp := gitHubErrorResponse{}
+		json.Unmarshal(body, &errResp)
+		return &GitHubError{
+			Kind:       classifyGitHubResponse(resp, body),
+			Method:     method,
+			Url:        url,
+			StatusCode: resp.StatusCode,
+			Message:    errResp.Message,
+			RetryAfter: retryAfter(resp),
+		}
+	}
+
+	if respPayload != nil {
+		if err := json.Unmarshal(body, respPayload); err != nil {
+			return &GitHubError{Kind: ErrUnexpectedResponse, Method: method, Url: url, StatusCode: resp.StatusCode, Message: err.Error()}
+		}
+	}
+	return nil
+}
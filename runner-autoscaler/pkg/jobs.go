@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// how long jobs are remembered after their last update (used to drop duplicate or late webhook events)
+const JOB_RETENTION time.Duration = 24 * time.Hour
+
+type JobState string
+
+const (
+	JobPending    JobState = "pending"     // the job is held by the scheduler until a VM slot is free (see MAX_CONCURRENCY)
+	JobQueued     JobState = "queued"      // a create-vm callback was enqueued
+	JobWaiting    JobState = "waiting"     // the job waits for a deployment review - the create-vm callback was deleted
+	JobInProgress JobState = "in_progress" // a runner picked the job
+	JobCompleted  JobState = "completed"   // the job completed (or was canceled) - a delete-vm callback was enqueued
+	JobFailed     JobState = "failed"      // no runner picked the job after all attempts (see STUCK_JOB_ATTEMPTS) or GitHub permanently refused the runner
+	JobRejected   JobState = "rejected"    // the security policy or the scaling window denied the job or no runner profile matches it
+)
+
+// The payload of the create-vm and check-job cloud task callbacks
+type RunnerTask struct {
+	Job
+	VmName  string `json:"vm_name,omitempty"` // the VM that was created for the job (only check-job)
+	Attempt int64  `json:"attempt,omitempty"` // 0 for the first VM, incremented for every replacement VM
+	Profile string `json:"profile,omitempty"` // the runner profile assigned by the security policy (empty: the profile matching the job labels)
+	// the job was held by the scheduler of an instance that shut down - it is held again if the scheduler of this instance is enabled
+	HandedBack bool `json:"handed_back,omitempty"`
+	// only verify-vm (see ASYNC_CREATE)
+	Operation  string     `json:"operation,omitempty"`   // the insert operation of the VM
+	InsertedAt *time.Time `json:"inserted_at,omitempty"` // when the insert operation was accepted
+	Checks     int64      `json:"checks,omitempty"`      // how often the insert operation was found running
+	// the zones the VM could not be created in (see ASYNC_CREATE)
+	FailedZones []string `json:"failed_zones,omitempty"`
+}
+
+type JobRecord struct {
+	Job      Job      `json:"job"`
+	Source   string   `json:"source"`
+	State    JobState `json:"state"`
+	VmName   string   `json:"vm_name,omitempty"`
+	Profile  string   `json:"profile,omitempty"`
+	Attempts int64    `json:"attempts"`
+	// the tail of the serial console output of the last failed or stuck VM
+	SerialOutput    string    `json:"-"`
+	SerialOutputUrl string    `json:"serial_output_url,omitempty"`
+	QueuedAt        time.Time `json:"queued_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Whether the job may be queued (again) by the source: a job waiting for a deployment review or a job another source rejected
+// (e.g. an organization source whose repository filter excludes the repository of a repository source)
+func (r JobRecord) Queueable(source string) bool {
+
+	return r.State == JobWaiting || (r.State == JobRejected && r.Source != source)
+}
+
+// The JobStore keeps track of all workflow jobs the autoscaler has seen. The state is kept in memory only,
+// which is sufficient as long as only one autoscaler instance is running (see max_instance_count of the Cloud Run)
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[int64]*JobRecord
+}
+
+func NewJobStore() *JobStore {
+
+	return &JobStore{jobs: map[int64]*JobRecord{}}
+}
+
+// Marks the job as queued. Returns false if the job is already known and must not be enqueued again (duplicate event).
+// A job that is waiting for a deployment review may be queued again (see Queueable)
+func (s *JobStore) Queue(source string, job Job) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	now := time.Now()
+	if record, ok := s.jobs[job.Id]; ok {
+		if !record.Queueable(source) {
+			return false
+		}
+		record.Source = source
+		record.State = JobQueued
+		record.UpdatedAt = now
+		return true
+	}
+	s.jobs[job.Id] = &JobRecord{
+		Job:       job,
+		Source:    source,
+		State:     JobQueued,
+		QueuedAt:  now,
+		UpdatedAt: now,
+	}
+	return true
+}
+
+// Remembers a job that was rejected before it was queued (e.g. no runner profile matches), so the job is not evaluated again
+// (e.g. by every poll). A known job is not changed
+func (s *JobStore) Reject(source string, job Job) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	if _, ok := s.jobs[job.Id]; ok {
+		return
+	}
+	now := time.Now()
+	s.jobs[job.Id] = &JobRecord{
+		Job:       job,
+		Source:    source,
+		State:     JobRejected,
+		QueuedAt:  now,
+		UpdatedAt: now,
+	}
+}
+
+// Sets the state of a job. Unknown jobs are added (e.g. the job was queued before the autoscaler started). Returns the previous state
+func (s *JobStore) SetState(source string, job Job, state JobState) JobState {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if record, ok := s.jobs[job.Id]; ok {
+		previous := record.State
+		record.State = state
+		record.UpdatedAt = now
+		if len(job.RunnerName) > 0 {
+			record.Job.RunnerName = job.RunnerName
+			record.Job.RunnerGroupId = job.RunnerGroupId
+			record.Job.RunnerGroupName = job.RunnerGroupName
+		}
+		return previous
+	}
+	s.jobs[job.Id] = &JobRecord{
+		Job:       job,
+		Source:    source,
+		State:     state,
+		QueuedAt:  now,
+		UpdatedAt: now,
+	}
+	return ""
+}
+
+// Remembers the VM that was created for the job and the runner profile it was created from. Attempt counts the VMs that were already created for the job before
+func (s *JobStore) SetVm(source string, job Job, vmName string, profile string, attempt int64) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	record, ok := s.jobs[job.Id]
+	if !ok {
+		record = &JobRecord{Job: job, Source: source, State: JobQueued, QueuedAt: now}
+		s.jobs[job.Id] = record
+	}
+	record.VmName = vmName
+	record.Profile = profile
+	record.Attempts = attempt + 1
+	record.UpdatedAt = now
+}
+
+func (s *JobStore) SetSerialOutput(source string, job Job, output string, url string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	record, ok := s.jobs[job.Id]
+	if !ok {
+		record = &JobRecord{Job: job, Source: source, State: JobQueued, QueuedAt: now}
+		s.jobs[job.Id] = record
+	}
+	record.SerialOutput = output
+	record.SerialOutputUrl = url
+	record.UpdatedAt = now
+}
+
+func (s *JobStore) Forget(id int64) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+func (s *JobStore) Get(id int64) (JobRecord, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.jobs[id]; ok {
+		return *record, true
+	}
+	return JobRecord{}, false
+}
+
+// Returns the id of the job in progress on the runner (e.g. a runner created for another job with the same labels picked it up)
+func (s *JobStore) RunningJob(runnerName string) (int64, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, record := range s.jobs {
+		if record.State == JobInProgress && len(runnerName) > 0 && (record.Job.RunnerName == runnerName || record.VmName == runnerName) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// returns a copy of all jobs that are in one of the given states (all jobs if no state is given)
+func (s *JobStore) List(states ...JobState) []JobRecord {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []JobRecord{}
+	for _, record := range s.jobs {
+		if len(states) == 0 {
+			ret = append(ret, *record)
+			continue
+		}
+		for _, state := range states {
+			if record.State == state {
+				ret = append(ret, *record)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// has to be called with locked mutex. GitHub fails jobs that are queued for more than 24 h so there is no need to keep unfinished jobs either
+func (s *JobStore) prune() {
+
+	for id, record := range s.jobs {
+		if time.Since(record.UpdatedAt) > JOB_RETENTION {
+			delete(s.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// the key of the jit config in the Secret of a runner Pod
+const KUBERNETES_JIT_CONFIG_KEY string = "jitconfig"
+
+// the name of the runner container in the Pod
+const KUBERNETES_RUNNER_CONTAINER string = "runner"
+
+// how many lines of the runner logs are read (the output is cut to SERIAL_OUTPUT_TAIL anyway)
+const KUBERNETES_LOG_TAIL_LINES int64 = 500
+
+// Launches each runner as a Pod from RUNNER_IMAGE in the namespace KUBERNETES_NAMESPACE. The jit config is kept in a Secret owned
+// by the Pod. The Pods carry the runner labels as Pod labels, so they are listed (and reconciled) by label
+type KubernetesBackend struct {
+	client    kubernetes.Interface
+	namespace string
+	image     string
+}
+
+// Connects to the cluster the autoscaler runs in or - if kubeconfig is set - to the current context of the kubeconfig file
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+
+	var config *rest.Config
+	var err error
+	if len(kubeconfig) > 0 {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load the kubernetes config: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func NewKubernetesBackend(client kubernetes.Interface, namespace string, image string) (*KubernetesBackend, error) {
+
+	if len(namespace) == 0 {
+		return nil, fmt.Errorf("the kubernetes backend requires KUBERNETES_NAMESPACE")
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("the kubernetes backend requires RUNNER_IMAGE")
+	}
+	return &KubernetesBackend{client: client, namespace: namespace, image: image}, nil
+}
+
+// The container resources of the runner profile. The requests equal the limits, a missing value is not constrained
+func KubernetesResources(cpus float64, memoryMb int64) corev1.ResourceRequirements {
+
+	resources := corev1.ResourceList{}
+	if cpus > 0 {
+		resources[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(cpus*1000), resource.DecimalSI)
+	}
+	if memoryMb > 0 {
+		resources[corev1.ResourceMemory] = *resource.NewQuantity(memoryMb*1024*1024, resource.BinarySI)
+	}
+	if len(resources) == 0 {
+		return corev1.ResourceRequirements{}
+	}
+	return corev1.ResourceRequirements{Requests: resources, Limits: resources.DeepCopy()}
+}
+
+// Creates the runner Pod and the Secret with its jit config. The Pod is started first (it waits for the Secret), so the Secret can be
+// owned by the Pod and is garbage collected with it
+func (b *KubernetesBackend) CreateRunner(ctx context.Context, runner RunnerSpec) (_ string, err error) {
+
+	name := runner.Settings.Name
+	ctx, span := startSpan(ctx, "kubernetes.CreatePod", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	if len(runner.JitConfig) == 0 {
+		return "", fmt.Errorf("pod %s: the kubernetes backend requires a jit config", name)
+	}
+	automount := false
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: b.namespace, Labels: runner.Settings.Labels},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                corev1.RestartPolicyNever,
+			AutomountServiceAccountToken: &automount, // the runner must not act as the service account of the namespace
+			Containers: []corev1.Container{{
+				Name:    KUBERNETES_RUNNER_CONTAINER,
+				Image:   b.image,
+				Command: DOCKER_RUNNER_CMD,
+				Env: []corev1.EnvVar{{
+					Name: DOCKER_JIT_CONFIG_ENV,
+					ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: name},
+						Key:                  KUBERNETES_JIT_CONFIG_KEY,
+					}},
+				}},
+				Resources: KubernetesResources(runner.Settings.Cpus, runner.Settings.MemoryMb),
+			}},
+		},
+	}
+	log.WithContext(ctx).Debugf("About to create pod %s from image %s", name, b.image)
+	if pod, err = b.client.CoreV1().Pods(b.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		log.WithContext(ctx).Errorf("Could not create pod %s from image %s: %s", name, b.image, err.Error())
+		return "", err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       b.namespace,
+			Labels:          runner.Settings.Labels,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID}},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{KUBERNETES_JIT_CONFIG_KEY: runner.JitConfig},
+	}
+	if _, err = b.client.CoreV1().Secrets(b.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		log.WithContext(ctx).Errorf("Could not create secret for pod %s: %s", name, err.Error())
+		if err := b.DeleteRunner(context.WithoutCancel(ctx), name); err != nil {
+			log.WithContext(ctx).Warnf("Could not delete pod %s: %s", name, err.Error())
+		}
+		return "", err
+	}
+	log.WithContext(ctx).Infof("Created pod %s from image %s", name, b.image)
+	return "", nil
+}
+
+// deletes the Pod (also if it is still running) and its Secret
+func (b *KubernetesBackend) DeleteRunner(ctx context.Context, name string) (err error) {
+
+	ctx, span := startSpan(ctx, "kubernetes.DeletePod", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	log.WithContext(ctx).Debugf("About to delete pod %s", name)
+	if err := b.client.CoreV1().Pods(b.namespace).Delete(ctx, name, metav1.DeleteOptions{}); apierrors.IsNotFound(err) {
+		log.WithContext(ctx).Infof("Pod %s already gone", name)
+	} else if err != nil {
+		log.WithContext(ctx).Errorf("Could not delete pod %s: %s", name, err.Error())
+		return err
+	} else {
+		log.WithContext(ctx).Infof("Deleted pod %s", name)
+	}
+	// the Secret is garbage collected with the Pod. Deleting it right away does not leave the jit config around until then
+	if err := b.client.CoreV1().Secrets(b.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		log.WithContext(ctx).Warnf("Could not delete secret of pod %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// Pods have no zone
+func (b *KubernetesBackend) Zone(ctx context.Context, name string) string {
+
+	return ""
+}
+
+// The Pod phase mapped to the VM states (a Pod that ran to completion is TERMINATED)
+func PodState(pod *corev1.Pod) State {
+
+	if pod.DeletionTimestamp != nil {
+		return STOPPING
+	}
+	switch pod.Status.Phase {
+	case corev1.PodPending:
+		return PROVISIONING
+	case corev1.PodRunning:
+		return RUNNING
+	case corev1.PodSucceeded, corev1.PodFailed:
+		return TERMINATED
+	default:
+		return Unknown
+	}
+}
+
+func (b *KubernetesBackend) RunnerState(ctx context.Context, name string) (State, error) {
+
+	if pod, err := b.client.CoreV1().Pods(b.namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		log.WithContext(ctx).Errorf("Could not get status for pod: %s - %s", name, err.Error())
+		return Unknown, err
+	} else {
+		return PodState(pod), nil
+	}
+}
+
+// the tail of the logs of the runner container
+func (b *KubernetesBackend) RunnerOutput(ctx context.Context, name string) string {
+
+	tail := KUBERNETES_LOG_TAIL_LINES
+	req := b.client.CoreV1().Pods(b.namespace).GetLogs(name, &corev1.PodLogOptions{Container: KUBERNETES_RUNNER_CONTAINER, TailLines: &tail})
+	data, err := req.Do(ctx).Raw()
+	if err != nil {
+		log.WithContext(ctx).Warnf("Could not read logs of pod %s: %s", name, err.Error())
+		return ""
+	}
+	output := string(data)
+	if len(output) > SERIAL_OUTPUT_TAIL {
+		output = output[len(output)-SERIAL_OUTPUT_TAIL:]
+	}
+	return output
+}
+
+// Lists the Pods labeled as managed by the autoscaler (also the completed ones)
+func (b *KubernetesBackend) ListRunners(ctx context.Context) ([]ManagedVm, error) {
+
+	selector := fmt.Sprintf("%s=%s", VM_LABEL_MANAGED_BY, VM_LABEL_MANAGED_BY_VALUE)
+	pods, err := b.client.CoreV1().Pods(b.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		log.WithContext(ctx).Errorf("Could not list pods: %s", err.Error())
+		return nil, err
+	}
+	ret := []ManagedVm{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		image := b.image
+		if len(pod.Spec.Containers) > 0 {
+			image = pod.Spec.Containers[0].Image
+		}
+		ret = append(ret, runnerVm(pod.Name, "", string(PodState(pod)), image, pod.CreationTimestamp.Time, pod.Labels))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+	return ret, nil
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TASK_QUEUE value that dispatches the callbacks in-process instead of through Cloud Tasks
+const LOCAL_TASK_QUEUE string = "local"
+
+// a failed callback is retried with exponential backoff starting with this delay (like Cloud Tasks)
+const LOCAL_TASK_MIN_BACKOFF time.Duration = 1 * time.Second
+const LOCAL_TASK_MAX_BACKOFF time.Duration = 1 * time.Minute
+const LOCAL_TASK_MAX_ATTEMPTS int = 10
+
+// the name of a dispatched task can't be reused for this long (like Cloud Tasks)
+const LOCAL_TASK_TOMBSTONE time.Duration = 1 * time.Hour
+
+var ErrTaskExists = errors.New("task already exists")
+var ErrTaskNotFound = errors.New("task not found")
+
+// only the status code of a callback matters
+type statusRecorder struct {
+	header http.Header
+	code   int
+}
+
+func (r *statusRecorder) Header() http.Header {
+
+	return r.header
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return len(data), nil
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+type localTask struct {
+	timer *time.Timer
+	done  time.Time // zero while the task is scheduled or running
+}
+
+// An in-memory replacement of the Cloud Tasks queue (TASK_QUEUE "local"), e.g. to run the autoscaler locally with the docker backend.
+// The callbacks are dispatched to the handler with the same headers and body, failed callbacks are retried. Scheduled tasks are lost
+// on shutdown
+type LocalTaskQueue struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	handler http.Handler
+	timeout time.Duration
+	tasks   map[string]*localTask
+}
+
+// the tasks are no longer dispatched once ctx is canceled
+func NewLocalTaskQueue(ctx context.Context, handler http.Handler, timeout time.Duration) *LocalTaskQueue {
+
+	return &LocalTaskQueue{ctx: ctx, handler: handler, timeout: timeout, tasks: map[string]*localTask{}}
+}
+
+// Schedules the POST callback to the url after the delay. Returns ErrTaskExists if a task with the name exists or was dispatched
+// within LOCAL_TASK_TOMBSTONE
+func (q *LocalTaskQueue) CreateTask(name string, url string, headers map[string]string, body []byte, delay time.Duration) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for taskName, task := range q.tasks {
+		if !task.done.IsZero() && time.Since(task.done) > LOCAL_TASK_TOMBSTONE {
+			delete(q.tasks, taskName)
+		}
+	}
+	if _, ok := q.tasks[name]; ok {
+		return ErrTaskExists
+	}
+	task := &localTask{}
+	task.timer = time.AfterFunc(delay, func() { q.dispatch(name, url, headers, body, 0) })
+	q.tasks[name] = task
+	return nil
+}
+
+// Deletes the task unless it was already dispatched
+func (q *LocalTaskQueue) DeleteTask(name string) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if task, ok := q.tasks[name]; !ok || !task.done.IsZero() || !task.timer.Stop() {
+		return ErrTaskNotFound
+	}
+	delete(q.tasks, name)
+	return nil
+}
+
+func (q *LocalTaskQueue) dispatch(name string, url string, headers map[string]string, body []byte, attempt int) {
+
+	if q.ctx.Err() != nil {
+		log.Warnf("Dropping local task %s - shutting down", name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Dropping local task %s: %s", name, err.Error())
+		q.finish(name)
+		return
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res := &statusRecorder{header: http.Header{}}
+	q.handler.ServeHTTP(res, req)
+	if res.code == 0 {
+		res.code = http.StatusOK
+	}
+	if res.code >= http.StatusOK && res.code < http.StatusMultipleChoices {
+		q.finish(name)
+	} else if attempt+1 >= LOCAL_TASK_MAX_ATTEMPTS {
+		log.Errorf("Local task %s failed with %d after %d attempts - giving up", name, res.code, attempt+1)
+		q.finish(name)
+	} else {
+		backoff := min(LOCAL_TASK_MIN_BACKOFF<<attempt, LOCAL_TASK_MAX_BACKOFF)
+		log.Warnf("Local task %s failed with %d - retrying in %s", name, res.code, backoff.String())
+		q.mu.Lock()
+		if task, ok := q.tasks[name]; ok {
+			task.timer = time.AfterFunc(backoff, func() { q.dispatch(name, url, headers, body, attempt+1) })
+		}
+		q.mu.Unlock()
+	}
+}
+
+// remembers the name of the dispatched task (see LOCAL_TASK_TOMBSTONE)
+func (q *LocalTaskQueue) finish(name string) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if task, ok := q.tasks[name]; ok {
+		task.done = time.Now()
+	}
+}
@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+)
+
+// the managed instances are polled this often until the created instance is running
+const MIG_POLL_INTERVAL time.Duration = 5 * time.Second
+
+// the current action of a managed instance that is running (or stopped) and not being changed by the MIG
+const MIG_ACTION_NONE string = "NONE"
+
+// The region of a zone, e.g. europe-west1 of europe-west1-b
+func ZoneRegion(zone string) string {
+
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// The zone of an instance url, e.g. europe-west1-b of .../zones/europe-west1-b/instances/runner-abc. Empty if the url has no zone
+func InstanceUrlZone(url string) string {
+
+	parts := strings.Split(url, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "zones" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// The per-instance config of a runner VM: the MIG creates the instance with this name and metadata (incl. the jit config)
+func PerInstanceConfig(name string, metadata []*computepb.Items) *computepb.PerInstanceConfig {
+
+	preserved := map[string]string{}
+	for _, item := range metadata {
+		preserved[item.GetKey()] = item.GetValue()
+	}
+	return &computepb.PerInstanceConfig{
+		Name:           proto.String(name),
+		PreservedState: &computepb.PreservedState{Metadata: preserved},
+	}
+}
+
+// Creates the runner VMs as instances of a regional managed instance group (INSTANCE_GROUP_MANAGER) built from the instance template.
+// The MIG picks the zone, so the zone of a VM is looked up (and cached) instead of derived from its name
+type migBackend struct {
+	s       *Autoscaler
+	region  string
+	manager string
+	zones   sync.Map // VM name -> zone
+}
+
+func newMigBackend(s *Autoscaler) (*migBackend, error) {
+
+	if len(s.conf.InstanceGroupManager) == 0 {
+		return nil, fmt.Errorf("the mig backend requires INSTANCE_GROUP_MANAGER")
+	} else if s.conf.AsyncCreate || s.conf.BulkCreateWindow > 0 {
+		return nil, fmt.Errorf("ASYNC_CREATE and BULK_CREATE_WINDOW are not supported by the mig backend")
+	} else if len(s.conf.Zones) == 0 {
+		return nil, fmt.Errorf("the mig backend requires ZONES")
+	}
+	region := ZoneRegion(s.conf.Zones[0])
+	for _, zone := range s.conf.Zones {
+		if ZoneRegion(zone) != region {
+			return nil, fmt.Errorf("zone %s is not in region %s of the managed instance group", zone, region)
+		}
+	}
+	return &migBackend{s: s, region: region, manager: s.conf.InstanceGroupManager}, nil
+}
+
+// blocking until the managed instance is running. The machine type and instance template of the runner profile are ignored - the
+// instance is created from the instance template of the MIG
+func (b *migBackend) CreateRunner(ctx context.Context, runner RunnerSpec) (_ string, err error) {
+
+	name := runner.Settings.Name
+	ctx, span := startSpan(ctx, "compute.CreateManagedInstance", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	if runner.Settings.MachineType != nil || len(runner.Settings.InstanceTemplate) > 0 {
+		log.WithContext(ctx).Warnf("Instance %s is created from the instance template of %s - the machine type and instance template of the runner profile are ignored", name, b.manager)
+	}
+	if b.s.conf.Simulate {
+		log.WithContext(ctx).Infof("(SIMULATE) Created managed instance %s (%s)", name, b.manager)
+		return "", nil
+	}
+
+	log.WithContext(ctx).Debugf("About to create managed instance %s (%s)", name, b.manager)
+	client := b.s.regionInstanceGroupManagersClient()
+	if res, err := client.CreateInstances(ctx, &computepb.CreateInstancesRegionInstanceGroupManagerRequest{
+		Project:              b.s.conf.ProjectId,
+		Region:               b.region,
+		InstanceGroupManager: b.manager,
+		RegionInstanceGroupManagersCreateInstancesRequestResource: &computepb.RegionInstanceGroupManagersCreateInstancesRequest{
+			Instances: []*computepb.PerInstanceConfig{PerInstanceConfig(name, runner.Metadata)},
+		},
+	}); err != nil {
+		log.WithContext(ctx).Errorf("Could not create managed instance %s (%s): %s", name, b.manager, err.Error())
+		return "", err
+	} else if err := res.Wait(ctx); err != nil {
+		log.WithContext(ctx).Errorf("Failed to wait for managed instance %s (%s) to be scheduled: %s", name, b.manager, err.Error())
+		return "", err
+	}
+
+	zone, err := b.waitForInstance(ctx, name)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Managed instance %s (%s) was not created: %s", name, b.manager, err.Error())
+		// otherwise the MIG keeps retrying to create the instance
+		if err := b.DeleteRunner(context.WithoutCancel(ctx), name); err != nil {
+			log.WithContext(ctx).Warnf("Could not delete managed instance %s: %s", name, err.Error())
+		}
+		return "", err
+	}
+	span.SetAttributes(ATTR_ZONE.String(zone))
+	log.WithContext(ctx).Infof("Created managed instance %s (%s) in %s", name, b.manager, zone)
+	// per-instance configs can't carry labels
+	if instance, err := b.s.computeClient().Get(ctx, &computepb.GetInstanceRequest{Project: b.s.conf.ProjectId, Zone: zone, Instance: name}); err != nil {
+		log.WithContext(ctx).Warnf("Could not read instance %s (%s): %s", name, zone, err.Error())
+	} else {
+		b.s.setInstanceLabels(ctx, zone, name, instance.LabelFingerprint, runner.Settings.Labels)
+	}
+	return "", nil
+}
+
+// polls the managed instance until the MIG created it. Returns the zone of the instance
+func (b *migBackend) waitForInstance(ctx context.Context, name string) (string, error) {
+
+	for {
+		if instance, err := b.managedInstance(ctx, name); err != nil {
+			return "", err
+		} else if instance != nil {
+			zone := InstanceUrlZone(instance.GetInstance())
+			if len(zone) > 0 {
+				b.zones.Store(name, zone)
+			}
+			if lastErr := instance.GetLastAttempt().GetErrors(); len(lastErr.GetMessage()) > 0 {
+				return zone, &OperationError{Operation: "createInstances", Messages: []string{fmt.Sprintf("%s: %s", lastErr.GetCode(), lastErr.GetMessage())}}
+			} else if instance.GetCurrentAction() == MIG_ACTION_NONE {
+				return zone, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(MIG_POLL_INTERVAL):
+		}
+	}
+}
+
+// the managed instance with the name or nil if the MIG has no such instance
+func (b *migBackend) managedInstance(ctx context.Context, name string) (*computepb.ManagedInstance, error) {
+
+	client := b.s.regionInstanceGroupManagersClient()
+	it := client.ListManagedInstances(ctx, &computepb.ListManagedInstancesRegionInstanceGroupManagersRequest{
+		Project:              b.s.conf.ProjectId,
+		Region:               b.region,
+		InstanceGroupManager: b.manager,
+	})
+	for {
+		if instance, err := it.Next(); err == iterator.Done {
+			return nil, nil
+		} else if err != nil {
+			log.WithContext(ctx).Errorf("Could not list managed instances of %s: %s", b.manager, err.Error())
+			return nil, err
+		} else if instance.GetName() == name || strings.HasSuffix(instance.GetInstance(), "/instances/"+name) {
+			return instance, nil
+		}
+	}
+}
+
+// blocking until the managed instance (and its per-instance config) is deleted. The size of the MIG shrinks accordingly
+func (b *migBackend) DeleteRunner(ctx context.Context, name string) (err error) {
+
+	ctx, span := startSpan(ctx, "compute.DeleteManagedInstance", ATTR_VM_NAME.String(name))
+	defer func() { endSpan(span, err) }()
+
+	if b.s.conf.Simulate {
+		log.WithContext(ctx).Infof("(SIMULATE) Deleted managed instance %s (%s)", name, b.manager)
+		return nil
+	}
+	zone := b.Zone(ctx, name)
+	if len(zone) == 0 {
+		log.WithContext(ctx).Infof("Managed instance %s (%s) already gone", name, b.manager)
+		return nil
+	}
+	span.SetAttributes(ATTR_ZONE.String(zone))
+
+	log.WithContext(ctx).Debugf("About to delete managed instance %s (%s) in %s", name, b.manager, zone)
+	client := b.s.regionInstanceGroupManagersClient()
+	if res, err := client.DeleteInstances(ctx, &computepb.DeleteInstancesRegionInstanceGroupManagerRequest{
+		Project:              b.s.conf.ProjectId,
+		Region:               b.region,
+		InstanceGroupManager: b.manager,
+		RegionInstanceGroupManagersDeleteInstancesRequestResource: &computepb.RegionInstanceGroupManagersDeleteInstancesRequest{
+			Instances: []string{fmt.Sprintf("zones/%s/instances/%s", zone, name)},
+			// an instance that is already gone is not an error
+			SkipInstancesOnValidationError: proto.Bool(true),
+		},
+	}); err != nil {
+		log.WithContext(ctx).Errorf("Could not delete managed instance %s (%s): %s", name, b.manager, err.Error())
+		return err
+	} else if err := res.Wait(ctx); err != nil {
+		log.WithContext(ctx).Errorf("Failed to wait for managed instance %s (%s) to be deleted: %s", name, b.manager, err.Error())
+		return err
+	}
+	b.zones.Delete(name)
+	log.WithContext(ctx).Infof("Deleted managed instance %s (%s) in %s", name, b.manager, zone)
+	return nil
+}
+
+// the zone is cached once known - another autoscaler instance (e.g. after a scale-out of Cloud Run) looks it up in the MIG
+func (b *migBackend) Zone(ctx context.Context, name string) string {
+
+	if zone, ok := b.zones.Load(name); ok {
+		return zone.(string)
+	} else if b.s.conf.Simulate {
+		return b.s.PickRandomZone(name)
+	} else if instance, err := b.managedInstance(ctx, name); err != nil || instance == nil {
+		return ""
+	} else if zone := InstanceUrlZone(instance.GetInstance()); len(zone) > 0 {
+		b.zones.Store(name, zone)
+		return zone
+	}
+	return ""
+}
+
+func (b *migBackend) RunnerState(ctx context.Context, name string) (State, error) {
+
+	return b.s.GetInstanceState(ctx, name)
+}
+
+func (b *migBackend) RunnerOutput(ctx context.Context, name string) string {
+
+	return b.s.GetSerialOutput(ctx, name)
+}
+
+// the instances of the MIG are labeled once they are running (see CreateRunner)
+func (b *migBackend) ListRunners(ctx context.Context) ([]ManagedVm, error) {
+
+	return b.s.ListInstances(ctx)
+}
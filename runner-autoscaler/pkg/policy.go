@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const WORKFLOW_RUN_ENDPOINT string = "https://api.github.com/repos/%s/actions/runs/%d"
+const ORG_MEMBER_ENDPOINT string = "https://api.github.com/orgs/%s/members/%s"
+
+type PolicyAction string
+
+const (
+	PolicyAllow   PolicyAction = "allow"
+	PolicyIsolate PolicyAction = "isolate" // the runner VM is created from the isolated profile
+	PolicyDeny    PolicyAction = "deny"    // no runner VM is created
+)
+
+// the stricter action wins
+func (a PolicyAction) severity() int {
+
+	switch a {
+	case PolicyDeny:
+		return 2
+	case PolicyIsolate:
+		return 1
+	}
+	return 0
+}
+
+// Decides how workflow jobs of public repositories, pull requests from forks and untrusted actors are handled.
+// All checks default to "allow"
+type SecurityPolicy struct {
+	PublicRepositories PolicyAction `json:"public_repositories,omitempty"`
+	ForkPullRequests   PolicyAction `json:"fork_pull_requests,omitempty"`
+	UntrustedActors    PolicyAction `json:"untrusted_actors,omitempty"`
+	TrustedActors      []string     `json:"trusted_actors,omitempty"`    // logins of trusted actors (globs like "*[bot]" are supported)
+	TrustOrgMembers    bool         `json:"trust_org_members,omitempty"` // members of the organization owning the repository are trusted
+	IsolatedProfile    string       `json:"isolated_profile,omitempty"`  // the runner profile used for isolated jobs
+}
+
+// The facts about a workflow run the security policy is evaluated against
+type RunFacts struct {
+	PublicRepository bool
+	ForkPullRequest  bool
+	Actor            string
+	TrustedActor     bool
+}
+
+type PolicyDecision struct {
+	Action PolicyAction
+	Reason string
+}
+
+// Validates the actions and the isolated profile
+func (p *SecurityPolicy) Validate(profiles []RunnerProfile) error {
+
+	isolate := false
+	for _, action := range []*PolicyAction{&p.PublicRepositories, &p.ForkPullRequests, &p.UntrustedActors} {
+		switch *action {
+		case "":
+			*action = PolicyAllow
+		case PolicyAllow, PolicyDeny:
+		case PolicyIsolate:
+			isolate = true
+		default:
+			return fmt.Errorf("unknown security policy action \"%s\" - expected allow, isolate or deny", *action)
+		}
+	}
+	for _, actor := range p.TrustedActors {
+		if _, err := path.Match(actor, ""); err != nil {
+			return fmt.Errorf("invalid trusted actor \"%s\": %s", actor, err.Error())
+		}
+	}
+	if isolate {
+		if len(p.IsolatedProfile) == 0 {
+			return fmt.Errorf("the security policy isolates jobs but no isolated_profile is configured")
+		} else if profile := profileByName(profiles, p.IsolatedProfile); profile == nil {
+			return fmt.Errorf("the isolated profile \"%s\" of the security policy is not configured (see RUNNER_PROFILES)", p.IsolatedProfile)
+		}
+	}
+	return nil
+}
+
+// true if at least one check is not "allow" - only then the workflow run has to be read from the GitHub api
+func (p *SecurityPolicy) isActive() bool {
+
+	return p.PublicRepositories.severity() > 0 || p.ForkPullRequests.severity() > 0 || p.UntrustedActors.severity() > 0
+}
+
+func (p *SecurityPolicy) isTrustedActor(actor string) bool {
+
+	for _, trusted := range p.TrustedActors {
+		if ok, _ := path.Match(strings.ToLower(trusted), strings.ToLower(actor)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the strictest action of all checks that apply to the run
+func (p *SecurityPolicy) Evaluate(facts RunFacts) PolicyDecision {
+
+	decision := PolicyDecision{Action: PolicyAllow}
+	reasons := []string{}
+	apply := func(action PolicyAction, reason string) {
+		if action.severity() > 0 {
+			reasons = append(reasons, reason)
+		}
+		if action.severity() > decision.Action.severity() {
+			decision.Action = action
+		}
+	}
+	if facts.PublicRepository {
+		apply(p.PublicRepositories, "public repository")
+	}
+	if facts.ForkPullRequest {
+		apply(p.ForkPullRequests, "pull request from a fork")
+	}
+	if !facts.TrustedActor {
+		apply(p.UntrustedActors, fmt.Sprintf("untrusted actor \"%s\"", facts.Actor))
+	}
+	decision.Reason = strings.Join(reasons, ", ")
+	return decision
+}
+
+type workflowRunDetails struct {
+	Event           string      `json:"event"`
+	Repository      Repository  `json:"repository"`
+	HeadRepository  *Repository `json:"head_repository,omitempty"`
+	Actor           *User       `json:"actor,omitempty"`
+	TriggeringActor *User       `json:"triggering_actor,omitempty"`
+}
+
+// the security policy of the source (SOURCE_SETTINGS) or the global one (SECURITY_POLICY)
+func (s *Autoscaler) securityPolicy(src Source) *SecurityPolicy {
+
+	if src.SecurityPolicy != nil {
+		return src.SecurityPolicy
+	}
+	return &s.conf.SecurityPolicy
+}
+
+// Evaluates the security policy for the workflow job. The repository visibility, event, head repository and triggering actor
+// are read from the workflow run
+func (s *Autoscaler) evaluatePolicy(ctx context.Context, src Source, job Job) (PolicyDecision, error) {
+
+	policy := s.securityPolicy(src)
+	if !policy.isActive() {
+		return PolicyDecision{Action: PolicyAllow}, nil
+	}
+	repo := job.repository()
+	if len(repo) == 0 || job.RunId == 0 {
+		return PolicyDecision{Action: PolicyDeny, Reason: "repository or workflow run unknown"}, nil
+	}
+	run := workflowRunDetails{}
+	if err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(WORKFLOW_RUN_ENDPOINT, repo, job.RunId), nil, &run, http.StatusOK); err != nil {
+		log.WithContext(ctx).Errorf("Could not read workflow run %d of repository %s: %s", job.RunId, repo, err.Error())
+		return PolicyDecision{}, err
+	}
+
+	facts := RunFacts{}
+	visibility := run.Repository.Visibility
+	if job.Repository != nil && len(job.Repository.Visibility) > 0 {
+		visibility = job.Repository.Visibility
+	}
+	facts.PublicRepository = visibility == "public" || (len(visibility) == 0 && !run.Repository.Private)
+	facts.ForkPullRequest = strings.HasPrefix(run.Event, "pull_request") && run.HeadRepository != nil &&
+		(run.HeadRepository.Fork || !strings.EqualFold(run.HeadRepository.FullName, run.Repository.FullName))
+	if run.TriggeringActor != nil {
+		facts.Actor = run.TriggeringActor.Login
+	} else if run.Actor != nil {
+		facts.Actor = run.Actor.Login
+	} else if job.Sender != nil {
+		facts.Actor = job.Sender.Login
+	}
+	if policy.UntrustedActors.severity() > 0 {
+		facts.TrustedActor = len(facts.Actor) > 0 && policy.isTrustedActor(facts.Actor)
+		if !facts.TrustedActor && policy.TrustOrgMembers && len(facts.Actor) > 0 {
+			if member, err := s.isOrgMember(ctx, run.Repository.Owner.Login, facts.Actor); err != nil {
+				return PolicyDecision{}, err
+			} else {
+				facts.TrustedActor = member
+			}
+		}
+	} else {
+		facts.TrustedActor = true
+	}
+	return policy.Evaluate(facts), nil
+}
+
+func (s *Autoscaler) isOrgMember(ctx context.Context, org string, user string) (bool, error) {
+
+	if len(org) == 0 {
+		return false, nil
+	}
+	if err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(ORG_MEMBER_ENDPOINT, org, user), nil, nil, http.StatusNoContent); err != nil {
+		// if the PAT owner is no member of the organization, GitHub redirects to the public members (404 for private members)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
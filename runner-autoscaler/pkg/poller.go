@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const REPO_RUNS_ENDPOINT string = "https://api.github.com/repos/%s/actions/runs?status=%s&per_page=100&page=%d" // format USER/REPO
+const RUN_JOBS_ENDPOINT string = "https://api.github.com/repos/%s/actions/runs/%d/jobs?filter=latest&per_page=100&page=%d"
+const ORG_REPOS_ENDPOINT string = "https://api.github.com/orgs/%s/repos?per_page=100&page=%d"
+
+const POLL_MAX_PAGES int = 10
+
+// the repositories of an organization are polled in rounds of at most this many repositories per interval
+const POLL_MAX_REPOSITORIES int = 10
+
+// polling for queued jobs stops for the interval once fewer requests are left in the rate limit window of the PAT. The remaining
+// requests are kept for the webhook and runner registration paths
+const POLL_RATE_LIMIT_RESERVE int64 = 1000
+
+// where the polling of an organization continues in the next interval
+type orgPollState struct {
+	repos  []Repository // listed again when a new round starts
+	cursor int
+}
+
+type pollState struct {
+	mu   sync.Mutex // PollOnce is also triggered by the admin API
+	orgs map[string]*orgPollState
+}
+
+type workflowRun struct {
+	Id              int64      `json:"id"`
+	Repository      Repository `json:"repository"`
+	TriggeringActor *User      `json:"triggering_actor,omitempty"`
+}
+
+type workflowRunsResponse struct {
+	WorkflowRuns []workflowRun `json:"workflow_runs"`
+}
+
+type workflowJobsResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+func (s *Autoscaler) rememberCallbackHost(host string) {
+
+	if len(host) > 0 {
+		s.callbackHost.Store(host)
+	}
+}
+
+// the host the cloud task callbacks are sent to if there is no incoming request (CALLBACK_HOST or the host of the last webhook)
+func (s *Autoscaler) getCallbackHost() string {
+
+	if len(s.conf.CallbackHost) > 0 {
+		return s.conf.CallbackHost
+	} else if host, ok := s.callbackHost.Load().(string); ok {
+		return host
+	}
+	return ""
+}
+
+// Periodically lists the queued workflow jobs of all sources and feeds them into the same create path as the webhook.
+// Also acts as a safety net for webhook events GitHub failed to deliver
+func (s *Autoscaler) poll(ctx context.Context, interval time.Duration) {
+
+	log.WithContext(ctx).Infof("Polling queued workflow jobs every %s", interval.String())
+	for _, src := range s.conf.RegisteredSources {
+		if src.SourceType == TypeEnterprise && !src.DisablePolling {
+			log.WithContext(ctx).Warnf("Enterprise source %s can't be polled - only its webhook events are processed", src.Name)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.PollOnce(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Autoscaler) PollOnce(ctx context.Context, interval time.Duration) {
+
+	host := s.getCallbackHost()
+	if len(host) == 0 {
+		log.WithContext(ctx).Warn("Can not poll workflow jobs - the callback host is unknown (see CALLBACK_HOST)")
+		return
+	}
+	s.polling.mu.Lock()
+	defer s.polling.mu.Unlock()
+	for _, src := range s.conf.RegisteredSources {
+		if src.DisablePolling {
+			continue
+		}
+		switch src.SourceType {
+		case TypeRepository:
+			if !s.pollBudgetExhausted(ctx) {
+				s.pollRepository(ctx, host, src, Repository{FullName: src.Name})
+			}
+		case TypeOrganization:
+			s.pollOrganization(ctx, host, src)
+		default:
+			log.WithContext(ctx).Debugf("Polling is not supported for %s source %s", src.SourceType, src.Name)
+			continue
+		}
+		// the tracked jobs are checked regardless of the rate limit, otherwise their runners might never be deleted
+		s.pollTrackedJobs(ctx, host, src, interval)
+	}
+}
+
+// true if the rate limit of the PAT is too low to poll for queued jobs (see POLL_RATE_LIMIT_RESERVE)
+func (s *Autoscaler) pollBudgetExhausted(ctx context.Context) bool {
+
+	if remaining := s.github.RateLimitRemaining(); remaining >= 0 && remaining < POLL_RATE_LIMIT_RESERVE {
+		log.WithContext(ctx).Warnf("Skipping polling of queued workflow jobs - only %d GitHub API requests left in the rate limit window", remaining)
+		return true
+	}
+	return false
+}
+
+// Returns the next batch of at most max repositories starting at the cursor and the cursor of the following batch (0 once the
+// round is complete)
+func PollBatch[T any](repos []T, cursor int, max int) ([]T, int) {
+
+	if cursor >= len(repos) {
+		cursor = 0
+	}
+	end := min(cursor+max, len(repos))
+	if end >= len(repos) {
+		return repos[cursor:end], 0
+	}
+	return repos[cursor:end], end
+}
+
+// polls the next POLL_MAX_REPOSITORIES repositories of the organization
+func (s *Autoscaler) pollOrganization(ctx context.Context, host string, src Source) {
+
+	if s.polling.orgs == nil {
+		s.polling.orgs = map[string]*orgPollState{}
+	}
+	state, ok := s.polling.orgs[src.Name]
+	if !ok {
+		state = &orgPollState{}
+		s.polling.orgs[src.Name] = state
+	}
+	if state.cursor == 0 {
+		if s.pollBudgetExhausted(ctx) {
+			return
+		}
+		state.repos = s.listOrgRepositories(ctx, src.Name)
+	}
+	start := state.cursor
+	batch, next := PollBatch(state.repos, start, POLL_MAX_REPOSITORIES)
+	for i, repo := range batch {
+		if s.pollBudgetExhausted(ctx) {
+			// continue with this repository in the next interval
+			state.cursor = start + i
+			return
+		}
+		s.pollRepository(ctx, host, src, repo)
+	}
+	state.cursor = next
+}
+
+// the repositories are listed with their topics and visibility, so the repository filter of the source can be applied to their jobs
+func (s *Autoscaler) listOrgRepositories(ctx context.Context, org string) []Repository {
+
+	ret := []Repository{}
+	for page := 1; page <= POLL_MAX_PAGES; page++ {
+		repos := []Repository{}
+		if err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(ORG_REPOS_ENDPOINT, org, page), nil, &repos, http.StatusOK); err != nil {
+			log.WithContext(ctx).Errorf("Could not list repositories of organization %s: %s", org, err.Error())
+			break
+		}
+		for _, repo := range repos {
+			if !repo.Archived {
+				ret = append(ret, repo)
+			}
+		}
+		if len(repos) < 100 {
+			break
+		}
+	}
+	return ret
+}
+
+// repo is the full repository if it was listed (see listOrgRepositories). The workflow runs only carry a minimal repository without
+// topics and visibility, which is used otherwise (repository sources)
+func (s *Autoscaler) pollRepository(ctx context.Context, host string, src Source, repo Repository) {
+
+	// jobs of a run that is already in progress may still be queued (e.g. matrix jobs)
+	for _, status := range []string{"queued", "in_progress"} {
+		for page := 1; page <= POLL_MAX_PAGES; page++ {
+			runs := workflowRunsResponse{}
+			if err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(REPO_RUNS_ENDPOINT, repo.FullName, status, page), nil, &runs, http.StatusOK); err != nil {
+				log.WithContext(ctx).Errorf("Could not list %s workflow runs of repository %s: %s", status, repo.FullName, err.Error())
+				break
+			}
+			for _, run := range runs.WorkflowRuns {
+				s.pollRun(ctx, host, src, repo, run)
+			}
+			if len(runs.WorkflowRuns) < 100 {
+				break
+			}
+		}
+	}
+}
+
+func (s *Autoscaler) pollRun(ctx context.Context, host string, src Source, repo Repository, run workflowRun) {
+
+	if repo.Id != 0 {
+		run.Repository = repo
+	}
+	for page := 1; page <= POLL_MAX_PAGES; page++ {
+		jobs := workflowJobsResponse{}
+		if err := s.github.Do(ctx, http.MethodGet, fmt.Sprintf(RUN_JOBS_ENDPOINT, repo.FullName, run.Id, page), nil, &jobs, http.StatusOK); err != nil {
+			log.WithContext(ctx).Errorf("Could not list workflow jobs of run %d in repository %s: %s", run.Id, repo.FullName, err.Error())
+			return
+		}
+		for _, job := range jobs.Jobs {
+			if job.Status == string(QUEUED) {
+				// also the jobs rejected before are not evaluated again
+				if record, known := s.jobs.Get(job.Id); known && !record.Queueable(src.Name) {
+					continue
+				}
+				// the jobs api does not return the repository and sender - they are taken from the workflow run (or the full repository)
+				job.Repository = &run.Repository
+				job.Sender = run.TriggeringActor
+				jobCtx, span := startJobSpan(ctx, "poll.queued", job.Id, ATTR_SOURCE.String(src.Name))
+				log.WithContext(jobCtx).Infof("Polling discovered queued workflow job Id %d in repository %s", job.Id, repo.FullName)
+				err := s.queueJob(jobCtx, host, src, job)
+				if err != nil {
+					log.WithContext(jobCtx).Errorf("Could not enqueue polled workflow job Id %d: %s", job.Id, err.Error())
+				}
+				endSpan(span, err)
+			}
+		}
+		if len(jobs.Jobs) < 100 {
+			return
+		}
+	}
+}
+
+// checks the state of jobs the autoscaler has enqueued a runner for, so runners are deleted (and pending jobs are removed from the
+// scheduler) even if the "completed" webhook event was lost
+func (s *Autoscaler) pollTrackedJobs(ctx context.Context, host string, src Source, interval time.Duration) {
+
+	for _, record := range s.jobs.List(JobPending, JobQueued, JobInProgress) {
+		if record.Source != src.Name || len(record.Job.Url) == 0 || time.Since(record.UpdatedAt) < interval {
+			continue
+		}
+		job := Job{}
+		if err := s.github.Do(ctx, http.MethodGet, record.Job.Url, nil, &job, http.StatusOK); err != nil {
+			log.WithContext(ctx).Errorf("Could not read state of workflow job Id %d: %s", record.Job.Id, err.Error())
+			continue
+		}
+		job.Repository, job.Organization, job.Sender = record.Job.Repository, record.Job.Organization, record.Job.Sender
+		if job.Status == string(COMPLETED) {
+			jobCtx, span := startJobSpan(ctx, "poll.completed", job.Id, ATTR_SOURCE.String(src.Name))
+			log.WithContext(jobCtx).Infof("Polling discovered completed workflow job Id %d", job.Id)
+			err := s.completeJob(jobCtx, host, src, job)
+			if err != nil {
+				log.WithContext(jobCtx).Errorf("Could not enqueue delete-vm for polled workflow job Id %d: %s", job.Id, err.Error())
+			}
+			endSpan(span, err)
+		} else if job.Status == string(IN_PROGRESS) && record.State != JobInProgress {
+			s.jobs.SetState(src.Name, job, JobInProgress)
+		}
+	}
+}
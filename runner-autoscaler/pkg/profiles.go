@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type LabelMatchMode string
+
+const (
+	// the job has to contain all labels of the profile (additional job labels are ignored)
+	MatchAll LabelMatchMode = "all"
+	// all labels of the job (except magic labels) have to be advertised by the profile
+	MatchSubset LabelMatchMode = "subset"
+	// all + subset
+	MatchExact LabelMatchMode = "exact"
+)
+
+const DEFAULT_PROFILE string = "default"
+
+// A runner profile describes the runner VMs created for the workflow jobs whose labels match the profile labels. Profile labels
+// are either literals (case insensitive), globs ("gpu-*") or regular expressions enclosed in slashes ("/^ubuntu-2[24]\.04$/")
+type RunnerProfile struct {
+	Name             string         `json:"name"`
+	Labels           []string       `json:"labels"`
+	Match            LabelMatchMode `json:"match,omitempty"`             // defaults to "all"
+	InstanceTemplate string         `json:"instance_template,omitempty"` // defaults to INSTANCE_TEMPLATE
+	MachineType      string         `json:"machine_type,omitempty"`      // defaults to the machine type of the instance template. The magic label @machine takes precedence
+	Spot             bool           `json:"spot,omitempty"`              // the instance template creates spot VMs (only used for the cost report)
+	Isolated         bool           `json:"isolated,omitempty"`          // only used for jobs the security policy isolates - never matched by labels
+	Cpus             float64        `json:"cpus,omitempty"`              // the CPU limit of the runner container (container backends only)
+	MemoryMb         int64          `json:"memory_mb,omitempty"`         // the memory limit of the runner container in MiB (container backends only)
+	patterns         []labelPattern
+}
+
+type labelPattern struct {
+	raw   string
+	match func(label string) bool
+}
+
+func newLabelPattern(pattern string) (labelPattern, error) {
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		if exp, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1]); err != nil {
+			return labelPattern{}, err
+		} else {
+			return labelPattern{raw: pattern, match: exp.MatchString}, nil
+		}
+	} else if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return labelPattern{}, err
+		}
+		lower := strings.ToLower(pattern)
+		return labelPattern{raw: pattern, match: func(label string) bool {
+			ok, _ := path.Match(lower, strings.ToLower(label))
+			return ok
+		}}, nil
+	}
+	return labelPattern{raw: pattern, match: func(label string) bool { return strings.EqualFold(pattern, label) }}, nil
+}
+
+// Validates the match mode and compiles the label patterns. Has to be called before the profile is used
+func (p *RunnerProfile) Compile() error {
+
+	if len(p.Name) == 0 {
+		return fmt.Errorf("runner profile without name")
+	}
+	switch p.Match {
+	case "":
+		p.Match = MatchAll
+	case MatchAll, MatchSubset, MatchExact:
+	default:
+		return fmt.Errorf("unknown label match mode \"%s\" of runner profile %s", p.Match, p.Name)
+	}
+	if p.Cpus < 0 || p.MemoryMb < 0 {
+		return fmt.Errorf("negative resource limit of runner profile %s", p.Name)
+	}
+	p.patterns = []labelPattern{}
+	for _, label := range p.Labels {
+		if IsMagicLabel(label) {
+			continue
+		}
+		if pattern, err := newLabelPattern(label); err != nil {
+			return fmt.Errorf("invalid label \"%s\" of runner profile %s: %s", label, p.Name, err.Error())
+		} else {
+			p.patterns = append(p.patterns, pattern)
+		}
+	}
+	return nil
+}
+
+// Returns true if the labels of the job match the profile. Otherwise the reason is returned
+func (p *RunnerProfile) Matches(job Job) (bool, string) {
+
+	if p.Match == MatchAll || p.Match == MatchExact {
+		missing := []string{}
+		for _, pattern := range p.patterns {
+			found := false
+			for _, label := range job.Labels {
+				if pattern.match(label) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, pattern.raw)
+			}
+		}
+		if len(missing) > 0 {
+			return false, fmt.Sprintf("job is missing the label(s) \"%s\"", strings.Join(missing, ", "))
+		}
+	}
+	if p.Match == MatchSubset || p.Match == MatchExact {
+		unknown := []string{}
+		for _, label := range job.Labels {
+			if IsMagicLabel(label) {
+				continue
+			}
+			found := false
+			for _, pattern := range p.patterns {
+				if pattern.match(label) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				unknown = append(unknown, label)
+			}
+		}
+		if len(unknown) > 0 {
+			return false, fmt.Sprintf("label(s) \"%s\" not advertised", strings.Join(unknown, ", "))
+		}
+	}
+	return true, ""
+}
+
+// Returns the first profile matching the job. If no profile matches, the reason of every profile is returned
+func MatchProfile(profiles []RunnerProfile, job Job) (*RunnerProfile, string) {
+
+	reasons := []string{}
+	for i := range profiles {
+		if profiles[i].Isolated {
+			continue
+		}
+		if ok, reason := profiles[i].Matches(job); ok {
+			return &profiles[i], ""
+		} else {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", profiles[i].Name, reason))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil, "no runner profile configured"
+	}
+	return nil, "no runner profile matches (" + strings.Join(reasons, "; ") + ")"
+}
+
+func profileByName(profiles []RunnerProfile, name string) *RunnerProfile {
+
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// the profile the runner VM for the job is created from. If no profile matches, the reason is returned
+func (s *Autoscaler) matchProfile(job Job) (*RunnerProfile, string) {
+
+	return MatchProfile(s.conf.RunnerProfiles, job)
+}
+
+// the profile assigned by the security policy or the profile matching the job labels
+func (s *Autoscaler) resolveProfile(task RunnerTask) (*RunnerProfile, string) {
+
+	if len(task.Profile) > 0 {
+		if profile := profileByName(s.conf.RunnerProfiles, task.Profile); profile != nil {
+			return profile, ""
+		}
+		return nil, fmt.Sprintf("runner profile \"%s\" not configured", task.Profile)
+	}
+	return s.matchProfile(task.Job)
+}
+
+// the magic label @machine takes precedence over the machine type of the profile. Nil if the machine type of the instance template is used
+func (p *RunnerProfile) machineType(job Job) *string {
+
+	if machineType := job.GetMagicLabelValue(MagicLabelMachine); machineType != nil {
+		return machineType
+	} else if len(p.MachineType) > 0 {
+		return &p.MachineType
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A repository rule matches if all conditions that are set match
+type RepositoryRule struct {
+	Repository string   `json:"repository,omitempty"` // OWNER/REPO or REPO, may be a glob ("internal-*")
+	Topics     []string `json:"topics,omitempty"`     // the repository has at least one of the topics (globs are supported)
+	Visibility string   `json:"visibility,omitempty"` // public, private or internal
+}
+
+// Includes or excludes the repositories of a source. Exclude rules take precedence over include rules
+type RepositoryFilter struct {
+	Include []RepositoryRule `json:"include,omitempty"` // if set, only repositories matching at least one rule are accepted
+	Exclude []RepositoryRule `json:"exclude,omitempty"` // repositories matching any rule are rejected
+}
+
+func (r *RepositoryRule) Validate() error {
+
+	if len(r.Repository) == 0 && len(r.Topics) == 0 && len(r.Visibility) == 0 {
+		return fmt.Errorf("empty repository rule")
+	}
+	if _, err := path.Match(r.Repository, ""); err != nil {
+		return fmt.Errorf("invalid repository pattern \"%s\": %s", r.Repository, err.Error())
+	}
+	for _, topic := range r.Topics {
+		if _, err := path.Match(topic, ""); err != nil {
+			return fmt.Errorf("invalid topic pattern \"%s\": %s", topic, err.Error())
+		}
+	}
+	switch r.Visibility {
+	case "", "public", "private", "internal":
+	default:
+		return fmt.Errorf("unknown visibility \"%s\" - expected public, private or internal", r.Visibility)
+	}
+	return nil
+}
+
+func (r *RepositoryRule) Matches(repo Repository) bool {
+
+	if len(r.Repository) > 0 {
+		// patterns without owner are matched against the repository name
+		name := repo.FullName
+		if !strings.Contains(r.Repository, "/") {
+			name = repo.Name
+			if len(name) == 0 {
+				name = path.Base(repo.FullName)
+			}
+		}
+		if ok, _ := path.Match(strings.ToLower(r.Repository), strings.ToLower(name)); !ok {
+			return false
+		}
+	}
+	if len(r.Topics) > 0 {
+		found := false
+		for _, pattern := range r.Topics {
+			for _, topic := range repo.Topics {
+				if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(topic)); ok {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Visibility) > 0 && r.Visibility != repo.visibility() {
+		return false
+	}
+	return true
+}
+
+func (f *RepositoryFilter) Validate() error {
+
+	for _, rules := range [][]RepositoryRule{f.Include, f.Exclude} {
+		for i := range rules {
+			if err := rules[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the repository passes the filter. Otherwise the reason is returned
+func (f *RepositoryFilter) Accepts(repo Repository) (bool, string) {
+
+	for i := range f.Exclude {
+		if f.Exclude[i].Matches(repo) {
+			return false, fmt.Sprintf("repository %s is excluded", repo.FullName)
+		}
+	}
+	if len(f.Include) == 0 {
+		return true, ""
+	}
+	for i := range f.Include {
+		if f.Include[i].Matches(repo) {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("repository %s is not included", repo.FullName)
+}
+
+// public, private or internal. Falls back to the private flag if the visibility is missing
+func (r Repository) visibility() string {
+
+	if len(r.Visibility) > 0 {
+		return strings.ToLower(r.Visibility)
+	} else if r.Private {
+		return "private"
+	}
+	return "public"
+}
+
+// checks the repository filter of the source (SOURCE_SETTINGS). The repository details come from the webhook payload or, for polled
+// jobs, from the listed repositories of the organization. If the job lacks the repository details, only the name is known
+func (s *Autoscaler) acceptsRepository(src Source, job Job) (bool, string) {
+
+	if src.Repositories == nil {
+		return true, ""
+	}
+	repo := Repository{FullName: job.repository()}
+	if job.Repository != nil {
+		repo = *job.Repository
+		repo.FullName = job.repository()
+	}
+	return src.Repositories.Accepts(repo)
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Routes workflow jobs of organization and enterprise sources to a runner group. All conditions that are set have to match
+type RunnerGroupRoute struct {
+	Source        string   `json:"source,omitempty"`     // the webhook source name
+	Repository    string   `json:"repository,omitempty"` // OWNER/REPO, may be a glob ("my-org/internal-*")
+	Labels        []string `json:"labels,omitempty"`     // the job has to contain all labels (literals, globs or regular expressions like profile labels)
+	Profile       string   `json:"profile,omitempty"`    // the name of the runner profile the job matches
+	RunnerGroupId int64    `json:"runner_group_id"`
+	patterns      []labelPattern
+}
+
+// Validates the route and compiles the label patterns. Has to be called before the route is used
+func (r *RunnerGroupRoute) Compile() error {
+
+	if r.RunnerGroupId <= 0 {
+		return fmt.Errorf("runner group route without runner_group_id")
+	}
+	if _, err := path.Match(r.Repository, ""); err != nil {
+		return fmt.Errorf("invalid repository pattern \"%s\" of runner group route: %s", r.Repository, err.Error())
+	}
+	r.patterns = []labelPattern{}
+	for _, label := range r.Labels {
+		if pattern, err := newLabelPattern(label); err != nil {
+			return fmt.Errorf("invalid label \"%s\" of runner group route: %s", label, err.Error())
+		} else {
+			r.patterns = append(r.patterns, pattern)
+		}
+	}
+	return nil
+}
+
+func (r *RunnerGroupRoute) Matches(src Source, job Job, profile string) bool {
+
+	if len(r.Source) > 0 && r.Source != src.Name {
+		return false
+	}
+	if len(r.Repository) > 0 {
+		if ok, _ := path.Match(strings.ToLower(r.Repository), strings.ToLower(job.repository())); !ok {
+			return false
+		}
+	}
+	if len(r.Profile) > 0 && r.Profile != profile {
+		return false
+	}
+	for _, pattern := range r.patterns {
+		found := false
+		for _, label := range job.Labels {
+			if pattern.match(label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the runner group id of the first matching route or the default runner group id. Repositories only have the
+// implicit runner group 1
+func RouteRunnerGroup(routes []RunnerGroupRoute, defaultGroupId int64, src Source, job Job, profile string) int64 {
+
+	if src.SourceType == TypeRepository {
+		return 1
+	}
+	for i := range routes {
+		if routes[i].Matches(src, job, profile) {
+			return routes[i].RunnerGroupId
+		}
+	}
+	return defaultGroupId
+}
+
+// the runner group a runner for the job has to join. The same routing applies when the VM of a completed job is deleted
+func (s *Autoscaler) runnerGroupId(src Source, job Job, profile string) int64 {
+
+	return RouteRunnerGroup(s.conf.RunnerGroupRoutes, s.conf.RunnerGroupId, src, job, profile)
+}
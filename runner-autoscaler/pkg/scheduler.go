@@ -0,0 +1,409 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the pending jobs are checked for free VM slots (in addition to every queued or completed job)
+const SCHEDULER_INTERVAL time.Duration = 10 * time.Second
+
+// Assigns a priority to workflow jobs. All conditions that are set have to match. Jobs with a higher priority are released first
+type PriorityRule struct {
+	Repository string   `json:"repository,omitempty"` // OWNER/REPO, may be a glob
+	Branch     string   `json:"branch,omitempty"`     // the head branch of the workflow run, may be a glob ("release/*")
+	Labels     []string `json:"labels,omitempty"`     // the job has to contain all labels (literals, globs or regular expressions like profile labels)
+	Priority   int64    `json:"priority"`
+	patterns   []labelPattern
+}
+
+// Validates the rule and compiles the label patterns. Has to be called before the rule is used
+func (r *PriorityRule) Compile() error {
+
+	if _, err := path.Match(r.Repository, ""); err != nil {
+		return fmt.Errorf("invalid repository pattern \"%s\" of priority rule: %s", r.Repository, err.Error())
+	}
+	if _, err := path.Match(r.Branch, ""); err != nil {
+		return fmt.Errorf("invalid branch pattern \"%s\" of priority rule: %s", r.Branch, err.Error())
+	}
+	r.patterns = []labelPattern{}
+	for _, label := range r.Labels {
+		if pattern, err := newLabelPattern(label); err != nil {
+			return fmt.Errorf("invalid label \"%s\" of priority rule: %s", label, err.Error())
+		} else {
+			r.patterns = append(r.patterns, pattern)
+		}
+	}
+	return nil
+}
+
+func (r *PriorityRule) Matches(job Job) bool {
+
+	if len(r.Repository) > 0 {
+		if ok, _ := path.Match(strings.ToLower(r.Repository), strings.ToLower(job.repository())); !ok {
+			return false
+		}
+	}
+	if len(r.Branch) > 0 {
+		if ok, _ := path.Match(r.Branch, job.HeadBranch); !ok {
+			return false
+		}
+	}
+	for _, pattern := range r.patterns {
+		found := false
+		for _, label := range job.Labels {
+			if pattern.match(label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the priority of the first matching rule or 0
+func JobPriority(rules []PriorityRule, job Job) int64 {
+
+	for i := range rules {
+		if rules[i].Matches(job) {
+			return rules[i].Priority
+		}
+	}
+	return 0
+}
+
+// A workflow job waiting for a free VM slot
+type PendingJob struct {
+	Source   string     `json:"source"`
+	Task     RunnerTask `json:"task"`
+	Host     string     `json:"-"` // the host the create-vm callback is sent to
+	Priority int64      `json:"priority"`
+	QueuedAt time.Time  `json:"queued_at"`
+	// the job is not released before (deferred until the next scaling window starts)
+	NotBefore time.Time `json:"not_before,omitempty"`
+}
+
+// The Scheduler holds the pending create requests and releases them as VM slots free up. The job with the highest priority is released
+// first. Among jobs of the same priority the source with the fewest active VMs (relative to its weight) wins, within the source the
+// repository with the fewest active VMs and finally the job that is pending the longest
+type Scheduler struct {
+	mu      sync.Mutex
+	pending map[int64]*PendingJob
+	weights map[string]float64
+	paused  map[string]bool
+}
+
+// Sources missing in weights have the weight 1
+func NewScheduler(weights map[string]float64) *Scheduler {
+
+	return &Scheduler{pending: map[int64]*PendingJob{}, weights: weights, paused: map[string]bool{}}
+}
+
+// The jobs of a paused source are held until the source is resumed
+func (q *Scheduler) Pause(source string) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused[source] = true
+}
+
+func (q *Scheduler) Resume(source string) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.paused, source)
+}
+
+func (q *Scheduler) IsPaused(source string) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused[source]
+}
+
+func (q *Scheduler) Paused() []string {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := []string{}
+	for source := range q.paused {
+		ret = append(ret, source)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (q *Scheduler) Push(job PendingJob) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.QueuedAt.IsZero() {
+		job.QueuedAt = time.Now()
+	}
+	q.pending[job.Task.Id] = &job
+}
+
+// Removes a pending job. Returns false if the job is not pending
+func (q *Scheduler) Remove(jobId int64) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[jobId]; ok {
+		delete(q.pending, jobId)
+		return true
+	}
+	return false
+}
+
+func (q *Scheduler) weight(source string) float64 {
+
+	if weight, ok := q.weights[source]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Pops the jobs that fit into the free VM slots. Active are the jobs that currently occupy a VM slot
+func (q *Scheduler) Next(active []JobRecord, maxConcurrency int) []PendingJob {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	perSource := map[string]int{}
+	perRepo := map[string]int{}
+	for _, record := range active {
+		perSource[record.Source]++
+		perRepo[record.Source+"/"+record.Job.repository()]++
+	}
+	ret := []PendingJob{}
+	now := time.Now()
+	for free := maxConcurrency - len(active); free > 0; free-- {
+		var next *PendingJob
+		for _, candidate := range q.pending {
+			if candidate.NotBefore.After(now) || q.paused[candidate.Source] {
+				continue
+			}
+			if next == nil || q.less(candidate, next, perSource, perRepo) {
+				next = candidate
+			}
+		}
+		if next == nil {
+			break
+		}
+		delete(q.pending, next.Task.Id)
+		perSource[next.Source]++
+		perRepo[next.Source+"/"+next.Task.repository()]++
+		ret = append(ret, *next)
+	}
+	return ret
+}
+
+// Pops the jobs that fit into the free VM slots (see Next) and passes them to release one by one. If release fails, the failed job and
+// all jobs that were not passed to release yet are pushed back, so they are released with the next attempt
+func (q *Scheduler) Release(active []JobRecord, maxConcurrency int, release func(job PendingJob) error) error {
+
+	jobs := q.Next(active, maxConcurrency)
+	for i, job := range jobs {
+		if err := release(job); err != nil {
+			for _, unreleased := range jobs[i:] {
+				q.Push(unreleased)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// true if a is released before b
+func (q *Scheduler) less(a *PendingJob, b *PendingJob, perSource map[string]int, perRepo map[string]int) bool {
+
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	shareA, shareB := float64(perSource[a.Source])/q.weight(a.Source), float64(perSource[b.Source])/q.weight(b.Source)
+	if shareA != shareB {
+		return shareA < shareB
+	}
+	repoA, repoB := perRepo[a.Source+"/"+a.Task.repository()], perRepo[b.Source+"/"+b.Task.repository()]
+	if repoA != repoB {
+		return repoA < repoB
+	}
+	if !a.QueuedAt.Equal(b.QueuedAt) {
+		return a.QueuedAt.Before(b.QueuedAt)
+	}
+	return a.Task.Id < b.Task.Id
+}
+
+// Returns a copy of the pending jobs ordered by the time they were queued
+func (q *Scheduler) Pending() []PendingJob {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := []PendingJob{}
+	for _, job := range q.pending {
+		ret = append(ret, *job)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].QueuedAt.Before(ret[j].QueuedAt) })
+	return ret
+}
+
+// the jobs that occupy a VM slot: the create-vm callback was enqueued or the VM picked the job. Jobs picked by other runners are never
+// queued by the autoscaler and don't have a VM
+func (s *Autoscaler) activeJobs() []JobRecord {
+
+	ret := []JobRecord{}
+	for _, record := range s.jobs.List(JobQueued, JobInProgress) {
+		if record.State == JobQueued || len(record.VmName) > 0 {
+			ret = append(ret, record)
+		}
+	}
+	return ret
+}
+
+// holds the job in the scheduler until a VM slot is free (and not before notBefore)
+func (s *Autoscaler) holdJob(ctx context.Context, host string, src Source, task RunnerTask, notBefore time.Time) {
+
+	priority := JobPriority(s.conf.PriorityRules, task.Job)
+	s.jobs.SetState(src.Name, task.Job, JobPending)
+	s.scheduler.Push(PendingJob{Source: src.Name, Task: task, Host: host, Priority: priority, NotBefore: notBefore})
+	event := newJobEvent(AuditJobPending, OutcomeSuccess, src, task.Job)
+	event.Profile = task.Profile
+	if !notBefore.IsZero() {
+		log.WithContext(ctx).Infof("Deferring workflow job Id %d with priority %d until %s (off-hours)", task.Id, priority, notBefore.Format(time.RFC3339))
+		event.Reason = "off-hours: deferred until " + notBefore.Format(time.RFC3339)
+	} else {
+		log.WithContext(ctx).Infof("Holding workflow job Id %d with priority %d until a VM slot is free", task.Id, priority)
+	}
+	s.audit(ctx, event)
+	s.wakeScheduler()
+}
+
+// enqueues the create-vm callbacks of the pending jobs that fit into the free VM slots
+func (s *Autoscaler) releaseJobs(ctx context.Context) {
+
+	// only one release at a time, otherwise the active jobs are counted twice
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	if s.IsDraining() {
+		return
+	}
+	maxConcurrency := int(s.maxConcurrency())
+	if maxConcurrency <= 0 {
+		maxConcurrency = math.MaxInt
+	}
+	s.scheduler.Release(s.activeJobs(), maxConcurrency, func(pending PendingJob) error {
+		src, ok := s.conf.RegisteredSources[pending.Source]
+		if !ok {
+			log.WithContext(ctx).Warnf("Dropping pending workflow job Id %d of unknown source %s", pending.Task.Id, pending.Source)
+			s.jobs.Forget(pending.Task.Id)
+			return nil
+		}
+		// the window the job is released into may not allow its runner profile (e.g. a job deferred into a spot-only window)
+		if profile, _ := s.resolveProfile(pending.Task); profile != nil && !s.windowAllows(ctx, src, pending.Task, profile) {
+			return nil
+		}
+		host := pending.Host
+		if len(host) == 0 {
+			host = s.getCallbackHost()
+		}
+		// the create vm delay already passed while the job was pending
+		delay := time.Duration(s.conf.CreateVmDelay)*time.Second - time.Since(pending.QueuedAt)
+		if delay < 0 {
+			delay = 0
+		}
+		s.jobs.SetState(src.Name, pending.Task.Job, JobQueued)
+		if err := s.enqueueCreateVm(ctx, host, src, pending.Task, delay); err != nil {
+			// keep the job pending, it is released again with the next attempt (the scheduler pushes it back)
+			s.jobs.SetState(src.Name, pending.Task.Job, JobPending)
+			return err
+		}
+		log.WithContext(ctx).Infof("Released workflow job Id %d after %s", pending.Task.Id, time.Since(pending.QueuedAt).Round(time.Second))
+		return nil
+	})
+}
+
+// wakes the scheduler loop up, e.g. because a VM slot was freed
+func (s *Autoscaler) wakeScheduler() {
+
+	select {
+	case s.schedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// Releases pending jobs whenever a job is queued or completed and every SCHEDULER_INTERVAL (VM slots are also freed by failed jobs,
+// deferred jobs are due and the max. concurrency changes with the scaling windows)
+func (s *Autoscaler) schedule(ctx context.Context) {
+
+	log.WithContext(ctx).Infof("Scheduling workflow jobs with a max. concurrency of %d VMs (0: unlimited)", s.maxConcurrency())
+	ticker := time.NewTicker(SCHEDULER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.schedulerWake:
+		}
+		s.releaseJobs(ctx)
+	}
+}
+
+type SourceQueue struct {
+	Pending int     `json:"pending"`
+	Active  int     `json:"active"`
+	Weight  float64 `json:"weight"`
+}
+
+type QueueStatus struct {
+	Window         string                 `json:"window,omitempty"` // the active scaling window
+	MaxConcurrency int64                  `json:"max_concurrency"`
+	Active         int                    `json:"active"`
+	Pending        int                    `json:"pending"`
+	Sources        map[string]SourceQueue `json:"sources"`
+	Jobs           []PendingJob           `json:"jobs,omitempty"`
+}
+
+func (s *Autoscaler) queueStatus(withJobs bool) QueueStatus {
+
+	status := QueueStatus{Window: s.activeWindow().Name, MaxConcurrency: s.maxConcurrency(), Sources: map[string]SourceQueue{}}
+	for name := range s.conf.RegisteredSources {
+		status.Sources[name] = SourceQueue{Weight: s.scheduler.weight(name)}
+	}
+	pending := s.scheduler.Pending()
+	for _, job := range pending {
+		queue := status.Sources[job.Source]
+		queue.Pending++
+		status.Sources[job.Source] = queue
+	}
+	active := s.activeJobs()
+	for _, record := range active {
+		queue := status.Sources[record.Source]
+		queue.Active++
+		status.Sources[record.Source] = queue
+	}
+	status.Active = len(active)
+	status.Pending = len(pending)
+	if withJobs {
+		status.Jobs = pending
+	}
+	return status
+}
+
+// GET /queue?jobs=1
+func (s *Autoscaler) handleGetQueue(ctx *gin.Context) {
+
+	ctx.JSON(http.StatusOK, s.queueStatus(ctx.Query("jobs") == "1"))
+}
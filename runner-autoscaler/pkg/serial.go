@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const COMMIT_COMMENT_ENDPOINT string = "https://api.github.com/repos/%s/commits/%s/comments"
+
+var matchJobRepository = regexp.MustCompile(`/repos/([^/]+/[^/]+)/actions/jobs/`)
+
+// Persists the serial console output of a failed runner VM. Returns a link to the stored output
+type SerialOutputSink interface {
+	Store(ctx context.Context, jobId int64, vmName string, output string) (string, error)
+}
+
+// Creates a sink from a SERIAL_OUTPUT_SINK value: "" (job record only), "file:///some/dir" or "gs://bucket/prefix". The gcs sink
+// uses the shared storage client returned by storageClient
+func NewSerialOutputSink(sink string, storageClient func() *storage.Client) (SerialOutputSink, error) {
+
+	if len(sink) == 0 {
+		return nil, nil
+	} else if dir, ok := strings.CutPrefix(sink, "file://"); ok {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		return &fileSink{dir: dir}, nil
+	} else if path, ok := strings.CutPrefix(sink, "gs://"); ok {
+		bucket, prefix, _ := strings.Cut(path, "/")
+		return &gcsSink{bucket: bucket, prefix: prefix, client: storageClient}, nil
+	}
+	return nil, fmt.Errorf("unsupported serial output sink: %s", sink)
+}
+
+type fileSink struct {
+	dir string
+}
+
+func (f *fileSink) Store(ctx context.Context, jobId int64, vmName string, output string) (string, error) {
+
+	file := filepath.Join(f.dir, fmt.Sprintf("%d-%s.log", jobId, vmName))
+	if err := os.WriteFile(file, []byte(output), 0640); err != nil {
+		return "", err
+	}
+	return "file://" + file, nil
+}
+
+type gcsSink struct {
+	bucket string
+	prefix string
+	client func() *storage.Client
+}
+
+func (g *gcsSink) Store(ctx context.Context, jobId int64, vmName string, output string) (string, error) {
+
+	client := g.client()
+	object := strings.TrimPrefix(fmt.Sprintf("%s/%d-%s.log", strings.TrimSuffix(g.prefix, "/"), jobId, vmName), "/")
+	writer := client.Bucket(g.bucket).Object(object).NewWriter(ctx)
+	writer.ContentType = "text/plain"
+	if _, err := writer.Write([]byte(output)); err != nil {
+		writer.Close()
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://storage.cloud.google.com/%s/%s", g.bucket, object), nil
+}
+
+// Captures the serial console output of a failed or stuck runner VM before it is deleted. The tail is kept in the job record,
+// persisted to the configured sink and (if enabled) added as a comment to the commit the workflow run was triggered for
+func (s *Autoscaler) captureSerialOutput(ctx context.Context, src Source, job Job, vmName string, reason string) {
+
+	output := s.backend.RunnerOutput(ctx, vmName)
+	if len(output) == 0 {
+		return
+	}
+	log.WithContext(ctx).WithField("job_id", job.Id).WithField("vm_name", vmName).Warnf("Serial console output of VM %s (%s):\n%s", vmName, reason, output)
+
+	link := fmt.Sprintf("/jobs/%d/serial_output", job.Id)
+	if s.serialSink != nil {
+		if sinkLink, err := s.serialSink.Store(ctx, job.Id, vmName, output); err != nil {
+			log.WithContext(ctx).Errorf("Could not store serial console output of VM %s: %s", vmName, err.Error())
+		} else {
+			link = sinkLink
+		}
+	}
+	s.jobs.SetSerialOutput(src.Name, job, output, link)
+
+	if s.conf.SerialOutputComment {
+		s.commentSerialOutput(ctx, job, vmName, reason, output)
+	}
+}
+
+// GitHub workflow runs can't be commented - the comment is added to the commit the workflow run was triggered for
+func (s *Autoscaler) commentSerialOutput(ctx context.Context, job Job, vmName string, reason string, output string) {
+
+	repo := job.repository()
+	if len(repo) == 0 || len(job.HeadSha) == 0 {
+		log.WithContext(ctx).Warnf("Can not comment serial console output of VM %s - repository or commit of workflow job Id %d unknown", vmName, job.Id)
+		return
+	}
+	body := fmt.Sprintf("The self-hosted runner VM `%s` for workflow job [%s](%s) %s.\n\n<details><summary>Serial console output (tail)</summary>\n\n```\n%s\n```\n</details>", vmName, job.Name, job.HtmlUrl, reason, strings.ReplaceAll(output, "```", "'''"))
+	if err := s.github.Do(ctx, http.MethodPost, fmt.Sprintf(COMMIT_COMMENT_ENDPOINT, repo, job.HeadSha), map[string]any{"body": body}, nil, http.StatusCreated); err != nil {
+		log.WithContext(ctx).Errorf("Could not comment serial console output of VM %s: %s", vmName, err.Error())
+	}
+}
+
+// requires the "Authorization: Bearer <API_TOKEN>" header
+func (s *Autoscaler) requireApiToken(ctx *gin.Context) {
+
+	token, _ := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if len(s.conf.ApiToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.ApiToken)) != 1 {
+		log.WithContext(ctx.Request.Context()).Warnf("%s did not provide a valid api token", ctx.RemoteIP())
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+func (s *Autoscaler) handleGetJob(ctx *gin.Context) {
+
+	if id, err := strconv.ParseInt(ctx.Param("id"), 10, 64); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else if record, ok := s.jobs.Get(id); !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+	} else {
+		ctx.JSON(http.StatusOK, record)
+	}
+}
+
+func (s *Autoscaler) handleGetSerialOutput(ctx *gin.Context) {
+
+	if id, err := strconv.ParseInt(ctx.Param("id"), 10, 64); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+	} else if record, ok := s.jobs.Get(id); !ok || len(record.SerialOutput) == 0 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+	} else {
+		ctx.String(http.StatusOK, record.SerialOutput)
+	}
+}
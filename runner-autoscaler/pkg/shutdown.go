@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// the in-flight requests have this much time to hand back their callbacks after the shutdown deadline was exceeded
+const SHUTDOWN_HANDBACK_TIMEOUT time.Duration = 2 * time.Second
+
+// Cloud Tasks retries callbacks that were answered with 503 after this many seconds
+const SHUTDOWN_RETRY_AFTER int64 = 10
+
+// Gracefully shuts the server down (like SIGTERM) - Srv returns once the shutdown completed
+func (s *Autoscaler) Shutdown() {
+
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// true once the shutdown started - the callbacks are answered with 503 so Cloud Tasks retries them
+func (s *Autoscaler) IsShuttingDown() bool {
+
+	return s.shuttingDown.Load()
+}
+
+// Stops accepting new callbacks and waits for the in-flight requests until the shutdown deadline (SHUTDOWN_TIMEOUT). Requests that are
+// still running after the deadline are canceled and hand back their callbacks (see abortWithError). Finally the jobs held by the
+// scheduler are handed back
+func (s *Autoscaler) shutdown(server *http.Server) {
+
+	timeout := time.Duration(s.conf.ShutdownTimeout) * time.Second
+	log.Infof("Shutting down - waiting up to %s for in-flight requests", timeout.String())
+	s.shuttingDown.Store(true)
+	deadline := time.AfterFunc(timeout, func() {
+		log.Warnf("Shutdown deadline of %s exceeded - handing back the in-flight callbacks", timeout.String())
+		s.cancelRequests()
+	})
+	defer deadline.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+SHUTDOWN_HANDBACK_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Could not shut down gracefully: %s", err.Error())
+	} else {
+		log.Info("Shut down gracefully")
+	}
+	s.cancelRequests()
+	s.handBackPendingJobs(ctx)
+	s.flushAudit()
+	if err := s.Close(); err != nil {
+		log.Warnf("Could not close the GCP clients: %s", err.Error())
+	}
+}
+
+// enqueues the create-vm callbacks of the jobs held by the scheduler (draining, a paused source, MAX_CONCURRENCY or SCALING_SCHEDULE),
+// so another instance picks them up. The create-vm callback holds them again if that instance holds the jobs too
+func (s *Autoscaler) handBackPendingJobs(ctx context.Context) {
+
+	// waits for a release that is still running
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	for _, pending := range s.scheduler.Pending() {
+		src, ok := s.conf.RegisteredSources[pending.Source]
+		if !ok {
+			continue
+		}
+		host := pending.Host
+		if len(host) == 0 {
+			host = s.getCallbackHost()
+		}
+		// the create vm delay already passed while the job was pending
+		delay := time.Duration(s.conf.CreateVmDelay)*time.Second - time.Since(pending.QueuedAt)
+		if delay < 0 {
+			delay = 0
+		}
+		task := pending.Task
+		task.HandedBack = true
+		if err := s.enqueueCreateVm(ctx, host, src, task, delay); err != nil {
+			log.WithContext(ctx).Errorf("Could not hand back pending workflow job Id %d - it is lost: %s", task.Id, err.Error())
+			continue
+		}
+		log.WithContext(ctx).Infof("Handed back pending workflow job Id %d", task.Id)
+		s.scheduler.Remove(task.Id)
+	}
+}
+
+// waits up to AUDIT_FLUSH_TIMEOUT for the audit sink to deliver the events of the handled requests
+func (s *Autoscaler) flushAudit() {
+
+	if s.auditSink == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AUDIT_FLUSH_TIMEOUT)
+	defer cancel()
+	if err := s.auditSink.Flush(ctx); err != nil {
+		log.Errorf("Could not flush the audit events: %s", err.Error())
+	}
+}
+
+// answers the cloud task callbacks with 503 once the shutdown started, so Cloud Tasks retries them (on another instance)
+func (s *Autoscaler) rejectWhileShuttingDown(ctx *gin.Context) {
+
+	if s.IsShuttingDown() {
+		log.WithContext(ctx.Request.Context()).Warnf("Shutting down - handing back %s", ctx.Request.URL.Path)
+		ctx.Header("Retry-After", fmt.Sprintf("%d", SHUTDOWN_RETRY_AFTER))
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+	}
+}
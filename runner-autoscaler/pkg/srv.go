@@ -1,32 +1,39 @@
 package pkg
 
 import (
-	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/gin-gonic/gin"
 	"github.com/googleapis/gax-go/v2/apierror"
 	log "github.com/sirupsen/logrus"
 	ginlogrus "github.com/toorop/gin-logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -46,7 +53,16 @@ const RUNNER_JIT_CONFIG_ATTR string = "jit_config"
 const RUNNER_SCRIPT_REGISTER_RUNNER_ATTR string = "startup_script_register_runner"         // has to match the global custom metadata in compute.tf
 const RUNNER_SCRIPT_REGISTER_JIT_RUNNER_ATTR string = "startup_script_register_jit_runner" // has to match the global custom metadata in compute.tf
 
+const RUNNER_REGISTER_TOKEN_ENTERPRISE_ENDPOINT string = "https://api.github.com/enterprises/%s/actions/runners/registration-token"
 const RUNNER_REGISTER_TOKEN_ORG_ENDPOINT string = "https://api.github.com/orgs/%s/actions/runners/registration-token"
+const RUNNER_REGISTER_TOKEN_REPO_ENDPOINT string = "https://api.github.com/repos/%s/actions/runners/registration-token" // format USER/REPO
+
+const RUNNER_ENTERPRISE_GROUP_ENDPOINT string = "https://api.github.com/enterprises/%s/actions/runner-groups/%d"
+const RUNNER_ORG_GROUP_ENDPOINT string = "https://api.github.com/orgs/%s/actions/runner-groups/%d"
+
+const RUNNER_ENTERPRISE_URL string = "https://github.com/enterprises/%s"
+const RUNNER_ORG_URL string = "https://github.com/%s"
+const RUNNER_REPO_URL string = "https://github.com/%s" // format USER/REPO
 
 const RUNNER_ENTERPRISE_JIT_CONFIG_ENDPOINT string = "https://api.github.com/enterprises/%s/actions/runners/generate-jitconfig"
 const RUNNER_ORG_JIT_CONFIG_ENDPOINT string = "https://api.github.com/orgs/%s/actions/runners/generate-jitconfig"
@@ -60,30 +76,153 @@ const (
 	TypeRepository   SourceType = "repository"
 )
 
+type RegistrationMode string
+
+const (
+	RegistrationJit   RegistrationMode = "jit"   // the runner is registered with a jit-config (default)
+	RegistrationToken RegistrationMode = "token" // the runner registers itself with a registration token by running config.sh
+)
+
+// Optional settings of a source (see SOURCE_SETTINGS)
+type SourceSettings struct {
+	RegistrationMode RegistrationMode  `json:"registration_mode,omitempty"`
+	ConfigFlags      string            `json:"config_flags,omitempty"` // additional config.sh flags - only used in registration mode "token"
+	DisablePolling   bool              `json:"disable_polling,omitempty"`
+	SecurityPolicy   *SecurityPolicy   `json:"security_policy,omitempty"` // overrides SECURITY_POLICY
+	Repositories     *RepositoryFilter `json:"repositories,omitempty"`    // includes or excludes repositories of organization and enterprise sources
+	Weight           float64           `json:"weight,omitempty"`          // the fair share of the source if MAX_CONCURRENCY is set (defaults to 1)
+}
+
 type Source struct {
 	Name       string     `json:"name"`
 	SourceType SourceType `json:"type"`
 	Secret     string     `json:"secret"`
+	SourceSettings
+}
+
+func (src Source) jitConfigEndpoint() string {
+
+	switch src.SourceType {
+	case TypeEnterprise:
+		return fmt.Sprintf(RUNNER_ENTERPRISE_JIT_CONFIG_ENDPOINT, src.Name)
+	case TypeOrganization:
+		return fmt.Sprintf(RUNNER_ORG_JIT_CONFIG_ENDPOINT, src.Name)
+	default:
+		return fmt.Sprintf(RUNNER_REPO_JIT_CONFIG_ENDPOINT, src.Name)
+	}
+}
+
+// the endpoint that issues registration tokens for runners of the source (registration mode "token")
+func (src Source) RegistrationTokenEndpoint() string {
+
+	switch src.SourceType {
+	case TypeEnterprise:
+		return fmt.Sprintf(RUNNER_REGISTER_TOKEN_ENTERPRISE_ENDPOINT, src.Name)
+	case TypeOrganization:
+		return fmt.Sprintf(RUNNER_REGISTER_TOKEN_ORG_ENDPOINT, src.Name)
+	default:
+		return fmt.Sprintf(RUNNER_REGISTER_TOKEN_REPO_ENDPOINT, src.Name)
+	}
+}
+
+// the url that has to be passed to config.sh
+func (src Source) runnerUrl() string {
+
+	switch src.SourceType {
+	case TypeEnterprise:
+		return fmt.Sprintf(RUNNER_ENTERPRISE_URL, src.Name)
+	case TypeOrganization:
+		return fmt.Sprintf(RUNNER_ORG_URL, src.Name)
+	default:
+		return fmt.Sprintf(RUNNER_REPO_URL, src.Name)
+	}
 }
 
 type Job struct {
-	Id              int64    `json:"id"`
-	Name            string   `json:"name"`
-	Status          string   `json:"status"`
-	Labels          []string `json:"labels"`
-	RunnerName      string   `json:"runner_name"`
-	RunnerGroupName string   `json:"runner_group_name"`
-	RunnerGroupId   int64    `json:"runner_group_id"`
+	Id              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Status          string     `json:"status"`
+	Labels          []string   `json:"labels"`
+	RunnerName      string     `json:"runner_name"`
+	RunnerGroupName string     `json:"runner_group_name"`
+	RunnerGroupId   int64      `json:"runner_group_id"`
+	Url             string     `json:"url,omitempty"` // the GitHub api url of the job
+	HtmlUrl         string     `json:"html_url,omitempty"`
+	HeadSha         string     `json:"head_sha,omitempty"`
+	HeadBranch      string     `json:"head_branch,omitempty"`
+	RunId           int64      `json:"run_id,omitempty"`
+	RunAttempt      int64      `json:"run_attempt,omitempty"`
+	WorkflowName    string     `json:"workflow_name,omitempty"`
+	Conclusion      string     `json:"conclusion,omitempty"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	// not part of the GitHub workflow job object - copied from the webhook payload (see Payload.WorkflowJob) or the workflow run
+	Repository   *Repository   `json:"repository,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Sender       *User         `json:"sender,omitempty"`
+}
+
+type Repository struct {
+	Id         int64    `json:"id"`
+	Name       string   `json:"name"`
+	FullName   string   `json:"full_name"`
+	Owner      User     `json:"owner"`
+	Private    bool     `json:"private"`
+	Visibility string   `json:"visibility,omitempty"` // public, private or internal
+	Fork       bool     `json:"fork"`
+	Archived   bool     `json:"archived"`
+	Topics     []string `json:"topics,omitempty"`
+}
+
+type Organization struct {
+	Id    int64  `json:"id"`
+	Login string `json:"login"`
+}
+
+type User struct {
+	Id    int64  `json:"id"`
+	Login string `json:"login"`
+	Type  string `json:"type,omitempty"` // User, Bot or Organization
 }
 
 type Payload struct {
-	Action Action `json:"action"`
-	Job    Job    `json:"workflow_job"`
+	Action       Action        `json:"action"`
+	Job          Job           `json:"workflow_job"`
+	Repository   *Repository   `json:"repository,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Sender       *User         `json:"sender,omitempty"`
+}
+
+// the workflow job including the repository, organization and sender of the webhook event
+func (p Payload) WorkflowJob() Job {
+
+	job := p.Job
+	job.Repository = p.Repository
+	job.Organization = p.Organization
+	job.Sender = p.Sender
+	return job
 }
 
 type VmSettings struct {
-	Name        string  `json:"name"`
-	MachineType *string `json:"machineType,omitempty"`
+	Name             string             `json:"name"`
+	MachineType      *string            `json:"machineType,omitempty"`
+	InstanceTemplate string             `json:"instanceTemplate,omitempty"`
+	Labels           map[string]string  `json:"labels,omitempty"` // GCE labels
+	Metadata         []*computepb.Items `json:"-"`                // additional guest metadata
+	Cpus             float64            `json:"-"`                // container backends only
+	MemoryMb         int64              `json:"-"`                // container backends only
+}
+
+// the repository (OWNER/REPO) of the job. Derived from the api url if the repository is unknown. Empty if unknown
+func (j Job) repository() string {
+
+	if j.Repository != nil && len(j.Repository.FullName) > 0 {
+		return j.Repository.FullName
+	} else if matches := matchJobRepository.FindStringSubmatch(j.Url); len(matches) == 2 {
+		return matches[1]
+	}
+	return ""
 }
 
 func (j Job) hasLabel(label string) bool {
@@ -166,7 +305,6 @@ const (
 	Unknown   State = "unknown"
 )
 
-/*
 func (s State) isStopped() bool {
 
 	return s == STOPPING || s == SUSPENDING || s == SUSPENDED || s == TERMINATED
@@ -175,42 +313,15 @@ func (s State) isStopped() bool {
 func (s State) isRunning() bool {
 
 	return s == PROVISIONING || s == STAGING || s == RUNNING || s == REPAIRING
-}*/
+}
 
 type InstanceClient struct {
 	*compute.InstancesClient
 }
 
-func createCallbackUrl(ctx *gin.Context, path string, srcQueryName string, srcQueryValue string) string {
+func createCallbackUrl(host string, path string, srcQueryName string, srcQueryValue string) string {
 
-	return "https://" + ctx.Request.Host + path + "?" + srcQueryName + "=" + url.QueryEscape(srcQueryValue)
-}
-
-func newComputeClient(ctx context.Context) *InstanceClient {
-
-	if client, err := compute.NewInstancesRESTClient(ctx); err != nil {
-		panic(err)
-	} else {
-		return &InstanceClient{client}
-	}
-}
-
-func newTaskClient(ctx context.Context) *cloudtasks.Client {
-
-	if client, err := cloudtasks.NewClient(ctx); err != nil {
-		panic(err)
-	} else {
-		return client
-	}
-}
-
-func newSecretAccessClient(ctx context.Context) *secretmanager.Client {
-
-	if client, err := secretmanager.NewClient(ctx); err != nil {
-		panic(err)
-	} else {
-		return client
-	}
+	return "https://" + host + path + "?" + srcQueryName + "=" + url.QueryEscape(srcQueryValue)
 }
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz")
@@ -245,7 +356,7 @@ func (s *Autoscaler) verifySignature(ctx *gin.Context) ([]byte, Source, error) {
 
 	if signature := ctx.GetHeader(SHA_HEADER); len(signature) == 71 {
 		if body, err := io.ReadAll(ctx.Request.Body); err != nil {
-			log.Errorf("Error receiving http body: %s", err.Error())
+			log.WithContext(ctx.Request.Context()).Errorf("Error receiving http body: %s", err.Error())
 			return nil, Source{}, ctx.AbortWithError(http.StatusBadRequest, err)
 		} else {
 			if src, ok := ctx.GetQuery(s.conf.SourceQueryParam); ok {
@@ -253,69 +364,73 @@ func (s *Autoscaler) verifySignature(ctx *gin.Context) ([]byte, Source, error) {
 					if calcSignature := CalcSigHex([]byte(source.Secret), body); calcSignature == signature[7:] {
 						return body, source, nil
 					} else {
-						log.Warnf("%s signature did not match", ctx.RemoteIP())
+						log.WithContext(ctx.Request.Context()).Warnf("%s signature did not match", ctx.RemoteIP())
 						return nil, Source{}, ctx.AbortWithError(http.StatusUnauthorized, fmt.Errorf("unauthorized"))
 					}
 				} else {
-					log.Infof("Source with name '%s' not registered - ignoring", src)
+					log.WithContext(ctx.Request.Context()).Infof("Source with name '%s' not registered - ignoring", src)
 					ctx.Status(http.StatusOK) // not considered an error
 					return nil, Source{}, fmt.Errorf("unknown webhook source")
 				}
 			} else {
-				log.Errorf("Missing %s query parameter", s.conf.SourceQueryParam)
+				log.WithContext(ctx.Request.Context()).Errorf("Missing %s query parameter", s.conf.SourceQueryParam)
 				return nil, Source{}, ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("missing %s query parameter", s.conf.SourceQueryParam))
 			}
 		}
 	} else {
-		log.Warnf("%s did not provide a signature", ctx.RemoteIP())
+		log.WithContext(ctx.Request.Context()).Warnf("%s did not provide a signature", ctx.RemoteIP())
 		return nil, Source{}, ctx.AbortWithError(http.StatusUnauthorized, fmt.Errorf("unauthorized"))
 	}
 }
 
-/*
 func (s *Autoscaler) GetInstanceState(ctx context.Context, instanceName string) (State, error) {
 
-	client := newComputeClient(ctx)
-	defer client.Close()
+	zone := s.backend.Zone(ctx, instanceName)
+	if len(zone) == 0 {
+		log.WithContext(ctx).Errorf("Could not get status for instance: %s - the zone is unknown", instanceName)
+		return Unknown, fmt.Errorf("zone of instance %s is unknown", instanceName)
+	}
+	client := s.computeClient()
 	if res, err := client.Get(ctx, &computepb.GetInstanceRequest{
 		Project:  s.conf.ProjectId,
-		Zone:     s.conf.Zone,
+		Zone:     zone,
 		Instance: instanceName,
 	}); err != nil {
-		log.Errorf("Could not get status for instance: %s - %s", instanceName, err.Error())
+		log.WithContext(ctx).Errorf("Could not get status for instance: %s - %s", instanceName, err.Error())
 		return Unknown, err
 	} else if res.Status == nil {
-		log.Errorf("Could not read status for instance: %s", instanceName)
+		log.WithContext(ctx).Errorf("Could not read status for instance: %s", instanceName)
 		return Unknown, fmt.Errorf("instance status is unknown")
 	} else {
 		return (State)(*res.Status), nil
 	}
 }
 
+/*
+
 // blocking until instance started or failed to start
 func (s *Autoscaler) StartInstance(ctx context.Context, instanceName string) error {
 
 	if s.conf.Simulate {
-		log.Infof("(SIMULATE) About to start instance: %s", instanceName)
+		log.WithContext(ctx).Infof("(SIMULATE) About to start instance: %s", instanceName)
 		time.Sleep(1 * time.Minute)
-		log.Infof("(SIMULATE) Started instance: %s", instanceName)
+		log.WithContext(ctx).Infof("(SIMULATE) Started instance: %s", instanceName)
 	} else {
-		log.Infof("About to start instance: %s", instanceName)
-		client := newComputeClient(ctx)
-		defer client.Close()
+		log.WithContext(ctx).Infof("About to start instance: %s", instanceName)
+		client := s.computeClient()
 		if res, err := client.Start(ctx, &computepb.StartInstanceRequest{
 			Project:  s.conf.ProjectId,
 			Zone:     s.conf.Zone,
 			Instance: instanceName,
 		}); err != nil {
-			log.Errorf("Could not start instance: %s - %s", instanceName, err.Error())
+			log.WithContext(ctx).Errorf("Could not start instance: %s - %s", instanceName, err.Error())
 			return err
 		} else {
 			if err := res.Wait(ctx); err != nil {
-				log.Errorf("Failed to wait for instance to start: %s", err.Error())
+				log.WithContext(ctx).Errorf("Failed to wait for instance to start: %s", err.Error())
 				return err
 			} else {
-				log.Infof("Started instance: %s", instanceName)
+				log.WithContext(ctx).Infof("Started instance: %s", instanceName)
 			}
 		}
 	}
@@ -325,22 +440,21 @@ func (s *Autoscaler) StartInstance(ctx context.Context, instanceName string) err
 // blocking until instance stopped or failed to stop
 func (s *Autoscaler) StopInstance(ctx context.Context, instanceName string) error {
 
-	log.Debugf("About to stop instance: %s", instanceName)
-	client := newComputeClient(ctx)
-	defer client.Close()
+	log.WithContext(ctx).Debugf("About to stop instance: %s", instanceName)
+	client := s.computeClient()
 	if res, err := client.Stop(ctx, &computepb.StopInstanceRequest{
 		Project:  s.conf.ProjectId,
 		Zone:     s.conf.Zone,
 		Instance: instanceName,
 	}); err != nil {
-		log.Errorf("Could not stop instance: %s - %s", instanceName, err.Error())
+		log.WithContext(ctx).Errorf("Could not stop instance: %s - %s", instanceName, err.Error())
 		return err
 	} else {
 		if err := res.Wait(ctx); err != nil {
-			log.Errorf("Failed to wait for instance to stop: %s", err.Error())
+			log.WithContext(ctx).Errorf("Failed to wait for instance to stop: %s", err.Error())
 			return err
 		} else {
-			log.Infof("Stopped instance: %s", instanceName)
+			log.WithContext(ctx).Infof("Stopped instance: %s", instanceName)
 		}
 	}
 	return nil
@@ -348,19 +462,22 @@ func (s *Autoscaler) StopInstance(ctx context.Context, instanceName string) erro
 */
 
 // blocking until the instance is deleted or the deletion fails
-func (s *Autoscaler) DeleteInstance(ctx context.Context, instanceName string) error {
+func (s *Autoscaler) DeleteInstance(ctx context.Context, instanceName string) (err error) {
+
+	ctx, span := startSpan(ctx, "compute.DeleteInstance", ATTR_VM_NAME.String(instanceName))
+	defer func() { endSpan(span, err) }()
 
 	if s.conf.Simulate {
-		log.Debugf("(SIMULATE) About to delete instance %s", instanceName)
+		log.WithContext(ctx).Debugf("(SIMULATE) About to delete instance %s", instanceName)
 		time.Sleep(30 * time.Second)
-		log.Infof("(SIMULATE) Deleted instance %s", instanceName)
+		log.WithContext(ctx).Infof("(SIMULATE) Deleted instance %s", instanceName)
 	} else {
 
 		zone := s.PickRandomZone(instanceName)
+		span.SetAttributes(ATTR_ZONE.String(zone))
 
-		log.Debugf("About to delete instance %s (%s)", instanceName, zone)
-		client := newComputeClient(ctx)
-		defer client.Close()
+		log.WithContext(ctx).Debugf("About to delete instance %s (%s)", instanceName, zone)
+		client := s.computeClient()
 		if res, err := client.Delete(ctx, &computepb.DeleteInstanceRequest{
 			Project:  s.conf.ProjectId,
 			Zone:     zone,
@@ -368,17 +485,17 @@ func (s *Autoscaler) DeleteInstance(ctx context.Context, instanceName string) er
 		}); err != nil {
 			if apiErr, ok := err.(*apierror.APIError); ok && apiErr.HTTPCode() == 404 {
 				// We ignore this error because the instance may no longer exist, as it may have been terminated prematurely
-				log.Infof("Instance %s (%s) already gone", instanceName, zone)
+				log.WithContext(ctx).Infof("Instance %s (%s) already gone", instanceName, zone)
 			} else {
-				log.Errorf("Could not delete instance %s (%s): %s", instanceName, zone, err.Error())
+				log.WithContext(ctx).Errorf("Could not delete instance %s (%s): %s", instanceName, zone, err.Error())
 				return err
 			}
 		} else {
 			if err := res.Wait(ctx); err != nil {
-				log.Errorf("Failed to wait for instance %s (%s) to be deleted: %s", instanceName, zone, err.Error())
+				log.WithContext(ctx).Errorf("Failed to wait for instance %s (%s) to be deleted: %s", instanceName, zone, err.Error())
 				return err
 			} else {
-				log.Infof("Deleted instance %s (%s)", instanceName, zone)
+				log.WithContext(ctx).Infof("Deleted instance %s (%s)", instanceName, zone)
 			}
 		}
 	}
@@ -386,64 +503,80 @@ func (s *Autoscaler) DeleteInstance(ctx context.Context, instanceName string) er
 }
 
 // blocking until instance started or failed to start
-func (s *Autoscaler) CreateInstanceFromTemplate(ctx context.Context, instanceName string, machineType *string, metadata ...*computepb.Items) error {
+func (s *Autoscaler) CreateInstanceFromTemplate(ctx context.Context, settings VmSettings, metadata ...*computepb.Items) (err error) {
+
+	instanceName := settings.Name
+	ctx, span := startSpan(ctx, "compute.CreateInstance", ATTR_VM_NAME.String(instanceName))
+	defer func() { endSpan(span, err) }()
 
 	if s.conf.Simulate {
-		log.Debugf("(SIMULATE) About to create instance %s from template", instanceName)
+		log.WithContext(ctx).Debugf("(SIMULATE) About to create instance %s from template", instanceName)
 		time.Sleep(1 * time.Minute)
-		log.Infof("(SIMULATE) Created instance from template: %s", instanceName)
+		log.WithContext(ctx).Infof("(SIMULATE) Created instance from template: %s", instanceName)
+	} else if res, err := s.insertInstance(ctx, settings, metadata); err != nil {
+		return err
+	} else if err := res.Wait(ctx); err != nil {
+		log.WithContext(ctx).Errorf("Failed to wait for instance %s (%s) to be created from template: %s", instanceName, s.PickRandomZone(instanceName), err.Error())
+		return err
 	} else {
+		log.WithContext(ctx).Infof("Created instance %s (%s) from template", instanceName, s.PickRandomZone(instanceName))
+	}
+	return nil
+}
 
-		zone := s.PickRandomZone(instanceName)
+// starts the insert operation of the instance in the zone picked by its name
+func (s *Autoscaler) insertInstance(ctx context.Context, settings VmSettings, metadata []*computepb.Items) (*compute.Operation, error) {
 
-		log.Debugf("About to create instance %s (%s) from template", instanceName, zone)
-		computeClient := newComputeClient(ctx)
-		defer computeClient.Close()
+	instanceName := settings.Name
+	instanceTemplate := settings.InstanceTemplate
+	if len(instanceTemplate) == 0 {
+		instanceTemplate = s.conf.InstanceTemplate
+	}
+	zone := s.PickRandomZone(instanceName)
+	trace.SpanFromContext(ctx).SetAttributes(ATTR_ZONE.String(zone))
 
-		var machine *string = nil
-		if machineType != nil {
-			machine = proto.String(fmt.Sprintf("zones/%s/machineTypes/%s", zone, *machineType))
-		}
+	log.WithContext(ctx).Debugf("About to create instance %s (%s) from template", instanceName, zone)
+	computeClient := s.computeClient()
 
-		if res, err := computeClient.Insert(ctx, &computepb.InsertInstanceRequest{
-			Project: s.conf.ProjectId,
-			Zone:    zone,
-			InstanceResource: &computepb.Instance{
-				Name:        proto.String(instanceName),
-				MachineType: machine,
-				Metadata: &computepb.Metadata{
-					Items: metadata,
-				},
+	var machine *string = nil
+	if settings.MachineType != nil {
+		machine = proto.String(fmt.Sprintf("zones/%s/machineTypes/%s", zone, *settings.MachineType))
+	}
+
+	res, err := computeClient.Insert(ctx, &computepb.InsertInstanceRequest{
+		Project: s.conf.ProjectId,
+		Zone:    zone,
+		InstanceResource: &computepb.Instance{
+			Name:        proto.String(instanceName),
+			MachineType: machine,
+			Labels:      settings.Labels,
+			Metadata: &computepb.Metadata{
+				Items: metadata,
 			},
-			SourceInstanceTemplate: &s.conf.InstanceTemplate,
-		}); err != nil {
-			log.Errorf("Could not create instance %s (%s) from template %s: %s", instanceName, zone, s.conf.InstanceTemplate, err.Error())
-			return err
-		} else {
-			if err := res.Wait(ctx); err != nil {
-				log.Errorf("Failed to wait for instance %s (%s) to be created from template: %s", instanceName, zone, err.Error())
-				return err
-			} else {
-				log.Infof("Created instance %s (%s) from template", instanceName, zone)
-			}
-		}
+		},
+		SourceInstanceTemplate: &instanceTemplate,
+	})
+	if err != nil {
+		log.WithContext(ctx).Errorf("Could not create instance %s (%s) from template %s: %s", instanceName, zone, instanceTemplate, err.Error())
 	}
-	return nil
+	return res, err
 }
 
 func (s *Autoscaler) readPat(ctx context.Context) (string, error) {
 
-	log.Debugf("About to read PAT from secret version: %s", s.conf.SecretVersion)
-	secretAccessClient := newSecretAccessClient(ctx)
-	defer secretAccessClient.Close()
+	if len(s.conf.GitHubPat) > 0 {
+		return s.conf.GitHubPat, nil
+	}
+	log.WithContext(ctx).Debugf("About to read PAT from secret version: %s", s.conf.SecretVersion)
+	secretAccessClient := s.secretAccessClient()
 	if secretResult, err := secretAccessClient.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
 		Name: s.conf.SecretVersion,
 	}); err != nil {
-		log.Errorf("Could not access GitHub PAT secret version %s: %s", s.conf.SecretVersion, err.Error())
-		return "", fmt.Errorf("missing GitHub PAT")
+		log.WithContext(ctx).Errorf("Could not access GitHub PAT secret version %s: %s", s.conf.SecretVersion, err.Error())
+		return "", ErrMissingPat
 	} else {
 		if pat := string(secretResult.Payload.Data); len(pat) == 0 {
-			log.Errorf("The GitHub PAT secret is empty")
+			log.WithContext(ctx).Errorf("The GitHub PAT secret is empty")
 			return "", fmt.Errorf("empty GitHub PAT")
 		} else {
 			return pat, nil
@@ -452,56 +585,85 @@ func (s *Autoscaler) readPat(ctx context.Context) (string, error) {
 }
 
 // A jit-config needs: RunnerName, RunnerGroupId, Labels, WorkFolder
-func (s *Autoscaler) GenerateRunnerJitConfig(ctx context.Context, url string, runnerName string, runnerGroupId int64, labels []string) (string, error) {
+func (s *Autoscaler) GenerateRunnerJitConfig(ctx context.Context, url string, runnerName string, runnerGroupId int64, labels []string) (_ string, err error) {
+
+	ctx, span := startSpan(ctx, "github.GenerateJitConfig", ATTR_VM_NAME.String(runnerName))
+	defer func() { endSpan(span, err) }()
+
+	log.WithContext(ctx).Debugf("About to request GitHub runner %s jit config from %s (runner group %d) using PAT from secret version: %s", runnerName, url, runnerGroupId, s.conf.SecretVersion)
+	reqPayload := map[string]any{}
+	reqPayload["name"] = runnerName
+	reqPayload["runner_group_id"] = runnerGroupId
+	reqPayload["labels"] = labels
+	reqPayload["work_folder"] = "_work"
+	payload := map[string]any{}
+	if err := s.github.Do(ctx, http.MethodPost, url, reqPayload, &payload, http.StatusCreated); err != nil {
+		log.WithContext(ctx).Errorf("GitHub runner jit-config request for runner %s failed: %s", runnerName, err.Error())
+		return "", err
+	} else if jitConfig, ok := payload["encoded_jit_config"].(string); ok && len(jitConfig) > 0 {
+		return jitConfig, nil
+	} else {
+		log.WithContext(ctx).Errorf("GitHub runner jit-config is empty")
+		return "", &GitHubError{Kind: ErrUnexpectedResponse, Method: http.MethodPost, Url: url, StatusCode: http.StatusCreated, Message: "empty jit-config"}
+	}
+}
+
+func (s *Autoscaler) GenerateRunnerRegistrationToken(ctx context.Context, url string) (_ string, err error) {
 
-	log.Debugf("About to request GitHub runner %s jit config from %s (runner group %d) using PAT from secret version: %s", runnerName, url, runnerGroupId, s.conf.SecretVersion)
-	secretAccessClient := newSecretAccessClient(ctx)
-	defer secretAccessClient.Close()
-	if pat, err := s.readPat(ctx); err != nil {
+	ctx, span := startSpan(ctx, "github.GenerateRegistrationToken")
+	defer func() { endSpan(span, err) }()
+
+	log.WithContext(ctx).Debugf("About to request GitHub runner registration token from %s using PAT from secret version: %s", url, s.conf.SecretVersion)
+	payload := map[string]any{}
+	if err := s.github.Do(ctx, http.MethodPost, url, nil, &payload, http.StatusCreated); err != nil {
+		log.WithContext(ctx).Errorf("GitHub runner registration token request failed: %s", err.Error())
 		return "", err
+	} else if token, ok := payload["token"].(string); ok && len(token) > 0 {
+		return token, nil
 	} else {
-		reqPayload := map[string]any{}
-		reqPayload["name"] = runnerName
-		reqPayload["runner_group_id"] = runnerGroupId
-		reqPayload["labels"] = labels
-		reqPayload["work_folder"] = "_work"
-		data, _ := json.Marshal(reqPayload)
-		if req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data)); err != nil {
-			log.Errorf("Could not create GitHub runner jit-config request")
-			return "", fmt.Errorf("failed jit-config request")
-		} else {
-			req.Header.Add("Accept", "application/vnd.github+json")
-			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", pat))
-			req.Header.Add("X-GitHub-Api-Version", GITHUB_API_VERSION)
-			req.Header.Add("User-Agent", "github-runner-autoscaler")
-			if resp, err := http.DefaultClient.Do(req); err != nil {
-				log.Errorf("GitHub runner jit-config request failed: %s", err.Error())
-				return "", fmt.Errorf("failed jit-config response")
-			} else if resp.StatusCode != 201 {
-				log.Errorf("GitHub runner jit-config request unsuccessful: %s", resp.Status)
-				defer resp.Body.Close()
-				return "", fmt.Errorf("failed jit-config response")
-			} else {
-				defer resp.Body.Close()
-				body, _ := io.ReadAll(resp.Body)
-				payload := map[string]any{}
-				if err := json.Unmarshal(body, &payload); err != nil {
-					log.Errorf("GitHub runner jit-config response missing: %s", err.Error())
-					return "", fmt.Errorf("failed jit-config response")
-				} else if jitConfig, ok := payload["encoded_jit_config"].(string); ok && len(jitConfig) > 0 {
-					return jitConfig, nil
-				} else {
-					log.Errorf("GitHub runner jit-config is empty")
-					return "", fmt.Errorf("failed jit-config response")
-				}
-			}
+		log.WithContext(ctx).Errorf("GitHub runner registration token is empty")
+		return "", &GitHubError{Kind: ErrUnexpectedResponse, Method: http.MethodPost, Url: url, StatusCode: http.StatusCreated, Message: "empty registration token"}
+	}
+}
+
+// config.sh expects the name of the runner group - not the id. Repositories don't have runner groups (empty name is returned)
+func (s *Autoscaler) GetRunnerGroupName(ctx context.Context, src Source, runnerGroupId int64) (string, error) {
+
+	var url string
+	switch src.SourceType {
+	case TypeEnterprise:
+		url = fmt.Sprintf(RUNNER_ENTERPRISE_GROUP_ENDPOINT, src.Name, runnerGroupId)
+	case TypeOrganization:
+		url = fmt.Sprintf(RUNNER_ORG_GROUP_ENDPOINT, src.Name, runnerGroupId)
+	default:
+		return "", nil
+	}
+	payload := map[string]any{}
+	if err := s.github.Do(ctx, http.MethodGet, url, nil, &payload, http.StatusOK); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			err = &GitHubError{Kind: ErrRunnerGroupNotFound, Method: http.MethodGet, Url: url, StatusCode: http.StatusNotFound}
 		}
+		log.WithContext(ctx).Errorf("Could not read name of runner group %d: %s", runnerGroupId, err.Error())
+		return "", err
+	} else if name, ok := payload["name"].(string); ok && len(name) > 0 {
+		return name, nil
+	} else {
+		return "", &GitHubError{Kind: ErrUnexpectedResponse, Method: http.MethodGet, Url: url, StatusCode: http.StatusOK, Message: "runner group without name"}
 	}
 }
 
 func (s *Autoscaler) CreateCallbackTaskWithToken(ctx context.Context, url string, secret string, job Job, delay time.Duration) error {
 
-	data, _ := json.Marshal(job)
+	return s.createCallbackTask(ctx, url, secret, fmt.Sprintf("%d", job.Id), job.Id, job, delay)
+}
+
+// the task name is "<taskId>-<retryCount>"
+func (s *Autoscaler) createCallbackTask(ctx context.Context, url string, secret string, taskId string, jobId int64, payload any, delay time.Duration) (err error) {
+
+	ctx, span := startSpan(ctx, "cloudtasks.CreateTask", ATTR_URL.String(url))
+	defer func() { endSpan(span, err) }()
+
+	data, _ := json.Marshal(payload)
 	now := timestamppb.Now()
 	now.Seconds += int64(delay.Seconds())
 	req := &taskspb.CreateTaskRequest{
@@ -525,21 +687,28 @@ func (s *Autoscaler) CreateCallbackTaskWithToken(ctx context.Context, url string
 		},
 	}
 	req.Task.GetHttpRequest().Body = []byte(data)
+	// the callback continues the trace of the current span
+	injectTraceContext(ctx, req.Task.GetHttpRequest().Headers)
 
-	client := newTaskClient(ctx)
-	defer client.Close()
+	createTask := func() error {
+		if s.localTasks != nil {
+			return s.localTasks.CreateTask(req.Task.Name, url, req.Task.GetHttpRequest().Headers, data, delay)
+		}
+		_, err := s.taskClient().CreateTask(ctx, req)
+		return err
+	}
 
 	var sendAndRetry func(int) error
 	sendAndRetry = func(retryCount int) error {
-		req.Task.Name = fmt.Sprintf("%s/tasks/%d-%d", s.conf.TaskQueue, job.Id, retryCount)
-		if _, err := client.CreateTask(ctx, req); err != nil {
-			if retry, _ := regexp.MatchString("code = AlreadyExists", err.Error()); retry && retryCount < 2 {
+		req.Task.Name = fmt.Sprintf("%s/tasks/%s-%d", s.conf.TaskQueue, taskId, retryCount)
+		if err := createTask(); err != nil {
+			if retry, _ := regexp.MatchString("code = AlreadyExists", err.Error()); (retry || errors.Is(err, ErrTaskExists)) && retryCount < 2 {
 				return sendAndRetry(retryCount + 1)
 			} else {
-				return fmt.Errorf("cloudtasks.CreateTask failed for job Id %d: %v", job.Id, err)
+				return fmt.Errorf("cloudtasks.CreateTask failed for job Id %d: %v", jobId, err)
 			}
 		} else {
-			log.Infof("Created cloud task callback for workflow job Id %d with url \"%s\" and payload \"%s\"", job.Id, url, data)
+			log.WithContext(ctx).Infof("Created cloud task callback for workflow job Id %d with url \"%s\"", jobId, url)
 			return nil
 		}
 	}
@@ -549,19 +718,52 @@ func (s *Autoscaler) CreateCallbackTaskWithToken(ctx context.Context, url string
 
 func (s *Autoscaler) DeleteCallbackTask(ctx context.Context, job Job) error {
 
-	client := newTaskClient(ctx)
-	defer client.Close()
-	err := client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{
-		Name: fmt.Sprintf("%s/tasks/%d-0", s.conf.TaskQueue, job.Id),
-	})
+	name := fmt.Sprintf("%s/tasks/%d-0", s.conf.TaskQueue, job.Id)
+	var err error
+	if s.localTasks != nil {
+		err = s.localTasks.DeleteTask(name)
+	} else {
+		err = s.taskClient().DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: name})
+	}
 	if err != nil {
 		return fmt.Errorf("cloudtasks.DeleteTask failed for job Id %d: %v", job.Id, err)
 	} else {
-		log.Infof("Deleted cloud task callback for workflow job Id %d", job.Id)
+		log.WithContext(ctx).Infof("Deleted cloud task callback for workflow job Id %d", job.Id)
 	}
 	return nil
 }
 
+// Reports a failed request to the caller. Permanent GitHub errors (bad credentials, missing permission, ...) are acknowledged
+// so Cloud Tasks stops retrying them, transient GitHub errors (rate limit, server errors) and all other errors lead to a retry
+func abortWithError(ctx *gin.Context, err error) {
+
+	var ghErr *GitHubError
+	if errors.As(err, &ghErr) {
+		if ghErr.RetryAfter > 0 {
+			ctx.Header("Retry-After", fmt.Sprintf("%d", int64(ghErr.RetryAfter.Seconds())))
+		}
+		if ghErr.Permanent() {
+			log.WithContext(ctx.Request.Context()).Errorf("Permanent GitHub error - the request will not be retried: %s", ghErr.Error())
+		} else {
+			log.WithContext(ctx.Request.Context()).Warnf("Transient GitHub error - the request will be retried: %s", ghErr.Error())
+		}
+		ctx.Error(err)
+		ctx.AbortWithStatusJSON(ghErr.HttpStatus(), gin.H{
+			"error":     ghErr.Kind.Error(),
+			"message":   ghErr.Error(),
+			"permanent": ghErr.Permanent(),
+		})
+	} else if ctx.Request.Context().Err() != nil {
+		// the request was canceled by the shutdown (or the caller went away) - Cloud Tasks retries the callback
+		log.WithContext(ctx.Request.Context()).Warnf("Request canceled - handing back the callback: %s", err.Error())
+		ctx.Error(err)
+		ctx.Header("Retry-After", fmt.Sprintf("%d", SHUTDOWN_RETRY_AFTER))
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+	} else {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
 const runner_script_wrapper = `
 #!/bin/bash
 val=$(curl "http://metadata.google.internal/computeMetadata/v1/instance/attributes/%s" -H "Metadata-Flavor: Google")
@@ -572,55 +774,220 @@ chmod +x ./runner_startup.sh
 rm runner_startup.sh
 `
 
-func (s *Autoscaler) createVmWithJitConfig(ctx *gin.Context, url string, runnerGroupId int64, settings VmSettings, labels []string) {
+// The register runner script is called with the parameters: <registration_token> <url> <labels> <runner_group> <config_flags>
+const runner_script_token_wrapper = `
+#!/bin/bash
+attr() {
+  curl -s "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1" -H "Metadata-Flavor: Google"
+}
+token=$(attr "%s")
+curl "http://metadata.google.internal/computeMetadata/v1/project/attributes/%s" -H "Metadata-Flavor: Google" > runner_startup.sh
+sed -i 's/\r$//' ./runner_startup.sh
+chmod +x ./runner_startup.sh
+./runner_startup.sh "$token" "$(attr %s)" "$(attr %s)" "$(attr %s)" "$(attr %s)"
+rm runner_startup.sh
+`
+
+const RUNNER_URL_ATTR string = "runner_url"
+const RUNNER_LABELS_ATTR string = "runner_labels"
+const RUNNER_GROUP_ATTR string = "runner_group"
+const RUNNER_CONFIG_FLAGS_ATTR string = "runner_config_flags"
+
+func (s *Autoscaler) createVmWithJitConfig(ctx context.Context, url string, runnerGroupId int64, settings VmSettings, labels []string) (string, error) {
 
 	if jitConfig, err := s.GenerateRunnerJitConfig(ctx, url, settings.Name, runnerGroupId, labels); err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return "", err
 	} else {
 		jit_config_attr := fmt.Sprintf("%s_%s", RUNNER_JIT_CONFIG_ATTR, RandStringRunes(16))
-		if err := s.CreateInstanceFromTemplate(ctx, settings.Name, settings.MachineType, &computepb.Items{
+		return s.backend.CreateRunner(ctx, RunnerSpec{Settings: settings, JitConfig: jitConfig, Metadata: append(slices.Clone(settings.Metadata), &computepb.Items{
 			Key:   proto.String(jit_config_attr),
 			Value: proto.String(jitConfig),
 		}, &computepb.Items{
 			Key:   proto.String("startup-script"),
 			Value: proto.String(fmt.Sprintf(runner_script_wrapper, jit_config_attr, RUNNER_SCRIPT_REGISTER_JIT_RUNNER_ATTR)),
-		}); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err)
-		} else {
-			ctx.Status(http.StatusOK)
+		})})
+	}
+}
+
+func (s *Autoscaler) createVmWithRegistrationToken(ctx context.Context, src Source, runnerGroupId int64, settings VmSettings, labels []string) (string, error) {
+
+	if token, err := s.GenerateRunnerRegistrationToken(ctx, src.RegistrationTokenEndpoint()); err != nil {
+		return "", err
+	} else if runnerGroup, err := s.GetRunnerGroupName(ctx, src, runnerGroupId); err != nil {
+		return "", err
+	} else {
+		return s.backend.CreateRunner(ctx, RunnerSpec{Settings: settings, Metadata: RegistrationTokenMetadata(src, settings.Metadata, token, runnerGroup, labels)})
+	}
+}
+
+// The guest metadata of a runner VM in registration mode "token": the given metadata followed by the registration token, the
+// parameters of config.sh and the startup script that passes them to the register runner script
+func RegistrationTokenMetadata(src Source, metadata []*computepb.Items, token string, runnerGroup string, labels []string) []*computepb.Items {
+
+	registration_token_attr := fmt.Sprintf("%s_%s", RUNNER_REGISTRATION_TOKEN_ATTR, RandStringRunes(16))
+	return append(slices.Clone(metadata), &computepb.Items{
+		Key:   proto.String(registration_token_attr),
+		Value: proto.String(token),
+	}, &computepb.Items{
+		Key:   proto.String(RUNNER_URL_ATTR),
+		Value: proto.String(src.runnerUrl()),
+	}, &computepb.Items{
+		Key:   proto.String(RUNNER_LABELS_ATTR),
+		Value: proto.String(strings.Join(labels, ",")),
+	}, &computepb.Items{
+		Key:   proto.String(RUNNER_GROUP_ATTR),
+		Value: proto.String(runnerGroup),
+	}, &computepb.Items{
+		Key:   proto.String(RUNNER_CONFIG_FLAGS_ATTR),
+		Value: proto.String(src.ConfigFlags),
+	}, &computepb.Items{
+		Key:   proto.String("startup-script"),
+		Value: proto.String(fmt.Sprintf(runner_script_token_wrapper, registration_token_attr, RUNNER_SCRIPT_REGISTER_RUNNER_ATTR, RUNNER_URL_ATTR, RUNNER_LABELS_ATTR, RUNNER_GROUP_ATTR, RUNNER_CONFIG_FLAGS_ATTR)),
+	})
+}
+
+// creates a runner VM for the job in none of the zones to avoid (if possible). Returns the name of the VM and the name of the insert
+// operation (only if ASYNC_CREATE is enabled)
+func (s *Autoscaler) createVm(ctx context.Context, src Source, profile *RunnerProfile, job Job, avoidZones []string) (string, string, error) {
+
+	settings := VmSettings{
+		Name:             s.newVmName(avoidZones),
+		MachineType:      profile.machineType(job),
+		InstanceTemplate: profile.InstanceTemplate,
+		Labels:           runnerVmLabels(src, profile, job),
+		Metadata:         runnerVmMetadata(src, profile, job),
+		Cpus:             profile.Cpus,
+		MemoryMb:         profile.MemoryMb,
+	}
+	var operation string
+	var err error
+	if src.RegistrationMode == RegistrationToken {
+		log.WithContext(ctx).Infof("Using registration token for runner registration for %s: %s", src.SourceType, src.Name)
+		operation, err = s.createVmWithRegistrationToken(ctx, src, s.runnerGroupId(src, job, profile.Name), settings, job.Labels)
+	} else {
+		log.WithContext(ctx).Infof("Using jit config for runner registration for %s: %s", src.SourceType, src.Name)
+		operation, err = s.createVmWithJitConfig(ctx, src.jitConfigEndpoint(), s.runnerGroupId(src, job, profile.Name), settings, job.Labels)
+	}
+	return settings.Name, operation, err
+}
+
+// the vm.created audit event of a runner VM (the creation started at start)
+func (s *Autoscaler) vmCreatedEvent(ctx context.Context, src Source, profile *RunnerProfile, task RunnerTask, vmName string, start time.Time) AuditEvent {
+
+	event := newJobEvent(AuditVmCreated, OutcomeSuccess, src, task.Job)
+	event.VmName = vmName
+	event.Zone = s.backend.Zone(ctx, vmName)
+	event.Attempt = task.Attempt
+	event.DurationSec = time.Since(start).Seconds()
+	if profile != nil {
+		event.Profile = profile.Name
+		event.RunnerGroupId = s.runnerGroupId(src, task.Job, profile.Name)
+		if machineType := profile.machineType(task.Job); machineType != nil {
+			event.MachineType = *machineType
+		}
+		event.Spot = profile.Spot
+	}
+	return event
+}
+
+// creates the runner VM and (if enabled) enqueues the check-job callback that detects if the job got stuck
+func (s *Autoscaler) provisionRunner(ctx context.Context, host string, src Source, task RunnerTask) error {
+
+	profile, reason := s.resolveProfile(task)
+	if s.isHeld(src) {
+		// draining or the source was paused after the create-vm callback was enqueued
+		task.HandedBack = false
+		s.holdJob(ctx, host, src, task, time.Time{})
+		return nil
+	} else if task.HandedBack && s.schedulingEnabled() {
+		// the scheduler of the instance that shut down held the job - the max. concurrency and the scaling windows still apply
+		task.HandedBack = false
+		notBefore, _ := s.evaluateWindow(task) // the window is checked again once the job is released
+		s.holdJob(ctx, host, src, task, notBefore)
+		return nil
+	} else if profile == nil {
+		// the runner profiles changed since the job was queued - retrying won't help
+		log.WithContext(ctx).Warnf("Rejecting workflow job Id %d with labels \"%s\": %s", task.Id, strings.Join(task.Labels, ", "), reason)
+		s.jobs.SetState(src.Name, task.Job, JobRejected)
+		event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, task.Job)
+		event.Reason = reason
+		s.audit(ctx, event)
+		// the job no longer takes a VM slot
+		s.wakeScheduler()
+		return nil
+	} else if !s.windowAllows(ctx, src, task, profile) {
+		// the scaling window changed since the job was queued
+		s.wakeScheduler()
+		return nil
+	}
+	log.WithContext(ctx).Infof("Creating runner VM for workflow job Id %d from runner profile %s", task.Id, profile.Name)
+	start := time.Now()
+	s.creating.Store(task.Id, start)
+	vmName, operation, err := s.createVm(ctx, src, profile, task.Job, task.FailedZones)
+	if err == nil && len(operation) > 0 {
+		// the VM is still being created - the verify-vm callback checks the insert operation
+		return s.enqueueVerifyVm(ctx, host, src, task, profile, vmName, operation, start)
+	}
+	s.creating.Delete(task.Id)
+	event := s.vmCreatedEvent(ctx, src, profile, task, vmName, start)
+	if err != nil {
+		event.Type = AuditVmCreateFailed
+		event.Outcome = OutcomeFailure
+		event.Reason = err.Error()
+		s.audit(ctx, event)
+		var ghErr *GitHubError
+		if errors.As(err, &ghErr) && ghErr.Permanent() {
+			// the callback is acknowledged (see abortWithError) - no VM will be created for the job
+			s.jobs.SetState(src.Name, task.Job, JobFailed)
+			s.wakeScheduler()
+		}
+		if s.conf.AsyncCreate && !errors.As(err, &ghErr) && ctx.Err() == nil {
+			// the insert request was rejected (e.g. quota exceeded)
+			return s.retryCreateVm(ctx, host, src, task, vmName, err)
+		}
+		return err
+	} else {
+		s.runnerCreated(ctx, host, src, task, event)
+		return nil
+	}
+}
+
+// remembers the created VM and (if enabled) enqueues the check-job callback
+func (s *Autoscaler) runnerCreated(ctx context.Context, host string, src Source, task RunnerTask, event AuditEvent) {
+
+	s.audit(ctx, event)
+	s.jobs.SetVm(src.Name, task.Job, event.VmName, event.Profile, task.Attempt)
+	if s.conf.StuckJobTimeout > 0 {
+		task.VmName = event.VmName
+		task.Operation = ""
+		task.InsertedAt = nil
+		task.Checks = 0
+		task.FailedZones = nil
+		checkUrl := createCallbackUrl(host, s.conf.RouteCheckJob, s.conf.SourceQueryParam, src.Name)
+		if err := s.createCallbackTask(ctx, checkUrl, src.Secret, fmt.Sprintf("%d-check-%d", task.Id, task.Attempt), task.Id, task, time.Duration(s.conf.StuckJobTimeout)*time.Second); err != nil {
+			// the runner was created - not being able to detect a stuck job is not considered an error
+			log.WithContext(ctx).Errorf("Can not enqueue check-job cloud task callback for workflow job Id %d: %s", task.Id, err.Error())
 		}
 	}
 }
 
 func (s *Autoscaler) handleCreateVm(ctx *gin.Context) {
 
-	log.Info("Received create-vm cloud task callback")
+	log.WithContext(ctx.Request.Context()).Info("Received create-vm cloud task callback")
 	if data, src, err := s.verifySignature(ctx); err == nil {
-		job := Job{}
-		json.Unmarshal(data, &job)
-		// use jit config
+		task := RunnerTask{}
+		json.Unmarshal(data, &task)
+		reqCtx, span := startHandlerSpan(ctx, "create-vm", task.Id, ATTR_SOURCE.String(src.Name))
+		defer endHandlerSpan(ctx, span)
 		switch src.SourceType {
-		case TypeEnterprise:
-			log.Infof("Using jit config for runner registration for enterprise: %s", src.Name)
-			s.createVmWithJitConfig(ctx, fmt.Sprintf(RUNNER_ENTERPRISE_JIT_CONFIG_ENDPOINT, src.Name), s.conf.RunnerGroupId, VmSettings{
-				Name:        fmt.Sprintf("%s-%s", s.conf.RunnerPrefix, RandStringRunes(10)),
-				MachineType: job.GetMagicLabelValue(MagicLabelMachine),
-			}, job.Labels)
-		case TypeOrganization:
-			log.Infof("Using jit config for runner registration for organization: %s", src.Name)
-			s.createVmWithJitConfig(ctx, fmt.Sprintf(RUNNER_ORG_JIT_CONFIG_ENDPOINT, src.Name), s.conf.RunnerGroupId, VmSettings{
-				Name:        fmt.Sprintf("%s-%s", s.conf.RunnerPrefix, RandStringRunes(10)),
-				MachineType: job.GetMagicLabelValue(MagicLabelMachine),
-			}, job.Labels)
-		case TypeRepository:
-			log.Infof("Using jit config for runner registration for repository: %s", src.Name)
-			// for repositories there is an implicit runner group with id 1
-			s.createVmWithJitConfig(ctx, fmt.Sprintf(RUNNER_REPO_JIT_CONFIG_ENDPOINT, src.Name), 1, VmSettings{
-				Name:        fmt.Sprintf("%s-%s", s.conf.RunnerPrefix, RandStringRunes(10)),
-				MachineType: job.GetMagicLabelValue(MagicLabelMachine),
-			}, job.Labels)
+		case TypeEnterprise, TypeOrganization, TypeRepository:
+			if err := s.provisionRunner(reqCtx, ctx.Request.Host, src, task); err != nil {
+				abortWithError(ctx, err)
+			} else {
+				ctx.Status(http.StatusOK)
+			}
 		default:
-			log.Errorf("Missing source type for %s", src.Name)
+			log.WithContext(reqCtx).Errorf("Missing source type for %s", src.Name)
 			ctx.Status(http.StatusBadRequest)
 		}
 	}
@@ -628,83 +995,240 @@ func (s *Autoscaler) handleCreateVm(ctx *gin.Context) {
 
 func (s *Autoscaler) handleDeleteVm(ctx *gin.Context) {
 
-	log.Info("Received delete-vm cloud task callback")
-	if data, _, err := s.verifySignature(ctx); err == nil {
+	log.WithContext(ctx.Request.Context()).Info("Received delete-vm cloud task callback")
+	if data, src, err := s.verifySignature(ctx); err == nil {
 		job := Job{}
 		json.Unmarshal(data, &job)
-		if err := s.DeleteInstance(ctx, job.RunnerName); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err)
+		reqCtx, span := startHandlerSpan(ctx, "delete-vm", job.Id, ATTR_SOURCE.String(src.Name), ATTR_VM_NAME.String(job.RunnerName))
+		defer endHandlerSpan(ctx, span)
+		if !s.conf.Simulate {
+			// a runner VM that stopped itself failed to register or to pick up the job
+			if state, err := s.backend.RunnerState(reqCtx, job.RunnerName); err == nil && state.isStopped() {
+				s.captureSerialOutput(reqCtx, src, job, job.RunnerName, fmt.Sprintf("stopped itself (%s)", state))
+			}
+		}
+		if err := s.deleteVm(reqCtx, src, job, job.RunnerName, ""); err != nil {
+			abortWithError(ctx, err)
 		} else {
 			ctx.Status(http.StatusOK)
 		}
 	}
 }
 
+// Deletes the runner VM and emits the vm.deleted (or vm.delete_failed) audit event, which also ends the runtime of the VM in the
+// cost report. Every runner VM has to be deleted this way
+func (s *Autoscaler) deleteVm(ctx context.Context, src Source, job Job, vmName string, reason string) error {
+
+	start := time.Now()
+	event := newJobEvent(AuditVmDeleted, OutcomeSuccess, src, job)
+	event.VmName = vmName
+	event.Zone = s.backend.Zone(ctx, vmName)
+	event.Reason = reason
+	err := s.backend.DeleteRunner(ctx, vmName)
+	event.DurationSec = time.Since(start).Seconds()
+	if err != nil {
+		event.Type = AuditVmDeleteFailed
+		event.Outcome = OutcomeFailure
+		event.Reason = err.Error()
+	}
+	s.audit(ctx, event)
+	return err
+}
+
+// the source and workflow job the runner VM was created for (empty if unknown)
+func (s *Autoscaler) vmJob(vmName string) (Source, Job) {
+
+	for _, record := range s.jobs.List() {
+		if record.VmName == vmName {
+			return s.conf.RegisteredSources[record.Source], record.Job
+		}
+	}
+	return Source{}, Job{}
+}
+
+// enqueues a delayed create-vm cloud task callback for a queued workflow job (if the labels match and the job was not already enqueued)
+func (s *Autoscaler) queueJob(ctx context.Context, host string, src Source, job Job) error {
+
+	if ok, reason := s.acceptsRepository(src, job); !ok {
+		log.WithContext(ctx).Infof("Rejecting workflow job Id %d: %s by the repository filter of source %s", job.Id, reason, src.Name)
+		s.jobs.Reject(src.Name, job)
+		event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, job)
+		event.Reason = "repository filter: " + reason
+		s.audit(ctx, event)
+	} else if profile, reason := s.matchProfile(job); profile == nil {
+		log.WithContext(ctx).Warnf("Rejecting workflow job Id %d with labels \"%s\": %s", job.Id, strings.Join(job.Labels, ", "), reason)
+		s.jobs.Reject(src.Name, job)
+		event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, job)
+		event.Reason = reason
+		s.audit(ctx, event)
+	} else if !s.jobs.Queue(src.Name, job) {
+		log.WithContext(ctx).Infof("Workflow job Id %d was already enqueued - ignoring", job.Id)
+	} else if decision, err := s.evaluatePolicy(ctx, src, job); err != nil {
+		log.WithContext(ctx).Errorf("Can not evaluate the security policy for workflow job Id %d: %s", job.Id, err.Error())
+		s.jobs.Forget(job.Id)
+		return err
+	} else if decision.Action == PolicyDeny {
+		log.WithContext(ctx).Warnf("Rejecting workflow job Id %d: denied by the security policy (%s)", job.Id, decision.Reason)
+		s.jobs.SetState(src.Name, job, JobRejected)
+		event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, job)
+		event.Reason = "security policy: " + decision.Reason
+		s.audit(ctx, event)
+	} else {
+		task := RunnerTask{Job: job}
+		if decision.Action == PolicyIsolate {
+			task.Profile = s.securityPolicy(src).IsolatedProfile
+			log.WithContext(ctx).Warnf("Isolating workflow job Id %d in runner profile %s (%s)", job.Id, task.Profile, decision.Reason)
+			event := newJobEvent(AuditJobIsolated, OutcomeSuccess, src, job)
+			event.Profile = task.Profile
+			event.Reason = "security policy: " + decision.Reason
+			s.audit(ctx, event)
+		}
+		if notBefore, err := s.evaluateWindow(task); err != nil {
+			log.WithContext(ctx).Warnf("Rejecting workflow job Id %d: %s", job.Id, err.Error())
+			s.jobs.SetState(src.Name, job, JobRejected)
+			event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, job)
+			event.Profile = task.Profile
+			event.Reason = err.Error()
+			s.audit(ctx, event)
+		} else if s.schedulingEnabled() || s.isHeld(src) {
+			s.holdJob(ctx, host, src, task, notBefore)
+		} else if err := s.enqueueCreateVm(ctx, host, src, task, time.Duration(s.conf.CreateVmDelay)*time.Second); err != nil {
+			s.jobs.Forget(job.Id)
+			return err
+		}
+	}
+	return nil
+}
+
+// delay the create vm callback so we have a chance to delete it if the workflow job is changing its state to 'waiting'
+func (s *Autoscaler) enqueueCreateVm(ctx context.Context, host string, src Source, task RunnerTask, delay time.Duration) error {
+
+	createUrl := createCallbackUrl(host, s.conf.RouteCreateVm, s.conf.SourceQueryParam, src.Name)
+	if err := s.createCallbackTask(ctx, createUrl, src.Secret, fmt.Sprintf("%d", task.Id), task.Id, task, delay); err != nil {
+		log.WithContext(ctx).Errorf("Can not enqueue create-vm cloud task callback: %s", err.Error())
+		event := newJobEvent(AuditJobQueued, OutcomeFailure, src, task.Job)
+		event.Reason = err.Error()
+		s.audit(ctx, event)
+		return err
+	}
+	s.audit(ctx, newJobEvent(AuditJobQueued, OutcomeSuccess, src, task.Job))
+	return nil
+}
+
+func (s *Autoscaler) waitJob(ctx context.Context, src Source, job Job) {
+
+	// the waiting action happens if a deployment environment is configured in the workflow that requires a review. We have to cancel the cloud task callback
+	if profile, reason := s.matchProfile(job); profile != nil {
+		s.jobs.SetState(src.Name, job, JobWaiting)
+		s.audit(ctx, newJobEvent(AuditJobWaiting, OutcomeSuccess, src, job))
+		if s.scheduler.Remove(job.Id) {
+			log.WithContext(ctx).Infof("Removed pending workflow job Id %d from the scheduler", job.Id)
+		} else if err := s.DeleteCallbackTask(ctx, job); err != nil {
+			// best effort - this is not considered an error
+			log.WithContext(ctx).Warnf("Can not delete create-vm cloud task callback: %s", err.Error())
+		}
+	} else {
+		log.WithContext(ctx).Warnf("Workflow job Id %d signals 'wait' but %s - ignoring", job.Id, reason)
+	}
+}
+
+// enqueues a delete-vm cloud task callback for a completed workflow job (if the runner group and labels match)
+func (s *Autoscaler) completeJob(ctx context.Context, host string, src Source, job Job) error {
+
+	// a VM slot may be free now
+	defer s.wakeScheduler()
+	if s.scheduler.Remove(job.Id) {
+		// the job was canceled before a VM was created for it
+		log.WithContext(ctx).Infof("Removed pending workflow job Id %d from the scheduler", job.Id)
+		s.jobs.SetState(src.Name, job, JobCompleted)
+		event := newJobEvent(AuditJobCompleted, OutcomeSuccess, src, job)
+		event.DurationSec = s.jobDuration(job)
+		event.Reason = job.Conclusion
+		s.audit(ctx, event)
+		return nil
+	}
+	profile, reason := s.matchProfile(job)
+	if record, ok := s.jobs.Get(job.Id); ok && len(record.Profile) > 0 {
+		// the runner VM may have been created from the isolated profile
+		profile, reason = profileByName(s.conf.RunnerProfiles, record.Profile), ""
+	}
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+	}
+	runnerGroupId := s.runnerGroupId(src, job, profileName)
+	if job.RunnerGroupId == runnerGroupId {
+		if profile != nil {
+
+			event := newJobEvent(AuditJobCompleted, OutcomeSuccess, src, job)
+			event.VmName = job.RunnerName
+			event.DurationSec = s.jobDuration(job)
+			event.Reason = job.Conclusion
+			s.audit(ctx, event)
+			s.jobs.SetState(src.Name, job, JobCompleted)
+
+			// if the user immediately cancels a workflow we have the chance to delete the callback if not older than 10 seconds - best effort, ignore all errors
+			s.DeleteCallbackTask(ctx, job)
+
+			deleteUrl := createCallbackUrl(host, s.conf.RouteDeleteVm, s.conf.SourceQueryParam, src.Name)
+			if err := s.CreateCallbackTaskWithToken(ctx, deleteUrl, src.Secret, job, 1*time.Second); err != nil {
+				log.WithContext(ctx).Errorf("Can not enqueue delete-vm cloud task callback: %s", err.Error())
+				event := newJobEvent(AuditCallbackFailed, OutcomeFailure, src, job)
+				event.VmName = job.RunnerName
+				event.Reason = err.Error()
+				s.audit(ctx, event)
+				return err
+			}
+		} else {
+			log.WithContext(ctx).Warnf("Signaled to delete a runner for workflow job Id %d but %s - ignoring", job.Id, reason)
+		}
+	} else {
+		log.WithContext(ctx).Warnf("Signaled to delete a runner for workflow job Id %d that does not belong to the expected runner group (expected \"%d\" got \"%d\") - ignoring", job.Id, runnerGroupId, job.RunnerGroupId)
+	}
+	return nil
+}
+
 func (s *Autoscaler) handleWebhook(ctx *gin.Context) {
 
-	log.Info("Received webhook")
+	log.WithContext(ctx.Request.Context()).Info("Received webhook")
 	if data, src, err := s.verifySignature(ctx); err == nil {
+		s.rememberCallbackHost(ctx.Request.Host)
 		event := ctx.GetHeader(EVENT_HEADER)
-		log.Info(string(data))
 		if event == WEBHOOK_PING_EVENT {
-			log.Info("Webhook ping acknowledged")
+			log.WithContext(ctx.Request.Context()).Info("Webhook ping acknowledged")
 			ctx.Status(http.StatusOK)
 		} else if event == WEBHOOK_JOB_EVENT {
 			payload := Payload{}
 			if err := json.Unmarshal(data, &payload); err != nil {
-				log.Errorf("Can not unmarshal payload - is the webhook content type set to \"application/json\"? %s", err.Error())
+				log.WithContext(ctx.Request.Context()).Errorf("Can not unmarshal payload - is the webhook content type set to \"application/json\"? %s", err.Error())
 				ctx.AbortWithError(http.StatusBadRequest, err)
 			} else {
+				job := payload.WorkflowJob()
+				reqCtx, span := startHandlerSpan(ctx, "webhook."+string(payload.Action), job.Id, ATTR_SOURCE.String(src.Name))
+				defer endHandlerSpan(ctx, span)
 				if payload.Action == QUEUED {
-					if ok, missingLabels := payload.Job.HasAllLabels(s.conf.RunnerLabels); ok {
-						createUrl := createCallbackUrl(ctx, s.conf.RouteCreateVm, s.conf.SourceQueryParam, src.Name)
-						// delay the create vm callback so we have a chance to delete it if the workflow job is changing its state to 'waiting'
-						if err := s.CreateCallbackTaskWithToken(ctx, createUrl, src.Secret, payload.Job, time.Duration(s.conf.CreateVmDelay)*time.Second); err != nil {
-							log.Errorf("Can not enqueue create-vm cloud task callback: %s", err.Error())
-							ctx.AbortWithError(http.StatusInternalServerError, err)
-							return
-						}
-					} else {
-						log.Warnf("Webhook requested to start a runner that is missing the label(s) \"%s\" - ignoring", strings.Join(missingLabels, ", "))
+					if err := s.queueJob(reqCtx, ctx.Request.Host, src, job); err != nil {
+						ctx.AbortWithError(http.StatusInternalServerError, err)
+						return
 					}
 				} else if payload.Action == WAITING {
-					// the waiting action happens if a deployment environment is configured in the workflow that requires a review. We have to cancel the cloud task callback
-					if ok, missingLabels := payload.Job.HasAllLabels(s.conf.RunnerLabels); ok {
-						if err := s.DeleteCallbackTask(ctx, payload.Job); err != nil {
-							// best effort - this is not considered an error
-							log.Warnf("Can not delete create-vm cloud task callback: %s", err.Error())
-						}
-					} else {
-						log.Warnf("Webhook signals 'wait' but is missing the label(s) \"%s\" - ignoring", strings.Join(missingLabels, ", "))
-					}
+					s.waitJob(reqCtx, src, job)
+				} else if payload.Action == IN_PROGRESS {
+					inProgress := newJobEvent(AuditJobInProgress, OutcomeSuccess, src, job)
+					inProgress.VmName = job.RunnerName
+					inProgress.DurationSec = s.jobDuration(job)
+					s.audit(reqCtx, inProgress)
+					s.jobs.SetState(src.Name, job, JobInProgress)
 				} else if payload.Action == COMPLETED {
-					runnerGroupId := s.conf.RunnerGroupId
-					if src.SourceType == TypeRepository {
-						runnerGroupId = 1
-					}
-					if payload.Job.RunnerGroupId == runnerGroupId {
-						if ok, missingLabels := payload.Job.HasAllLabels(s.conf.RunnerLabels); ok {
-
-							// if the user immediately cancels a workflow we have the chance to delete the callback if not older than 10 seconds - best effort, ignore all errors
-							s.DeleteCallbackTask(ctx, payload.Job)
-
-							deleteUrl := createCallbackUrl(ctx, s.conf.RouteDeleteVm, s.conf.SourceQueryParam, src.Name)
-							if err := s.CreateCallbackTaskWithToken(ctx, deleteUrl, src.Secret, payload.Job, 1*time.Second); err != nil {
-								log.Errorf("Can not enqueue delete-vm cloud task callback: %s", err.Error())
-								ctx.AbortWithError(http.StatusInternalServerError, err)
-								return
-							}
-						} else {
-							log.Warnf("Webhook signaled to delete a runner that is missing the label(s) \"%s\" - ignoring", strings.Join(missingLabels, ", "))
-						}
-					} else {
-						log.Warnf("Webhook signaled to delete a runner that does not belong to the expected runner group (expected \"%d\" got \"%d\") - ignoring", runnerGroupId, payload.Job.RunnerGroupId)
+					if err := s.completeJob(reqCtx, ctx.Request.Host, src, job); err != nil {
+						ctx.AbortWithError(http.StatusInternalServerError, err)
+						return
 					}
 				}
 				ctx.Status(http.StatusOK)
 			}
 		} else {
-			log.Infof("Unknown GitHub webhook event \"%s\" received - ignoring", event)
+			log.WithContext(ctx.Request.Context()).Infof("Unknown GitHub webhook event \"%s\" received - ignoring", event)
 			ctx.Status(http.StatusOK)
 		}
 	}
@@ -720,46 +1244,256 @@ func (p Pair) IsIValid() bool {
 }
 
 type AutoscalerConfig struct {
-	RouteWebhook      string
-	RouteCreateVm     string
-	RouteDeleteVm     string
-	ProjectId         string
-	Zones             []string
-	TaskQueue         string
-	TaskTimeout       int64
-	InstanceTemplate  string
-	SecretVersion     string
-	RunnerPrefix      string
-	RunnerGroupId     int64
-	RunnerLabels      []string
-	RegisteredSources map[string]Source
-	SourceQueryParam  string
-	CreateVmDelay     int64
-	Simulate          bool
+	RouteWebhook         string
+	RouteCreateVm        string
+	RouteDeleteVm        string
+	ProjectId            string
+	Zones                []string
+	TaskQueue            string
+	TaskTimeout          int64
+	InstanceTemplate     string
+	SecretVersion        string
+	RunnerPrefix         string
+	RunnerGroupId        int64
+	RunnerGroupRoutes    []RunnerGroupRoute
+	SecurityPolicy       SecurityPolicy
+	MaxConcurrency       int64
+	PriorityRules        []PriorityRule
+	ScalingSchedule      ScalingSchedule
+	RunnerLabels         []string
+	LabelMatchMode       LabelMatchMode
+	RunnerProfiles       []RunnerProfile
+	RegisteredSources    map[string]Source
+	SourceQueryParam     string
+	CreateVmDelay        int64
+	RouteCheckJob        string
+	StuckJobTimeout      int64
+	StuckJobAttempts     int64
+	SerialOutputSink     string
+	SerialOutputComment  bool
+	AuditSink            string
+	PriceTable           PriceTable
+	CostRetention        int64
+	InstanceTemplateSpot bool
+	ApiToken             string
+	AdminToken           string
+	CallbackHost         string
+	PollInterval         int64
+	GitHubTimeout        int64
+	GitHubApiUrl         string // the GitHub REST API is reached through this url instead of https://api.github.com if set
+	GitHubMaxRetries     int64
+	PatCacheTtl          int64
+	BulkCreateWindow     int64
+	Backend              BackendType
+	InstanceGroupManager string
+	DockerHost           string
+	RunnerImage          string
+	KubernetesNamespace  string
+	Kubeconfig           string // the cluster the autoscaler runs in if empty
+	GitHubPat            string // used instead of the SECRET_VERSION if set (docker backend only)
+	AsyncCreate          bool
+	RouteVerifyVm        string
+	VerifyVmDelay        int64
+	CreateVmAttempts     int64
+	ShutdownTimeout      int64
+	Drain                bool
+	Simulate             bool
 }
 
 type Autoscaler struct {
-	engine *gin.Engine
-	conf   AutoscalerConfig
+	engine       *gin.Engine
+	conf         AutoscalerConfig
+	clients      gcpClients
+	backend      Backend
+	bulk         *BulkBatcher    // nil if BULK_CREATE_WINDOW is not set
+	localTasks   *LocalTaskQueue // nil unless TASK_QUEUE is "local"
+	pat          *PatCache
+	github       *GitHubClient
+	jobs         *JobStore
+	serialSink   SerialOutputSink
+	auditSink    AuditSink
+	costs        *CostLedger
+	activity     *ActivityRecorder
+	creating     sync.Map // the ids of the jobs whose VM is being created
+	callbackHost atomic.Value
+	polling      pollState
+	// holds the create requests if MAX_CONCURRENCY is set
+	scheduler     *Scheduler
+	schedulerWake chan struct{}
+	releaseMu     sync.Mutex
+	draining      atomic.Bool
+	// canceled if the shutdown deadline is exceeded
+	requestCtx     context.Context
+	cancelRequests context.CancelFunc
+	shuttingDown   atomic.Bool
+	stop           chan struct{}
+	stopOnce       sync.Once
 }
 
 func NewAutoscaler(config AutoscalerConfig) *Autoscaler {
 
+	if len(config.RunnerProfiles) == 0 {
+		config.RunnerProfiles = []RunnerProfile{{Name: DEFAULT_PROFILE, Labels: config.RunnerLabels, Match: config.LabelMatchMode, Spot: config.InstanceTemplateSpot}}
+	}
+	for i := range config.RunnerProfiles {
+		if err := config.RunnerProfiles[i].Compile(); err != nil {
+			panic(err)
+		}
+	}
+	if err := config.SecurityPolicy.Validate(config.RunnerProfiles); err != nil {
+		panic(err)
+	}
+	for _, src := range config.RegisteredSources {
+		if src.SecurityPolicy != nil {
+			if err := src.SecurityPolicy.Validate(config.RunnerProfiles); err != nil {
+				panic(fmt.Errorf("source %s: %s", src.Name, err.Error()))
+			}
+		}
+		if src.Repositories != nil {
+			if err := src.Repositories.Validate(); err != nil {
+				panic(fmt.Errorf("repository filter of source %s: %s", src.Name, err.Error()))
+			}
+		}
+	}
+	for i := range config.RunnerGroupRoutes {
+		if err := config.RunnerGroupRoutes[i].Compile(); err != nil {
+			panic(err)
+		}
+	}
+	if err := config.ScalingSchedule.Compile(config.RunnerProfiles); err != nil {
+		panic(err)
+	}
+	// the held jobs are kept in memory only - polling picks them up again after a restart
+	if config.PollInterval <= 0 && (config.MaxConcurrency > 0 || config.ScalingSchedule.HoldsJobs()) {
+		panic(fmt.Errorf("MAX_CONCURRENCY and SCALING_SCHEDULE (max_concurrency or the off-hours action \"defer\") hold workflow jobs in memory - POLL_INTERVAL has to be set"))
+	}
+	for i := range config.PriorityRules {
+		if err := config.PriorityRules[i].Compile(); err != nil {
+			panic(err)
+		}
+	}
+	weights := map[string]float64{}
+	for name, src := range config.RegisteredSources {
+		if src.Weight < 0 {
+			panic(fmt.Errorf("negative weight of source %s", name))
+		} else if src.Weight > 0 {
+			weights[name] = src.Weight
+		}
+	}
+
 	engine := gin.New()
 
 	scaler := Autoscaler{
-		engine: engine,
-		conf:   config,
+		engine:   engine,
+		conf:     config,
+		jobs:     NewJobStore(),
+		costs:    NewCostLedger(time.Duration(config.CostRetention) * 24 * time.Hour),
+		activity: NewActivityRecorder(),
+		// buffered, so a wake up is not lost while the scheduler is releasing jobs
+		scheduler:     NewScheduler(weights),
+		schedulerWake: make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	scaler.requestCtx, scaler.cancelRequests = context.WithCancel(context.Background())
+	if config.Drain {
+		scaler.SetDraining(true)
+	}
+	if sink, err := NewSerialOutputSink(config.SerialOutputSink, scaler.storageClient); err != nil {
+		panic(err)
+	} else {
+		scaler.serialSink = sink
+	}
+	if sink, err := NewAuditSink(config.AuditSink); err != nil {
+		panic(err)
+	} else {
+		scaler.auditSink = sink
+	}
+	if config.BulkCreateWindow > 0 {
+		scaler.bulk = NewBulkBatcher(time.Duration(config.BulkCreateWindow)*time.Second, BULK_CREATE_MAX, time.Duration(config.TaskTimeout)*time.Second, scaler.BulkInsertInstances)
 	}
-	engine.Use(ginlogrus.Logger(log.WithFields(log.Fields{})))
-	engine.POST(config.RouteCreateVm, scaler.handleCreateVm)
-	engine.POST(config.RouteDeleteVm, scaler.handleDeleteVm)
+	if config.TaskQueue == LOCAL_TASK_QUEUE {
+		scaler.localTasks = NewLocalTaskQueue(scaler.requestCtx, engine, time.Duration(config.TaskTimeout)*time.Second)
+	}
+	if backend, err := newBackend(&scaler); err != nil {
+		panic(err)
+	} else {
+		scaler.backend = backend
+	}
+	scaler.pat = NewPatCache(scaler.readPat, time.Duration(config.PatCacheTtl)*time.Second)
+	scaler.github = NewGitHubClient(time.Duration(config.GitHubTimeout)*time.Second, int(config.GitHubMaxRetries), scaler.pat.Get)
+	scaler.github.OnBadCredentials(scaler.pat.Invalidate)
+	scaler.github.SetApiUrl(config.GitHubApiUrl)
+	engine.Use(otelgin.Middleware(SERVICE_NAME), ginlogrus.Logger(log.WithFields(log.Fields{})))
+	engine.POST(config.RouteCreateVm, scaler.rejectWhileShuttingDown, scaler.handleCreateVm)
+	engine.POST(config.RouteDeleteVm, scaler.rejectWhileShuttingDown, scaler.handleDeleteVm)
 	engine.POST(config.RouteWebhook, scaler.handleWebhook)
-	engine.GET("/healthcheck", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	if config.StuckJobTimeout > 0 {
+		engine.POST(config.RouteCheckJob, scaler.rejectWhileShuttingDown, scaler.handleCheckJob)
+	}
+	if config.AsyncCreate {
+		engine.POST(config.RouteVerifyVm, scaler.rejectWhileShuttingDown, scaler.handleVerifyVm)
+	}
+	engine.GET("/healthcheck", func(ctx *gin.Context) {
+		if scaler.IsShuttingDown() {
+			ctx.Status(http.StatusServiceUnavailable)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	if len(config.ApiToken) > 0 {
+		jobs := engine.Group("/jobs", scaler.requireApiToken)
+		jobs.GET("/:id", scaler.handleGetJob)
+		jobs.GET("/:id/serial_output", scaler.handleGetSerialOutput)
+		reports := engine.Group("/reports", scaler.requireApiToken)
+		reports.GET("/cost", scaler.handleCostReport)
+		engine.GET("/queue", scaler.requireApiToken, scaler.handleGetQueue)
+		dashboard := engine.Group("/dashboard", scaler.requireDashboardToken)
+		dashboard.GET("", scaler.handleDashboard)
+		dashboard.GET("/data", scaler.handleDashboardData)
+	}
+	if len(config.AdminToken) > 0 {
+		admin := engine.Group("/admin", scaler.requireAdminToken)
+		admin.GET("/status", scaler.handleAdminStatus)
+		admin.GET("/config", scaler.handleAdminConfig)
+		admin.GET("/vms", scaler.handleAdminListVms)
+		admin.DELETE("/vms/:name", scaler.handleAdminDeleteVm)
+		admin.POST("/drain", scaler.handleAdminDrain)
+		admin.DELETE("/drain", scaler.handleAdminDrain)
+		admin.POST("/pause", scaler.handleAdminPauseSource)
+		admin.DELETE("/pause", scaler.handleAdminPauseSource)
+		admin.POST("/reconcile", scaler.handleAdminReconcile)
+	}
 	return &scaler
 }
 
+// Serves until SIGTERM/SIGINT is received or Shutdown is called, then shuts down gracefully
 func (s *Autoscaler) Srv(port int) {
 
-	s.engine.Run(fmt.Sprintf("0.0.0.0:%d", port))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if s.conf.PollInterval > 0 {
+		go s.poll(ctx, time.Duration(s.conf.PollInterval)*time.Second)
+	}
+	// the scheduler also releases the jobs held while draining or while a source is paused
+	go s.schedule(ctx)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
+		Handler: s.engine.Handler(),
+		// the in-flight requests are canceled if the shutdown deadline is exceeded
+		BaseContext: func(net.Listener) context.Context { return s.requestCtx },
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.stop:
+		}
+		stop()
+		s.shutdown(server)
+		close(done)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Could not serve on port %d: %s", port, err.Error())
+	}
+	<-done
 }
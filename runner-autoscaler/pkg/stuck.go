@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// only the last bytes of the serial console output are kept
+const SERIAL_OUTPUT_TAIL int = 8192
+
+// Returns true if the workflow job is still queued. The state is read from the GitHub api if possible, otherwise the state known to the autoscaler is used
+func (s *Autoscaler) isJobStuck(ctx context.Context, task RunnerTask) (bool, error) {
+
+	if len(task.Url) > 0 {
+		job := Job{}
+		if err := s.github.Do(ctx, http.MethodGet, task.Url, nil, &job, http.StatusOK); err != nil {
+			log.WithContext(ctx).Errorf("Could not read state of workflow job Id %d: %s", task.Id, err.Error())
+			return false, err
+		}
+		return job.Status == string(QUEUED), nil
+	} else if record, ok := s.jobs.Get(task.Id); ok {
+		return record.State == JobQueued, nil
+	}
+	return false, nil
+}
+
+// Reads the tail of the serial console output of a VM instance. Returns an empty string if the output is not available
+func (s *Autoscaler) GetSerialOutput(ctx context.Context, instanceName string) string {
+
+	if s.conf.Simulate {
+		return ""
+	}
+	zone := s.backend.Zone(ctx, instanceName)
+	if len(zone) == 0 {
+		log.WithContext(ctx).Warnf("Could not read serial console output of instance %s: the zone is unknown", instanceName)
+		return ""
+	}
+	client := s.computeClient()
+	if res, err := client.GetSerialPortOutput(ctx, &computepb.GetSerialPortOutputInstanceRequest{
+		Project:  s.conf.ProjectId,
+		Zone:     zone,
+		Instance: instanceName,
+	}); err != nil {
+		log.WithContext(ctx).Warnf("Could not read serial console output of instance %s (%s): %s", instanceName, zone, err.Error())
+		return ""
+	} else {
+		output := res.GetContents()
+		if len(output) > SERIAL_OUTPUT_TAIL {
+			output = output[len(output)-SERIAL_OUTPUT_TAIL:]
+		}
+		return output
+	}
+}
+
+// Invoked by Cloud Tasks STUCK_JOB_TIMEOUT seconds after a VM was created for a workflow job. If the job is still queued, the VM is
+// replaced by a new one (up to STUCK_JOB_ATTEMPTS VMs in total)
+func (s *Autoscaler) handleCheckJob(ctx *gin.Context) {
+
+	log.WithContext(ctx.Request.Context()).Info("Received check-job cloud task callback")
+	if data, src, err := s.verifySignature(ctx); err == nil {
+		task := RunnerTask{}
+		json.Unmarshal(data, &task)
+		reqCtx, span := startHandlerSpan(ctx, "check-job", task.Id, ATTR_SOURCE.String(src.Name), ATTR_VM_NAME.String(task.VmName))
+		defer endHandlerSpan(ctx, span)
+		if stuck, err := s.isJobStuck(reqCtx, task); err != nil {
+			abortWithError(ctx, err)
+		} else if !stuck {
+			log.WithContext(reqCtx).Debugf("Workflow job Id %d was picked up by a runner", task.Id)
+			ctx.Status(http.StatusOK)
+		} else {
+			log.WithContext(reqCtx).Warnf("Workflow job Id %d is still queued %d seconds after VM %s was created (attempt %d/%d)", task.Id, s.conf.StuckJobTimeout, task.VmName, task.Attempt+1, s.conf.StuckJobAttempts)
+			event := newJobEvent(AuditJobStuck, OutcomeFailure, src, task.Job)
+			event.VmName = task.VmName
+			event.Attempt = task.Attempt
+			event.DurationSec = s.jobDuration(task.Job)
+			s.audit(reqCtx, event)
+			// GitHub does not tie the job to the jit runner created for it - the runner may run another job with the same labels
+			var err error
+			if jobId, busy := s.jobs.RunningJob(task.VmName); busy {
+				log.WithContext(reqCtx).Infof("VM %s is running workflow job Id %d - it is not deleted", task.VmName, jobId)
+			} else {
+				s.captureSerialOutput(reqCtx, src, task.Job, task.VmName, fmt.Sprintf("did not pick up the job within %d seconds", s.conf.StuckJobTimeout))
+				err = s.deleteVm(reqCtx, src, task.Job, task.VmName, fmt.Sprintf("stuck: did not pick up the job within %d seconds", s.conf.StuckJobTimeout))
+			}
+			if err != nil {
+				abortWithError(ctx, err)
+			} else if task.Attempt+1 >= s.conf.StuckJobAttempts {
+				log.WithContext(reqCtx).Errorf("Workflow job Id %d was not picked up by any of the %d VMs - giving up", task.Id, task.Attempt+1)
+				s.jobs.SetState(src.Name, task.Job, JobFailed)
+				event := newJobEvent(AuditJobFailed, OutcomeFailure, src, task.Job)
+				event.Attempt = task.Attempt
+				event.Reason = fmt.Sprintf("not picked up by any of the %d VMs", task.Attempt+1)
+				s.audit(reqCtx, event)
+				ctx.Status(http.StatusOK)
+			} else {
+				task.Attempt++
+				task.VmName = ""
+				log.WithContext(reqCtx).Infof("Creating replacement VM for workflow job Id %d (attempt %d/%d)", task.Id, task.Attempt+1, s.conf.StuckJobAttempts)
+				if err := s.provisionRunner(reqCtx, ctx.Request.Host, src, task); err != nil {
+					abortWithError(ctx, err)
+				} else {
+					ctx.Status(http.StatusOK)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const SERVICE_NAME string = "github-runner-autoscaler"
+const TRACER_NAME string = "github.com/Tereius/gcp-hosted-github-runner"
+
+const ATTR_JOB_ID = attribute.Key("github.workflow_job.id")
+const ATTR_SOURCE = attribute.Key("github.source")
+const ATTR_VM_NAME = attribute.Key("gce.instance.name")
+const ATTR_ZONE = attribute.Key("gce.zone")
+const ATTR_URL = attribute.Key("url.full")
+
+var tracer = otel.Tracer(TRACER_NAME)
+
+// Sets up the OpenTelemetry trace provider. Spans are only exported (via OTLP/HTTP) if the standard env OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The returned function flushes and stops the exporter
+func InitTracing(ctx context.Context, serviceName string, version string) (func(context.Context) error, error) {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) == 0 && len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) == 0 {
+		log.Debug("No OTLP endpoint configured - traces are not exported")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName), semconv.ServiceVersion(version)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	log.Info("Exporting traces via OTLP")
+	return provider.Shutdown, nil
+}
+
+type jobIdKey struct{}
+
+// starts a span that is related to a workflow job. All spans started from the returned context (see startSpan) get the job id attribute too
+func startJobSpan(ctx context.Context, name string, jobId int64, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+
+	return tracer.Start(context.WithValue(ctx, jobIdKey{}, jobId), name, trace.WithAttributes(append(attrs, ATTR_JOB_ID.Int64(jobId))...))
+}
+
+// starts a child span. The job id attribute is inherited
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+
+	if jobId, ok := ctx.Value(jobIdKey{}).(int64); ok {
+		attrs = append(attrs, ATTR_JOB_ID.Int64(jobId))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// starts a job span for a http handler. The span is stored in the request context, which is returned and has to be passed to
+// everything below the handler. The gin context itself must not be used as context.Context - it is reused for the next request
+// once the handler returns
+func startHandlerSpan(ctx *gin.Context, name string, jobId int64, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+
+	spanCtx, span := startJobSpan(ctx.Request.Context(), name, jobId, attrs...)
+	ctx.Request = ctx.Request.WithContext(spanCtx)
+	return spanCtx, span
+}
+
+// ends the span of a http handler and records the errors of the gin context
+func endHandlerSpan(ctx *gin.Context, span trace.Span) {
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(ctx.Writer.Status()))
+	if len(ctx.Errors) > 0 {
+		endSpan(span, ctx.Errors.Last().Err)
+	} else {
+		span.End()
+	}
+}
+
+// records the error (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injects the trace context of ctx into the given http headers (e.g. the headers of a Cloud Task callback)
+func injectTraceContext(ctx context.Context, headers map[string]string) {
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+}
+
+func newTracingTransport() http.RoundTripper {
+
+	return otelhttp.NewTransport(http.DefaultTransport)
+}
+
+// A logrus hook that adds the Cloud Logging trace fields to every log entry that was created with a context containing a span
+// (log.WithContext(ctx)), so logs and traces line up
+type TraceHook struct {
+	ProjectId string
+}
+
+func (h *TraceHook) Levels() []log.Level {
+
+	return log.AllLevels
+}
+
+func (h *TraceHook) Fire(entry *log.Entry) error {
+
+	if entry.Context == nil {
+		return nil
+	}
+	if spanCtx := trace.SpanContextFromContext(entry.Context); spanCtx.IsValid() {
+		entry.Data["logging.googleapis.com/trace"] = fmt.Sprintf("projects/%s/traces/%s", h.ProjectId, spanCtx.TraceID().String())
+		entry.Data["logging.googleapis.com/spanId"] = spanCtx.SpanID().String()
+		entry.Data["logging.googleapis.com/trace_sampled"] = spanCtx.IsSampled()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/protobuf/proto"
+)
+
+// GCE labels: max. 63 chars of lower case letters, digits, "_" and "-". Keys have to start with a letter
+const GCE_LABEL_MAX_LENGTH int = 63
+
+const VM_LABEL_MANAGED_BY string = "managed-by"
+const VM_LABEL_MANAGED_BY_VALUE string = "github-runner-autoscaler"
+const VM_LABEL_SOURCE string = "gh-source"
+const VM_LABEL_SOURCE_TYPE string = "gh-source-type"
+const VM_LABEL_REPOSITORY string = "gh-repository"
+const VM_LABEL_WORKFLOW string = "gh-workflow"
+const VM_LABEL_JOB_ID string = "gh-job-id"
+const VM_LABEL_RUN_ID string = "gh-run-id"
+const VM_LABEL_RUNNER_LABELS string = "gh-runner-labels"
+const VM_LABEL_PROFILE string = "gh-profile"
+
+// guest metadata keys (readable from within the VM via the metadata server)
+const VM_METADATA_SOURCE string = "github-source"
+const VM_METADATA_REPOSITORY string = "github-repository"
+const VM_METADATA_WORKFLOW string = "github-workflow"
+const VM_METADATA_JOB_ID string = "github-job-id"
+const VM_METADATA_JOB_URL string = "github-job-url"
+const VM_METADATA_RUN_ID string = "github-run-id"
+const VM_METADATA_RUN_ATTEMPT string = "github-run-attempt"
+const VM_METADATA_HEAD_BRANCH string = "github-head-branch"
+const VM_METADATA_HEAD_SHA string = "github-head-sha"
+const VM_METADATA_RUNNER_LABELS string = "github-runner-labels"
+const VM_METADATA_PROFILE string = "github-runner-profile"
+
+var matchInvalidLabelChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// Converts a value to a valid GCE label value: lower case, invalid characters replaced by "_", truncated to 63 chars
+func SanitizeLabelValue(value string) string {
+
+	value = matchInvalidLabelChars.ReplaceAllString(strings.ToLower(value), "_")
+	if len(value) > GCE_LABEL_MAX_LENGTH {
+		value = value[:GCE_LABEL_MAX_LENGTH]
+	}
+	return value
+}
+
+// Converts a key to a valid GCE label key. Same as SanitizeLabelValue but the key has to start with a lower case letter and must not be empty
+func SanitizeLabelKey(key string) string {
+
+	key = SanitizeLabelValue(key)
+	if len(key) == 0 || key[0] < 'a' || key[0] > 'z' {
+		key = SanitizeLabelValue("l" + key)
+	}
+	return key
+}
+
+// the GCE labels of a runner VM describing the workflow job (used to attribute the cost in the billing export)
+func runnerVmLabels(src Source, profile *RunnerProfile, job Job) map[string]string {
+
+	labels := map[string]string{
+		VM_LABEL_MANAGED_BY:  VM_LABEL_MANAGED_BY_VALUE,
+		VM_LABEL_SOURCE:      src.Name,
+		VM_LABEL_SOURCE_TYPE: string(src.SourceType),
+		VM_LABEL_JOB_ID:      fmt.Sprintf("%d", job.Id),
+		VM_LABEL_PROFILE:     profile.Name,
+	}
+	if repo := job.repository(); len(repo) > 0 {
+		labels[VM_LABEL_REPOSITORY] = repo
+	}
+	if len(job.WorkflowName) > 0 {
+		labels[VM_LABEL_WORKFLOW] = job.WorkflowName
+	}
+	if job.RunId > 0 {
+		labels[VM_LABEL_RUN_ID] = fmt.Sprintf("%d", job.RunId)
+	}
+	if len(job.Labels) > 0 {
+		labels[VM_LABEL_RUNNER_LABELS] = strings.Join(job.Labels, "_")
+	}
+	ret := map[string]string{}
+	for key, value := range labels {
+		ret[SanitizeLabelKey(key)] = SanitizeLabelValue(value)
+	}
+	return ret
+}
+
+// the guest metadata of a runner VM describing the workflow job (not sanitized)
+func runnerVmMetadata(src Source, profile *RunnerProfile, job Job) []*computepb.Items {
+
+	metadata := map[string]string{
+		VM_METADATA_SOURCE:        src.Name,
+		VM_METADATA_REPOSITORY:    job.repository(),
+		VM_METADATA_WORKFLOW:      job.WorkflowName,
+		VM_METADATA_JOB_ID:        fmt.Sprintf("%d", job.Id),
+		VM_METADATA_JOB_URL:       job.HtmlUrl,
+		VM_METADATA_HEAD_BRANCH:   job.HeadBranch,
+		VM_METADATA_HEAD_SHA:      job.HeadSha,
+		VM_METADATA_RUNNER_LABELS: strings.Join(job.Labels, ","),
+		VM_METADATA_PROFILE:       profile.Name,
+	}
+	if job.RunId > 0 {
+		metadata[VM_METADATA_RUN_ID] = fmt.Sprintf("%d", job.RunId)
+		metadata[VM_METADATA_RUN_ATTEMPT] = fmt.Sprintf("%d", job.RunAttempt)
+	}
+	items := []*computepb.Items{}
+	for key, value := range metadata {
+		if len(value) > 0 {
+			items = append(items, &computepb.Items{Key: proto.String(key), Value: proto.String(value)})
+		}
+	}
+	return items
+}
@@ -0,0 +1,306 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type OffHoursAction string
+
+const (
+	OffHoursAllow OffHoursAction = "allow" // jobs are processed like within a window
+	OffHoursDefer OffHoursAction = "defer" // jobs are held until the next window starts
+	OffHoursBlock OffHoursAction = "block" // jobs are rejected
+)
+
+// The settings that change while a window is active (or outside of all windows)
+type WindowSettings struct {
+	MaxConcurrency *int64   `json:"max_concurrency,omitempty"` // replaces MAX_CONCURRENCY (0: unlimited)
+	Profiles       []string `json:"profiles,omitempty"`        // the allowed runner profiles (empty: all profiles)
+	SpotOnly       bool     `json:"spot_only,omitempty"`       // only runner profiles creating spot VMs are allowed
+}
+
+// A recurring time window, e.g. weekdays from 08:00 to 20:00. If end is before start, the window spans midnight
+type ScalingWindow struct {
+	Name  string   `json:"name"`
+	Days  []string `json:"days,omitempty"` // mon, tue, wed, thu, fri, sat, sun (empty: every day)
+	Start string   `json:"start"`          // 15:04
+	End   string   `json:"end"`            // 15:04 (24:00 for the end of the day)
+	WindowSettings
+	days  map[time.Weekday]bool
+	start time.Duration
+	end   time.Duration
+}
+
+// Applies outside of all windows
+type OffHours struct {
+	WindowSettings
+	Action   OffHoursAction `json:"action,omitempty"`   // defaults to "allow"
+	Branches []string       `json:"branches,omitempty"` // jobs of these branches (globs) are always allowed, defaults to "main"
+}
+
+type ScalingSchedule struct {
+	Timezone string          `json:"timezone,omitempty"` // IANA timezone, defaults to UTC
+	Windows  []ScalingWindow `json:"windows,omitempty"`
+	OffHours OffHours        `json:"off_hours,omitempty"`
+	location *time.Location
+}
+
+// The window that is active at a point in time
+type ActiveWindow struct {
+	Name     string
+	OffHours bool
+	WindowSettings
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(clock string) (time.Duration, error) {
+
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time \"%s\" - expected HH:MM", clock)
+	} else if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time \"%s\" - expected HH:MM", clock)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Validates the schedule and parses the timezone, days and times. Has to be called before the schedule is used
+func (s *ScalingSchedule) Compile(profiles []RunnerProfile) error {
+
+	if location, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone \"%s\": %s", s.Timezone, err.Error())
+	} else {
+		s.location = location
+	}
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if len(w.Name) == 0 {
+			w.Name = fmt.Sprintf("window-%d", i)
+		}
+		w.days = map[time.Weekday]bool{}
+		for _, day := range w.Days {
+			if weekday, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]; ok {
+				w.days[weekday] = true
+			} else {
+				return fmt.Errorf("unknown day \"%s\" of scaling window %s", day, w.Name)
+			}
+		}
+		var err error
+		if w.start, err = parseClock(w.Start); err != nil {
+			return fmt.Errorf("scaling window %s: %s", w.Name, err.Error())
+		} else if w.end, err = parseClock(w.End); err != nil {
+			return fmt.Errorf("scaling window %s: %s", w.Name, err.Error())
+		} else if w.start == w.end {
+			return fmt.Errorf("scaling window %s: start equals end", w.Name)
+		}
+		if err := w.WindowSettings.validate(profiles); err != nil {
+			return fmt.Errorf("scaling window %s: %s", w.Name, err.Error())
+		}
+	}
+	switch s.OffHours.Action {
+	case "":
+		s.OffHours.Action = OffHoursAllow
+	case OffHoursAllow, OffHoursDefer, OffHoursBlock:
+	default:
+		return fmt.Errorf("unknown off-hours action \"%s\" - expected allow, defer or block", s.OffHours.Action)
+	}
+	if len(s.OffHours.Branches) == 0 {
+		s.OffHours.Branches = []string{"main"}
+	}
+	for _, branch := range s.OffHours.Branches {
+		if _, err := path.Match(branch, ""); err != nil {
+			return fmt.Errorf("invalid off-hours branch \"%s\": %s", branch, err.Error())
+		}
+	}
+	if err := s.OffHours.WindowSettings.validate(profiles); err != nil {
+		return fmt.Errorf("off-hours: %s", err.Error())
+	}
+	return nil
+}
+
+func (w *WindowSettings) validate(profiles []RunnerProfile) error {
+
+	if w.MaxConcurrency != nil && *w.MaxConcurrency < 0 {
+		return fmt.Errorf("negative max_concurrency")
+	}
+	for _, name := range w.Profiles {
+		if profileByName(profiles, name) == nil {
+			return fmt.Errorf("runner profile \"%s\" is not configured (see RUNNER_PROFILES)", name)
+		}
+	}
+	return nil
+}
+
+// true if windows are configured - without windows there are no off-hours either
+func (s *ScalingSchedule) IsActive() bool {
+
+	return len(s.Windows) > 0
+}
+
+// true if the window contains the point in time (in the timezone of the schedule)
+func (w *ScalingWindow) contains(t time.Time) bool {
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock := t.Sub(midnight)
+	onDay := func(day time.Weekday) bool { return len(w.days) == 0 || w.days[day] }
+	if w.start < w.end {
+		return onDay(t.Weekday()) && clock >= w.start && clock < w.end
+	}
+	// spans midnight: the part after start belongs to the current day, the part before end to the previous day
+	return (onDay(t.Weekday()) && clock >= w.start) || (onDay((t.Weekday()+6)%7) && clock < w.end)
+}
+
+// Returns the first window containing the point in time or the off-hours
+func (s *ScalingSchedule) Active(now time.Time) ActiveWindow {
+
+	now = now.In(s.location)
+	for i := range s.Windows {
+		if s.Windows[i].contains(now) {
+			return ActiveWindow{Name: s.Windows[i].Name, WindowSettings: s.Windows[i].WindowSettings}
+		}
+	}
+	return ActiveWindow{Name: "off-hours", OffHours: true, WindowSettings: s.OffHours.WindowSettings}
+}
+
+// true if the scheduler may hold workflow jobs because of the schedule: a window (or the off-hours) limits the max. concurrency or the
+// off-hours action is "defer"
+func (s *ScalingSchedule) HoldsJobs() bool {
+
+	if s.OffHours.Action == OffHoursDefer || s.OffHours.limitsConcurrency() {
+		return true
+	}
+	for i := range s.Windows {
+		if s.Windows[i].limitsConcurrency() {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WindowSettings) limitsConcurrency() bool {
+
+	return w.MaxConcurrency != nil && *w.MaxConcurrency > 0
+}
+
+// Returns the start of the next window after now. Zero if there is no window
+func (s *ScalingSchedule) NextWindowStart(now time.Time) time.Time {
+
+	now = now.In(s.location)
+	next := time.Time{}
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		for day := 0; day <= 7; day++ {
+			date := now.AddDate(0, 0, day)
+			if len(w.days) > 0 && !w.days[date.Weekday()] {
+				continue
+			}
+			start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, s.location).Add(w.start)
+			if start.After(now) {
+				if next.IsZero() || start.Before(next) {
+					next = start
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+// true if jobs of the branch are processed off-hours regardless of the off-hours action
+func (s *ScalingSchedule) isExemptBranch(branch string) bool {
+
+	for _, pattern := range s.OffHours.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if the runner profile is not allowed within the window
+func (w ActiveWindow) allows(profile *RunnerProfile) error {
+
+	if w.SpotOnly && !profile.Spot {
+		return fmt.Errorf("runner profile %s does not create spot VMs (%s is spot-only)", profile.Name, w.Name)
+	}
+	if len(w.Profiles) > 0 {
+		for _, name := range w.Profiles {
+			if name == profile.Name {
+				return nil
+			}
+		}
+		return fmt.Errorf("runner profile %s is not allowed during %s", profile.Name, w.Name)
+	}
+	return nil
+}
+
+// Evaluates the active scaling window for the job. Returns the start of the next window if the job is deferred or an error if the job
+// is rejected
+func (s *Autoscaler) evaluateWindow(task RunnerTask) (time.Time, error) {
+
+	window := s.activeWindow()
+	if profile, reason := s.resolveProfile(task); profile == nil {
+		return time.Time{}, fmt.Errorf("%s", reason)
+	} else if err := window.allows(profile); err != nil {
+		return time.Time{}, err
+	}
+	if !window.OffHours || s.conf.ScalingSchedule.isExemptBranch(task.HeadBranch) {
+		return time.Time{}, nil
+	}
+	switch s.conf.ScalingSchedule.OffHours.Action {
+	case OffHoursBlock:
+		return time.Time{}, fmt.Errorf("off-hours: jobs of branch \"%s\" are blocked", task.HeadBranch)
+	case OffHoursDefer:
+		return s.conf.ScalingSchedule.NextWindowStart(time.Now()), nil
+	}
+	return time.Time{}, nil
+}
+
+// Returns false and rejects the job if the window active right now does not allow the runner profile (the window changed since the job
+// was queued, e.g. a job deferred into a spot-only window)
+func (s *Autoscaler) windowAllows(ctx context.Context, src Source, task RunnerTask, profile *RunnerProfile) bool {
+
+	if err := s.activeWindow().allows(profile); err != nil {
+		log.WithContext(ctx).Warnf("Rejecting workflow job Id %d: %s", task.Id, err.Error())
+		s.jobs.SetState(src.Name, task.Job, JobRejected)
+		event := newJobEvent(AuditJobRejected, OutcomeIgnored, src, task.Job)
+		event.Profile = profile.Name
+		event.Reason = err.Error()
+		s.audit(ctx, event)
+		return false
+	}
+	return true
+}
+
+// the window active right now. Without windows the settings of the AutoscalerConfig apply
+func (s *Autoscaler) activeWindow() ActiveWindow {
+
+	if !s.conf.ScalingSchedule.IsActive() {
+		return ActiveWindow{}
+	}
+	return s.conf.ScalingSchedule.Active(time.Now())
+}
+
+// the max. number of active VMs right now (0: unlimited)
+func (s *Autoscaler) maxConcurrency() int64 {
+
+	if window := s.activeWindow(); window.MaxConcurrency != nil {
+		return *window.MaxConcurrency
+	}
+	return s.conf.MaxConcurrency
+}
+
+// jobs are held by the scheduler if a max. concurrency or scaling windows are configured
+func (s *Autoscaler) schedulingEnabled() bool {
+
+	return s.conf.MaxConcurrency > 0 || s.conf.ScalingSchedule.IsActive()
+}
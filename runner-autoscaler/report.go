@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+)
+
+// runner-autoscaler report [flags] - prints a cost report either computed from an audit log file or fetched from a running autoscaler
+func runReport(args []string) error {
+
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	auditLog := flags.String("audit-log", "", "audit log file (json lines written by the file or stdout audit sink), \"-\" reads from stdin")
+	autoscalerUrl := flags.String("url", "", "base url of a running autoscaler, e.g. https://autoscaler-123.us-east1.run.app (instead of -audit-log)")
+	token := flags.String("token", os.Getenv("API_TOKEN"), "api token of the autoscaler (-url only)")
+	prices := flags.String("prices", "", "price table json file (-audit-log only, defaults to env PRICE_TABLE)")
+	from := flags.String("from", "", "start of the report (2006-01-02 or RFC 3339), defaults to 30 days ago")
+	to := flags.String("to", "", "end of the report (2006-01-02 or RFC 3339), defaults to now")
+	groupBy := flags.String("group-by", "repository,workflow", "comma separated list of: source, repository, workflow, label")
+	format := flags.String("format", "csv", "csv or json")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of the request to the autoscaler (-url only)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := pkg.ParseCostReportFormat(*format); err != nil {
+		return err
+	}
+	if len(*autoscalerUrl) > 0 {
+		return fetchReport(*autoscalerUrl, *token, *from, *to, *groupBy, *format, *timeout)
+	} else if len(*auditLog) == 0 {
+		return fmt.Errorf("either -audit-log or -url is required")
+	}
+
+	now := time.Now().UTC()
+	priceTable := pkg.PriceTable{}
+	if len(*prices) > 0 {
+		if data, err := os.ReadFile(*prices); err != nil {
+			return err
+		} else if err := json.Unmarshal(data, &priceTable); err != nil {
+			return fmt.Errorf("price table %s is not valid json: %s", *prices, err.Error())
+		}
+	} else if err := json.Unmarshal([]byte(getEnvDefault("PRICE_TABLE", "{}")), &priceTable); err != nil {
+		return fmt.Errorf("env PRICE_TABLE is not valid json: %s", err.Error())
+	}
+	fromTime, err := pkg.ParseReportTime(*from, now.AddDate(0, 0, -30))
+	if err != nil {
+		return err
+	}
+	toTime, err := pkg.ParseReportTime(*to, now)
+	if err != nil {
+		return err
+	}
+	groups, err := pkg.ParseCostGroups(*groupBy)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader = os.Stdin
+	if *auditLog != "-" {
+		file, err := os.Open(*auditLog)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	ledger := pkg.NewCostLedger(0)
+	if err := ledger.ReadAuditLog(reader); err != nil {
+		return err
+	}
+	report := pkg.NewCostReport(ledger.Usages(), ledger.Since(), priceTable, fromTime, toTime, groups)
+	if pkg.CostReportFormat(*format) == pkg.FormatJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return report.WriteCsv(os.Stdout)
+}
+
+func fetchReport(autoscalerUrl string, token string, from string, to string, groupBy string, format string, timeout time.Duration) error {
+
+	query := url.Values{}
+	query.Set("from", from)
+	query.Set("to", to)
+	query.Set("group_by", groupBy)
+	query.Set("format", format)
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(autoscalerUrl, "/")+"/reports/cost?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("autoscaler responded with status %d", res.StatusCode)
+	}
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
@@ -0,0 +1,110 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(t *testing.T, method string, path string, token string) *http.Response {
+
+	req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%d/admin%s", PORT, path), nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	return resp
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, http.MethodGet, "/status", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, http.MethodGet, "/status", "wrong").StatusCode)
+	assert.Equal(t, http.StatusOK, adminRequest(t, http.MethodGet, "/status", ADMIN_TOKEN).StatusCode)
+}
+
+func TestAdminDrainAndPause(t *testing.T) {
+
+	status := pkg.AdminStatus{}
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, http.MethodPost, "/drain", ADMIN_TOKEN).StatusCode)
+	assert.True(t, scaler.IsDraining())
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, http.MethodDelete, "/drain", ADMIN_TOKEN).StatusCode)
+	assert.False(t, scaler.IsDraining())
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, http.MethodPost, "/pause?source=unknown", ADMIN_TOKEN).StatusCode)
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, http.MethodPost, "/pause?source="+url.QueryEscape(TEST_REPO_KEY), ADMIN_TOKEN).StatusCode)
+	resp := adminRequest(t, http.MethodGet, "/status", ADMIN_TOKEN)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, []string{TEST_REPO_KEY}, status.PausedSources)
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, http.MethodDelete, "/pause?source="+url.QueryEscape(TEST_REPO_KEY), ADMIN_TOKEN).StatusCode)
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+
+	resp := adminRequest(t, http.MethodGet, "/config", ADMIN_TOKEN)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	config := pkg.AutoscalerConfig{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&config))
+	assert.Equal(t, pkg.REDACTED, config.AdminToken)
+	assert.Equal(t, pkg.REDACTED, config.ApiToken)
+	assert.Equal(t, pkg.REDACTED, config.RegisteredSources[TEST_REPO_KEY].Secret)
+	assert.Equal(t, PROJECT_ID, config.ProjectId)
+}
+
+func TestReconcileLooksUpUnknownJobs(t *testing.T) {
+
+	mu := sync.Mutex{}
+	polls := 0
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/my-org/my-repo/actions/jobs/51", "/repos/my-org/my-repo/actions/jobs/53":
+			w.Write([]byte(`{"id": ` + path.Base(r.URL.Path) + `, "status": "completed", "conclusion": "success"}`))
+		case "/repos/my-org/my-repo/actions/jobs/52":
+			w.Write([]byte(`{"id": 52, "status": "in_progress"}`))
+		default:
+			mu.Lock()
+			polls++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer github.Close()
+	// the labels are sanitized (see runnerVmLabels)
+	docker := &fakeDocker{
+		containers: map[string]map[string]any{"runner-done": {}, "runner-busy": {}, "runner-repo": {}, "runner-lost": {}},
+		listed: `[
+			{"Names": ["/runner-done"], "State": "running", "Created": 1700000001, "Labels": {"gh-source": "my-org", "gh-repository": "my-org_my-repo", "gh-job-id": "51"}},
+			{"Names": ["/runner-busy"], "State": "running", "Created": 1700000002, "Labels": {"gh-source": "my-org", "gh-repository": "my-org_my-repo", "gh-job-id": "52"}},
+			{"Names": ["/runner-repo"], "State": "running", "Created": 1700000003, "Labels": {"gh-source": "my-org_my-repo", "gh-repository": "my-org_my-repo", "gh-job-id": "53"}},
+			{"Names": ["/runner-lost"], "State": "running", "Created": 1700000004, "Labels": {"gh-source": "other-org", "gh-job-id": "54"}}
+		]`,
+	}
+	scaler := startDockerScaler(t, PORT-12, docker, func(config *pkg.AutoscalerConfig) {
+		config.GitHubApiUrl = github.URL
+		config.CallbackHost = "autoscaler.example.com"
+		config.RegisteredSources["my-org"] = pkg.Source{Name: "my-org", SourceType: pkg.TypeOrganization, Secret: PUBLIC_SECRET}
+	})
+
+	result := scaler.Reconcile(context.Background())
+	assert.Equal(t, []string{"runner-done", "runner-repo"}, result.DeletedVms, "the VMs of completed jobs are deleted")
+	if assert.Len(t, result.Errors, 1) {
+		assert.Contains(t, result.Errors[0], "runner-lost")
+	}
+	docker.mu.Lock()
+	assert.Contains(t, docker.containers, "runner-busy")
+	assert.NotContains(t, docker.containers, "runner-done")
+	docker.mu.Unlock()
+	mu.Lock()
+	assert.Equal(t, 0, polls, "the sources are not polled without POLL_INTERVAL")
+	mu.Unlock()
+}
@@ -0,0 +1,37 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOperationResult(t *testing.T) {
+
+	running := &computepb.Operation{Name: proto.String("op-1"), Status: computepb.Operation_RUNNING.Enum()}
+	assert.True(t, errors.Is(pkg.OperationResult(running), pkg.ErrOperationRunning))
+
+	done := &computepb.Operation{Name: proto.String("op-2"), Status: computepb.Operation_DONE.Enum()}
+	assert.Nil(t, pkg.OperationResult(done))
+
+	exhausted := &computepb.Operation{
+		Name:   proto.String("op-3"),
+		Status: computepb.Operation_DONE.Enum(),
+		Error: &computepb.Error{Errors: []*computepb.Errors{{
+			Code:    proto.String("ZONE_RESOURCE_POOL_EXHAUSTED"),
+			Message: proto.String("The zone does not have enough resources available"),
+		}}},
+	}
+	var opErr *pkg.OperationError
+	err := pkg.OperationResult(exhausted)
+	assert.True(t, errors.As(err, &opErr))
+	assert.Equal(t, "op-3", opErr.Operation)
+	assert.Contains(t, err.Error(), "ZONE_RESOURCE_POOL_EXHAUSTED")
+
+	denied := &computepb.Operation{Name: proto.String("op-4"), Status: computepb.Operation_DONE.Enum(), HttpErrorStatusCode: proto.Int32(403), HttpErrorMessage: proto.String("FORBIDDEN")}
+	assert.True(t, errors.As(pkg.OperationResult(denied), &opErr))
+}
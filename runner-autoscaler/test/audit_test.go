@@ -0,0 +1,99 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditFileSinkWritesJsonLines(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := pkg.NewAuditSink("file://" + file)
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Emit(context.Background(), pkg.AuditEvent{SchemaVersion: pkg.AUDIT_SCHEMA_VERSION, Type: pkg.AuditJobQueued, Outcome: pkg.OutcomeSuccess, JobId: 1}))
+	assert.Nil(t, sink.Emit(context.Background(), pkg.AuditEvent{SchemaVersion: pkg.AUDIT_SCHEMA_VERSION, Type: pkg.AuditVmCreated, Outcome: pkg.OutcomeSuccess, JobId: 1, VmName: "runner-abc", Zone: "europe-west1-b"}))
+
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	event := map[string]any{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, "1", event["schema_version"])
+	assert.Equal(t, "vm.created", event["type"])
+	assert.Equal(t, "runner-abc", event["vm_name"])
+	assert.Equal(t, "europe-west1-b", event["zone"])
+}
+
+func TestAuditHttpSink(t *testing.T) {
+
+	received := pkg.AuditEvent{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sink, err := pkg.NewAuditSink(srv.URL)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Emit(context.Background(), pkg.AuditEvent{Type: pkg.AuditJobRejected, Outcome: pkg.OutcomeIgnored, JobId: 7, Reason: "missing label(s): gpu"}))
+	assert.Nil(t, sink.Flush(context.Background()))
+	assert.Equal(t, pkg.AuditJobRejected, received.Type)
+	assert.Equal(t, int64(7), received.JobId)
+	assert.Equal(t, "missing label(s): gpu", received.Reason)
+}
+
+func TestAuditHttpSinkDeliversInBackground(t *testing.T) {
+
+	received := atomic.Int64{}
+	first := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case first <- struct{}{}:
+		default:
+		}
+		<-release
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sink, err := pkg.NewAuditSink(srv.URL)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, sink.Emit(ctx, pkg.AuditEvent{Type: pkg.AuditJobQueued, JobId: 1}), "the event is not delivered while emitting")
+	cancel() // e.g. the request that emitted the event is done
+	<-first
+	for i := 0; i < pkg.AUDIT_QUEUE_SIZE; i++ {
+		assert.Nil(t, sink.Emit(context.Background(), pkg.AuditEvent{Type: pkg.AuditJobQueued, JobId: int64(i + 2)}))
+	}
+	assert.NotNil(t, sink.Emit(context.Background(), pkg.AuditEvent{Type: pkg.AuditJobQueued}), "the queue is bounded")
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelTimeout()
+	assert.NotNil(t, sink.Flush(timeout), "flushing gives up once the context is done")
+	close(release)
+	assert.Nil(t, sink.Flush(context.Background()))
+	assert.Equal(t, int64(pkg.AUDIT_QUEUE_SIZE+1), received.Load(), "the queued events are delivered on flush")
+	assert.NotNil(t, sink.Emit(context.Background(), pkg.AuditEvent{Type: pkg.AuditJobQueued}), "no events are accepted after flushing")
+}
+
+func TestAuditSinkUnsupported(t *testing.T) {
+
+	_, err := pkg.NewAuditSink("ftp://somewhere")
+	assert.NotNil(t, err)
+}
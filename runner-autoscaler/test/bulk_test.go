@@ -0,0 +1,85 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkBatcherCoalescesRequests(t *testing.T) {
+
+	mu := sync.Mutex{}
+	batches := map[pkg.BulkKey][]int{}
+	batcher := pkg.NewBulkBatcher(200*time.Millisecond, 100, time.Second, func(ctx context.Context, key pkg.BulkKey, requests []pkg.BulkRequest) map[string]error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches[key] = append(batches[key], len(requests))
+		// the VM in zone b fails individually
+		return map[string]error{"runner-b-0": errors.New("ZONE_RESOURCE_POOL_EXHAUSTED")}
+	})
+
+	errs := sync.Map{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		for _, zone := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(name string, zone string) {
+				defer wg.Done()
+				errs.Store(name, batcher.Insert(context.Background(), pkg.BulkKey{Zone: zone}, pkg.BulkRequest{Settings: pkg.VmSettings{Name: name}}))
+			}(fmt.Sprintf("runner-%s-%d", zone, i), zone)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[pkg.BulkKey][]int{{Zone: "a"}: {10}, {Zone: "b"}: {10}}, batches)
+	failed, _ := errs.Load("runner-b-0")
+	assert.NotNil(t, failed)
+	created, _ := errs.Load("runner-b-1")
+	assert.Nil(t, created)
+}
+
+func TestBulkBatcherFlushesFullBatches(t *testing.T) {
+
+	sizes := make(chan int, 10)
+	batcher := pkg.NewBulkBatcher(time.Hour, 3, time.Second, func(ctx context.Context, key pkg.BulkKey, requests []pkg.BulkRequest) map[string]error {
+		sizes <- len(requests)
+		return nil
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			assert.Nil(t, batcher.Insert(context.Background(), pkg.BulkKey{Zone: "a"}, pkg.BulkRequest{Settings: pkg.VmSettings{Name: name}}))
+		}(fmt.Sprintf("runner-%d", i))
+	}
+	wg.Wait()
+	assert.Equal(t, 3, <-sizes)
+	assert.Equal(t, 3, <-sizes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, batcher.Insert(ctx, pkg.BulkKey{Zone: "a"}, pkg.BulkRequest{Settings: pkg.VmSettings{Name: "runner-6"}}), context.DeadlineExceeded)
+}
+
+func TestMergeMetadata(t *testing.T) {
+
+	item := func(key string, value string) *computepb.Items {
+		return &computepb.Items{Key: &key, Value: &value}
+	}
+	template := []*computepb.Items{item("ssh-keys", "admin:key"), item("startup-script", "template")}
+	merged := pkg.MergeMetadata(template, []*computepb.Items{item("startup-script", "runner"), item("gh-job-id", "42")})
+	assert.Len(t, merged, 3)
+	assert.Equal(t, "ssh-keys", merged[0].GetKey(), "the metadata of the instance template is kept")
+	assert.Equal(t, "runner", merged[1].GetValue(), "an item replaces the template item with the same key")
+	assert.Equal(t, "gh-job-id", merged[2].GetKey())
+	assert.Equal(t, "template", template[1].GetValue(), "the template metadata is not modified")
+}
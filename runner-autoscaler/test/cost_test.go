@@ -0,0 +1,118 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+const auditLog = `{"schema_version":"1","time":"2024-08-01T10:01:00Z","type":"vm.created","outcome":"success","source":"octo-org","job_id":1,"repository":"octo-org/app","workflow":"CI","labels":["self-hosted","linux"],"vm_name":"runner-a","machine_type":"e2-standard-4","duration_sec":60}
+{"severity":"INFO","message":"audit: vm.created","audit":{"schema_version":"1","time":"2024-08-01T10:00:00Z","type":"vm.created","outcome":"success","source":"octo-org","job_id":2,"repository":"octo-org/lib","workflow":"Release","labels":["self-hosted"],"vm_name":"runner-b","spot":true}}
+{"severity":"INFO","message":"Some unrelated log line"}
+{"schema_version":"1","time":"2024-08-01T12:00:00Z","type":"vm.deleted","outcome":"success","source":"octo-org","job_id":1,"vm_name":"runner-a"}
+{"schema_version":"1","time":"2024-08-01T10:30:00Z","type":"vm.deleted","outcome":"success","source":"octo-org","job_id":2,"vm_name":"runner-b"}
+`
+
+func TestCostReport(t *testing.T) {
+
+	ledger := pkg.NewCostLedger(0)
+	assert.Nil(t, ledger.ReadAuditLog(strings.NewReader(auditLog)))
+	assert.Len(t, ledger.Usages(), 2)
+
+	prices := pkg.PriceTable{
+		"e2-standard-4":         {OnDemand: 0.2, Spot: 0.05},
+		pkg.PRICE_TABLE_DEFAULT: {OnDemand: 0.1, Spot: 0.02},
+	}
+	from := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 8, 2, 0, 0, 0, 0, time.UTC)
+	report := pkg.NewCostReport(ledger.Usages(), ledger.Since(), prices, from, to, []pkg.CostGroup{pkg.GroupByRepository})
+
+	assert.Len(t, report.Rows, 2)
+	// runner-a ran 2h on demand (including the 1 minute it took to create the VM)
+	assert.Equal(t, "octo-org/app", report.Rows[0].Repository)
+	assert.InDelta(t, 2.0, report.Rows[0].OnDemandHours, 0.001)
+	assert.InDelta(t, 0.4, report.Rows[0].Cost, 0.001)
+	// runner-b ran 0.5h as spot VM with the default price
+	assert.Equal(t, "octo-org/lib", report.Rows[1].Repository)
+	assert.InDelta(t, 0.5, report.Rows[1].SpotHours, 0.001)
+	assert.InDelta(t, 0.01, report.Rows[1].Cost, 0.001)
+	assert.Equal(t, 2, report.Total.VmCount)
+
+	// the runtime outside of the date range is not accounted
+	report = pkg.NewCostReport(ledger.Usages(), ledger.Since(), prices, time.Date(2024, 8, 1, 11, 0, 0, 0, time.UTC), to, []pkg.CostGroup{pkg.GroupByLabel})
+	assert.InDelta(t, 0.2, report.Total.Cost, 0.001)
+	assert.Len(t, report.Rows, 2)
+
+	out := bytes.Buffer{}
+	assert.Nil(t, report.WriteCsv(&out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "label,vm_count,on_demand_hours,spot_hours,unpriced_hours,cost", lines[0])
+	assert.Len(t, lines, 3)
+}
+
+func TestParseCostGroups(t *testing.T) {
+
+	groups, err := pkg.ParseCostGroups("source, workflow")
+	assert.Nil(t, err)
+	assert.Equal(t, []pkg.CostGroup{pkg.GroupBySource, pkg.GroupByWorkflow}, groups)
+	_, err = pkg.ParseCostGroups("zone")
+	assert.NotNil(t, err)
+}
+
+func TestCostLedgerSince(t *testing.T) {
+
+	start := time.Now().UTC()
+	ledger := pkg.NewCostLedger(0)
+	assert.False(t, ledger.Since().Before(start), "an empty ledger knows the runtime since it was created")
+	assert.Nil(t, ledger.ReadAuditLog(strings.NewReader(auditLog)))
+	// runner-b was created at 10:00, runner-a at 10:00 too (vm.created at 10:01 after 60s)
+	assert.Equal(t, time.Date(2024, 8, 1, 10, 0, 0, 0, time.UTC), ledger.Since())
+
+	retention := 24 * time.Hour
+	ledger = pkg.NewCostLedger(retention)
+	assert.Nil(t, ledger.ReadAuditLog(strings.NewReader(auditLog)))
+	assert.WithinDuration(t, time.Now().Add(-retention), ledger.Since(), time.Minute, "the runtime before the retention is forgotten")
+}
+
+func TestParseCostReportFormat(t *testing.T) {
+
+	format, err := pkg.ParseCostReportFormat("csv")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.FormatCsv, format)
+	_, err = pkg.ParseCostReportFormat("xml")
+	assert.NotNil(t, err)
+}
+
+func TestCostReportEndpoint(t *testing.T) {
+
+	get := func(query string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/reports/cost?%s", PORT, query), nil)
+		req.Header.Set("Authorization", "Bearer "+API_TOKEN)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := get("format=json")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	report := pkg.CostReport{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.False(t, report.Since.IsZero(), "the report says since when the runtime is known")
+
+	resp = get("format=csv")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(pkg.COST_REPORT_SINCE_HEADER))
+
+	resp = get("format=xml")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
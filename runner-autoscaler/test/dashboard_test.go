@@ -0,0 +1,60 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivityRecorder(t *testing.T) {
+
+	now := time.Now().UTC()
+	recorder := pkg.NewActivityRecorder()
+	recorder.Record(pkg.AuditEvent{Time: now, Type: pkg.AuditJobQueued, Outcome: pkg.OutcomeSuccess, JobId: 1})
+	recorder.Record(pkg.AuditEvent{Time: now, Type: pkg.AuditVmCreated, Outcome: pkg.OutcomeSuccess, JobId: 1})
+	recorder.Record(pkg.AuditEvent{Time: now.Add(-2 * time.Hour), Type: pkg.AuditVmCreateFailed, Outcome: pkg.OutcomeFailure, JobId: 2, Reason: "quota exceeded"})
+	recorder.Record(pkg.AuditEvent{Time: now.Add(-30 * time.Hour), Type: pkg.AuditVmCreateFailed, Outcome: pkg.OutcomeFailure, JobId: 3})
+
+	failures := recorder.Failures(now)
+	assert.Len(t, failures, 1)
+	assert.Equal(t, "quota exceeded", failures[0].Reason)
+
+	timeline := recorder.Timeline(now)
+	assert.Len(t, timeline, 24)
+	assert.Equal(t, 1, timeline[23].Queued)
+	assert.Equal(t, 1, timeline[23].Created)
+	assert.Equal(t, 1, timeline[21].Failed)
+}
+
+func TestDashboard(t *testing.T) {
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/dashboard", PORT)
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth("developer", API_TOKEN)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	html, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(html), "Runner Autoscaler")
+
+	req, _ = http.NewRequest(http.MethodGet, url+"/data", nil)
+	req.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	data := pkg.DashboardData{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&data))
+	assert.Len(t, data.Timeline, 24)
+	assert.Equal(t, []pkg.ZoneUsage{{Zone: ZONE, Vms: 0}}, data.Zones)
+}
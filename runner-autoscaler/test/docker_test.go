@@ -0,0 +1,153 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+// a fake Docker Engine API with one missing image
+type fakeDocker struct {
+	mu         sync.Mutex
+	pulled     bool
+	containers map[string]map[string]any
+	started    []string
+	listed     string // the json of the listed containers (a single running container if empty)
+}
+
+func (d *fakeDocker) handler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		path, _ := strings.CutPrefix(r.URL.Path, "/v1.41")
+		parts := strings.Split(strings.Trim(path, "/"), "/")
+		switch {
+		case r.Method == http.MethodPost && path == "/containers/create":
+			if !d.pulled {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"message": "No such image"})
+				return
+			}
+			config := map[string]any{}
+			json.NewDecoder(r.Body).Decode(&config)
+			d.containers[r.URL.Query().Get("name")] = config
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"abc"}`))
+		case r.Method == http.MethodPost && path == "/images/create":
+			d.pulled = r.URL.Query().Get("fromImage") == "ghcr.io/actions/actions-runner" && r.URL.Query().Get("tag") == "2.320.0"
+			w.Write([]byte("{\"status\":\"Pulling\"}\n{\"status\":\"Done\"}\n"))
+		case r.Method == http.MethodGet && path == "/containers/json":
+			filters := map[string][]string{}
+			json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+			if r.URL.Query().Get("all") != "true" || len(filters["label"]) != 1 || filters["label"][0] != "managed-by=github-runner-autoscaler" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			if len(d.listed) > 0 {
+				w.Write([]byte(d.listed))
+				return
+			}
+			w.Write([]byte(`[{"Names":["/runner-abc"],"Image":"ghcr.io/actions/actions-runner:2.320.0","State":"running","Created":1700000000,
+				"Labels":{"managed-by":"github-runner-autoscaler","gh-source":"my-org","gh-job-id":"42","gh-profile":"small"}}]`))
+		case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "start":
+			d.started = append(d.started, parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete && len(parts) == 2:
+			if _, ok := d.containers[parts[1]]; !ok || r.URL.Query().Get("force") != "true" {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"message": "No such container"})
+				return
+			}
+			delete(d.containers, parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "json":
+			w.Write([]byte(`{"State":{"Status":"exited"}}`))
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "logs":
+			w.Write(logFrame(1, "runner started\n"))
+			w.Write(logFrame(2, "runner failed\n"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+}
+
+func logFrame(stream byte, payload string) []byte {
+
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, []byte(payload)...)
+}
+
+func TestDockerBackend(t *testing.T) {
+
+	docker := &fakeDocker{containers: map[string]map[string]any{}}
+	server := httptest.NewServer(docker.handler())
+	defer server.Close()
+
+	backend, err := pkg.NewDockerBackend(server.URL, "ghcr.io/actions/actions-runner:2.320.0")
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	_, err = backend.CreateRunner(ctx, pkg.RunnerSpec{Settings: pkg.VmSettings{Name: "runner-abc"}})
+	assert.NotNil(t, err, "the docker backend requires a jit config")
+
+	_, err = backend.CreateRunner(ctx, pkg.RunnerSpec{
+		Settings:  pkg.VmSettings{Name: "runner-abc", Labels: map[string]string{"managed-by": "github-runner-autoscaler"}, Cpus: 1.5, MemoryMb: 2048},
+		JitConfig: "encoded-jit-config",
+	})
+	assert.Nil(t, err)
+	assert.True(t, docker.pulled, "the missing image is pulled")
+	assert.Equal(t, []string{"runner-abc"}, docker.started)
+	config := docker.containers["runner-abc"]
+	assert.Equal(t, "ghcr.io/actions/actions-runner:2.320.0", config["Image"])
+	assert.Equal(t, []any{"ACTIONS_RUNNER_INPUT_JITCONFIG=encoded-jit-config"}, config["Env"])
+	assert.Equal(t, map[string]any{"managed-by": "github-runner-autoscaler"}, config["Labels"])
+	assert.Equal(t, map[string]any{"NanoCpus": 1.5e9, "Memory": float64(2048 * 1024 * 1024)}, config["HostConfig"])
+
+	state, err := backend.RunnerState(ctx, "runner-abc")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.TERMINATED, state)
+	assert.Equal(t, "runner started\nrunner failed\n", backend.RunnerOutput(ctx, "runner-abc"))
+
+	runners, err := backend.ListRunners(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, runners, 1)
+	assert.Equal(t, "runner-abc", runners[0].Name)
+	assert.Equal(t, "RUNNING", runners[0].Status)
+	assert.Equal(t, "my-org", runners[0].Source)
+	assert.Equal(t, "small", runners[0].Profile)
+	assert.Equal(t, int64(42), runners[0].JobId)
+
+	assert.Nil(t, backend.DeleteRunner(ctx, "runner-abc"))
+	assert.Empty(t, docker.containers)
+	assert.Nil(t, backend.DeleteRunner(ctx, "runner-abc"), "a container that is already gone is not an error")
+}
+
+func TestDemuxDockerLogs(t *testing.T) {
+
+	assert.Equal(t, "out\nerr\n", pkg.DemuxDockerLogs(append(logFrame(1, "out\n"), logFrame(2, "err\n")...)))
+	assert.Equal(t, "plain output\n", pkg.DemuxDockerLogs([]byte("plain output\n")))
+	assert.Equal(t, "", pkg.DemuxDockerLogs(nil))
+}
+
+func TestDockerHost(t *testing.T) {
+
+	_, err := pkg.NewDockerBackend("unix:///var/run/docker.sock", "runner")
+	assert.Nil(t, err)
+	_, err = pkg.NewDockerBackend("tcp://localhost:2375", "runner")
+	assert.Nil(t, err)
+	_, err = pkg.NewDockerBackend("ssh://localhost", "runner")
+	assert.NotNil(t, err)
+	_, err = pkg.NewDockerBackend("unix:///var/run/docker.sock", "")
+	assert.NotNil(t, err)
+}
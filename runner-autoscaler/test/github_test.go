@@ -0,0 +1,198 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGitHubClient() *pkg.GitHubClient {
+
+	client := pkg.NewGitHubClient(5*time.Second, 3, func(ctx context.Context) (string, error) { return "test-pat", nil })
+	client.SetBackoff(10*time.Millisecond, 2*time.Second)
+	return client
+}
+
+func TestGitHubClientRetriesServerErrors(t *testing.T) {
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "Bearer test-pat", r.Header.Get("Authorization"))
+		if calls < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"encoded_jit_config": "abc"}`))
+		}
+	}))
+	defer srv.Close()
+
+	payload := map[string]any{}
+	err := newTestGitHubClient().Do(context.Background(), http.MethodPost, srv.URL, map[string]any{"name": "runner"}, &payload, http.StatusCreated)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "abc", payload["encoded_jit_config"])
+}
+
+func TestGitHubClientRateLimit(t *testing.T) {
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	err := newTestGitHubClient().Do(context.Background(), http.MethodGet, srv.URL, nil, nil, http.StatusOK)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.GreaterOrEqual(t, time.Since(start), 1*time.Second)
+}
+
+func TestGitHubClientRetryAfterDate(t *testing.T) {
+
+	calls := 0
+	retryAt := time.Now().Add(2 * time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", retryAt.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	err := newTestGitHubClient().Do(context.Background(), http.MethodGet, srv.URL, nil, nil, http.StatusOK)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	// the HTTP-date has a resolution of one second, the default backoff would be 10ms
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestGitHubClientPermanentErrors(t *testing.T) {
+
+	cases := map[int]error{
+		http.StatusUnauthorized: pkg.ErrBadCredentials,
+		http.StatusForbidden:    pkg.ErrMissingPermission,
+		http.StatusConflict:     pkg.ErrRunnerNameConflict,
+	}
+	for status, expected := range cases {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message": "nope"}`))
+		}))
+
+		err := newTestGitHubClient().Do(context.Background(), http.MethodPost, srv.URL, nil, nil, http.StatusCreated)
+		srv.Close()
+		assert.ErrorIs(t, err, expected)
+		assert.Equal(t, 1, calls)
+		var ghErr *pkg.GitHubError
+		if assert.True(t, errors.As(err, &ghErr)) {
+			assert.True(t, ghErr.Permanent())
+			assert.Equal(t, http.StatusOK, ghErr.HttpStatus())
+			assert.Equal(t, "nope", ghErr.Message)
+		}
+	}
+}
+
+func TestGitHubClientRunnerGroupNotFound(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Runner group not found"}`))
+	}))
+	defer srv.Close()
+
+	err := newTestGitHubClient().Do(context.Background(), http.MethodPost, srv.URL, nil, nil, http.StatusCreated)
+	assert.ErrorIs(t, err, pkg.ErrRunnerGroupNotFound)
+}
+
+func TestPatCache(t *testing.T) {
+
+	reads := 0
+	cache := pkg.NewPatCache(func(ctx context.Context) (string, error) {
+		reads++
+		if reads == 2 {
+			return "", errors.New("secret manager unavailable")
+		}
+		return "test-pat", nil
+	}, time.Minute)
+
+	pat, err := cache.Get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "test-pat", pat)
+	pat, _ = cache.Get(context.Background())
+	assert.Equal(t, "test-pat", pat)
+	assert.Equal(t, 1, reads)
+
+	cache.Invalidate()
+	_, err = cache.Get(context.Background())
+	assert.NotNil(t, err)
+	pat, err = cache.Get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "test-pat", pat)
+	assert.Equal(t, 3, reads)
+}
+
+func TestGitHubClientInvalidatesRejectedPat(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "Bad credentials"}`))
+	}))
+	defer srv.Close()
+
+	invalidated := 0
+	client := newTestGitHubClient()
+	client.OnBadCredentials(func() { invalidated++ })
+	err := client.Do(context.Background(), http.MethodGet, srv.URL, nil, nil, http.StatusOK)
+	assert.True(t, errors.Is(err, pkg.ErrBadCredentials))
+	assert.Equal(t, 1, invalidated)
+}
+
+func TestGitHubClientRateLimitRemaining(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4711")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := newTestGitHubClient()
+	assert.Equal(t, int64(-1), client.RateLimitRemaining())
+	assert.Nil(t, client.Do(context.Background(), http.MethodGet, srv.URL, nil, nil, http.StatusOK))
+	assert.Equal(t, int64(4711), client.RateLimitRemaining())
+}
+
+func TestGitHubClientApiUrl(t *testing.T) {
+
+	path := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client := newTestGitHubClient()
+	client.SetApiUrl(srv.URL + "/")
+	assert.Nil(t, client.Do(context.Background(), http.MethodGet, pkg.GITHUB_API_URL+"/orgs/my-org/repos", nil, nil, http.StatusOK))
+	assert.Equal(t, "/orgs/my-org/repos", path)
+}
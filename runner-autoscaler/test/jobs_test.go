@@ -0,0 +1,51 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobStoreDeduplicatesQueuedJobs(t *testing.T) {
+
+	store := pkg.NewJobStore()
+	job := pkg.Job{Id: 42, Labels: []string{"self-hosted"}}
+	assert.True(t, store.Queue("src", job))
+	assert.False(t, store.Queue("src", job))
+
+	// a job waiting for a deployment review may be queued again
+	store.SetState("src", job, pkg.JobWaiting)
+	assert.True(t, store.Queue("src", job))
+
+	store.SetState("src", job, pkg.JobCompleted)
+	assert.False(t, store.Queue("src", job))
+
+	record, ok := store.Get(42)
+	assert.True(t, ok)
+	assert.Equal(t, pkg.JobCompleted, record.State)
+	assert.Len(t, store.List(pkg.JobQueued), 0)
+	assert.Len(t, store.List(), 1)
+}
+
+func TestJobStoreRejectedJobs(t *testing.T) {
+
+	store := pkg.NewJobStore()
+	job := pkg.Job{Id: 42, Labels: []string{"ubuntu-latest"}}
+	store.Reject("my-org", job)
+	record, ok := store.Get(42)
+	assert.True(t, ok)
+	assert.Equal(t, pkg.JobRejected, record.State)
+	assert.False(t, record.Queueable("my-org"), "the job is not evaluated again by the same source")
+	assert.False(t, store.Queue("my-org", job))
+
+	// e.g. the repository filter of the organization excludes the repository that has its own source
+	assert.True(t, record.Queueable("my-org/my-repo"))
+	assert.True(t, store.Queue("my-org/my-repo", job))
+	record, _ = store.Get(42)
+	assert.Equal(t, "my-org/my-repo", record.Source)
+
+	store.Reject("my-org", job)
+	record, _ = store.Get(42)
+	assert.Equal(t, pkg.JobQueued, record.State, "a known job is not rejected")
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesBackend(t *testing.T) {
+
+	client := fake.NewClientset(&corev1.Pod{
+		// a pod that is not managed by the autoscaler
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "runners", Labels: map[string]string{"app": "other"}},
+	})
+	backend, err := pkg.NewKubernetesBackend(client, "runners", "ghcr.io/actions/actions-runner:2.320.0")
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	_, err = backend.CreateRunner(ctx, pkg.RunnerSpec{Settings: pkg.VmSettings{Name: "runner-abc"}})
+	assert.NotNil(t, err, "the kubernetes backend requires a jit config")
+
+	labels := map[string]string{"managed-by": "github-runner-autoscaler", "gh-source": "my-org", "gh-job-id": "42", "gh-profile": "small"}
+	_, err = backend.CreateRunner(ctx, pkg.RunnerSpec{
+		Settings:  pkg.VmSettings{Name: "runner-abc", Labels: labels, Cpus: 1.5, MemoryMb: 2048},
+		JitConfig: "encoded-jit-config",
+	})
+	assert.Nil(t, err)
+
+	pod, err := client.CoreV1().Pods("runners").Get(ctx, "runner-abc", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, labels, pod.Labels)
+	assert.Equal(t, corev1.RestartPolicyNever, pod.Spec.RestartPolicy)
+	assert.Len(t, pod.Spec.Containers, 1)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, "ghcr.io/actions/actions-runner:2.320.0", container.Image)
+	assert.Equal(t, "ACTIONS_RUNNER_INPUT_JITCONFIG", container.Env[0].Name)
+	assert.Empty(t, container.Env[0].Value, "the jit config is not part of the pod spec")
+	assert.Equal(t, "runner-abc", container.Env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, "jitconfig", container.Env[0].ValueFrom.SecretKeyRef.Key)
+	assert.Equal(t, "1500m", container.Resources.Limits.Cpu().String())
+	assert.Equal(t, "2Gi", container.Resources.Limits.Memory().String())
+
+	secret, err := client.CoreV1().Secrets("runners").Get(ctx, "runner-abc", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "encoded-jit-config", secret.StringData["jitconfig"])
+	assert.Len(t, secret.OwnerReferences, 1)
+	assert.Equal(t, "Pod", secret.OwnerReferences[0].Kind)
+	assert.Equal(t, "runner-abc", secret.OwnerReferences[0].Name)
+
+	pod.Status.Phase = corev1.PodSucceeded
+	_, err = client.CoreV1().Pods("runners").UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+	state, err := backend.RunnerState(ctx, "runner-abc")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.TERMINATED, state)
+	assert.Equal(t, "fake logs", backend.RunnerOutput(ctx, "runner-abc"))
+
+	runners, err := backend.ListRunners(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, runners, 1)
+	assert.Equal(t, "runner-abc", runners[0].Name)
+	assert.Equal(t, "", runners[0].Zone)
+	assert.Equal(t, "TERMINATED", runners[0].Status)
+	assert.Equal(t, "my-org", runners[0].Source)
+	assert.Equal(t, "small", runners[0].Profile)
+	assert.Equal(t, int64(42), runners[0].JobId)
+
+	assert.Nil(t, backend.DeleteRunner(ctx, "runner-abc"))
+	_, err = client.CoreV1().Pods("runners").Get(ctx, "runner-abc", metav1.GetOptions{})
+	assert.NotNil(t, err)
+	_, err = client.CoreV1().Secrets("runners").Get(ctx, "runner-abc", metav1.GetOptions{})
+	assert.NotNil(t, err)
+	assert.Nil(t, backend.DeleteRunner(ctx, "runner-abc"), "a pod that is already gone is not an error")
+}
+
+func TestPodState(t *testing.T) {
+
+	pod := func(phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{Status: corev1.PodStatus{Phase: phase}}
+	}
+	assert.Equal(t, pkg.PROVISIONING, pkg.PodState(pod(corev1.PodPending)))
+	assert.Equal(t, pkg.RUNNING, pkg.PodState(pod(corev1.PodRunning)))
+	assert.Equal(t, pkg.TERMINATED, pkg.PodState(pod(corev1.PodFailed)))
+	assert.Equal(t, pkg.Unknown, pkg.PodState(pod(corev1.PodUnknown)))
+	deleting := pod(corev1.PodRunning)
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	assert.Equal(t, pkg.STOPPING, pkg.PodState(deleting))
+}
+
+func TestKubernetesResources(t *testing.T) {
+
+	resources := pkg.KubernetesResources(0.5, 512)
+	assert.True(t, resources.Requests.Cpu().Equal(resource.MustParse("500m")))
+	assert.True(t, resources.Limits.Memory().Equal(resource.MustParse("512Mi")))
+	assert.Equal(t, corev1.ResourceRequirements{}, pkg.KubernetesResources(0, 0))
+
+	_, err := pkg.NewKubernetesBackend(fake.NewClientset(), "", "runner")
+	assert.NotNil(t, err)
+	_, err = pkg.NewKubernetesBackend(fake.NewClientset(), "runners", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalTaskQueue(t *testing.T) {
+
+	calls := atomic.Int32{}
+	received := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// the first attempt fails and is retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Header.Get("x-hub-signature-256") + " " + string(body)
+	})
+	queue := pkg.NewLocalTaskQueue(context.Background(), handler, 5*time.Second)
+
+	assert.Nil(t, queue.CreateTask("local/tasks/1-0", "https://localhost/create_vm?src=test", map[string]string{"x-hub-signature-256": "sha256=abc"}, []byte("{}"), 0))
+	assert.True(t, errors.Is(queue.CreateTask("local/tasks/1-0", "https://localhost/create_vm", nil, nil, 0), pkg.ErrTaskExists))
+	select {
+	case got := <-received:
+		assert.Equal(t, "sha256=abc {}", got)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the task was not retried")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+	assert.True(t, errors.Is(queue.CreateTask("local/tasks/1-0", "https://localhost/create_vm", nil, nil, 0), pkg.ErrTaskExists), "the name of a dispatched task can't be reused")
+
+	assert.Nil(t, queue.CreateTask("local/tasks/2-0", "https://localhost/create_vm", nil, nil, time.Hour))
+	assert.Nil(t, queue.DeleteTask("local/tasks/2-0"))
+	assert.True(t, errors.Is(queue.DeleteTask("local/tasks/2-0"), pkg.ErrTaskNotFound))
+}
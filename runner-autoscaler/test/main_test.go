@@ -29,6 +29,8 @@ const TEST_REPO = "Privatehive/runner-test"
 const TEST_REPO_KEY = "repository-" + TEST_REPO
 const SOURCE_QUERY_PARAM_NAME = "src"
 const PUBLIC_SECRET = "It's a Secret to Everybody"
+const ADMIN_TOKEN = "admin-token"
+const API_TOKEN = "api-token"
 
 func init() {
 
@@ -45,6 +47,8 @@ func init() {
 		RunnerGroupId:    1,
 		RunnerLabels:     []string{"self-hosted"},
 		SourceQueryParam: SOURCE_QUERY_PARAM_NAME,
+		AdminToken:       ADMIN_TOKEN,
+		ApiToken:         API_TOKEN,
 		RegisteredSources: map[string]pkg.Source{
 			TEST_REPO_KEY: {
 				Name:       TEST_REPO,
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMigZones(t *testing.T) {
+
+	assert.Equal(t, "europe-west1", pkg.ZoneRegion("europe-west1-b"))
+	assert.Equal(t, "us-central1", pkg.ZoneRegion("us-central1-a"))
+
+	assert.Equal(t, "europe-west1-c", pkg.InstanceUrlZone("https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-c/instances/runner-abc"))
+	assert.Equal(t, "europe-west1-d", pkg.InstanceUrlZone("zones/europe-west1-d/instances/runner-abc"))
+	assert.Equal(t, "", pkg.InstanceUrlZone("runner-abc"))
+}
+
+func TestPerInstanceConfig(t *testing.T) {
+
+	config := pkg.PerInstanceConfig("runner-abc", []*computepb.Items{
+		{Key: proto.String("jit_config_xyz"), Value: proto.String("encoded-jit-config")},
+		{Key: proto.String("startup-script"), Value: proto.String("#!/bin/bash")},
+	})
+	assert.Equal(t, "runner-abc", config.GetName())
+	assert.Equal(t, map[string]string{"jit_config_xyz": "encoded-jit-config", "startup-script": "#!/bin/bash"}, config.GetPreservedState().GetMetadata())
+}
+
+func migConfig(modify func(config *pkg.AutoscalerConfig)) pkg.AutoscalerConfig {
+
+	config := pkg.AutoscalerConfig{
+		RouteWebhook:         "/webhook",
+		RouteCreateVm:        "/create",
+		RouteDeleteVm:        "/delete",
+		Zones:                []string{"europe-west1-b", "europe-west1-c"},
+		Backend:              pkg.BackendMig,
+		InstanceGroupManager: "runners",
+	}
+	modify(&config)
+	return config
+}
+
+func TestMigBackendConfig(t *testing.T) {
+
+	assert.NotPanics(t, func() { pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) {})) })
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.InstanceGroupManager = "" }))
+	})
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.AsyncCreate = true }))
+	})
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.BulkCreateWindow = 5 }))
+	})
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.Zones = []string{"europe-west1-b", "us-central1-a"} }))
+	})
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.Backend = "unknown" }))
+	})
+	// the PAT env var and the in-process task queue are only meant for the docker backend (no GCP)
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.GitHubPat = "pat" }))
+	})
+	assert.Panics(t, func() {
+		pkg.NewAutoscaler(migConfig(func(config *pkg.AutoscalerConfig) { config.TaskQueue = pkg.LOCAL_TASK_QUEUE }))
+	})
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+const workflowJobPayload = `{
+  "action": "completed",
+  "workflow_job": {
+    "id": 29679449,
+    "run_id": 10464024513,
+    "run_attempt": 2,
+    "workflow_name": "CI",
+    "head_branch": "main",
+    "head_sha": "f83a356a3e2d76d2b9ea1c4f5e0e9cd0d1f3c5d0",
+    "url": "https://api.github.com/repos/octo-org/example-workflow/actions/jobs/29679449",
+    "html_url": "https://github.com/octo-org/example-workflow/actions/runs/10464024513/job/29679449",
+    "status": "completed",
+    "conclusion": "success",
+    "created_at": "2024-08-19T21:40:05Z",
+    "started_at": "2024-08-19T21:40:20Z",
+    "completed_at": "2024-08-19T21:45:31Z",
+    "name": "build",
+    "labels": ["self-hosted", "linux"],
+    "runner_id": 1,
+    "runner_name": "runner-abcdefghij",
+    "runner_group_id": 1,
+    "runner_group_name": "Default"
+  },
+  "repository": {
+    "id": 186853002,
+    "name": "example-workflow",
+    "full_name": "octo-org/example-workflow",
+    "private": false,
+    "visibility": "public",
+    "fork": false,
+    "archived": false,
+    "topics": ["ci"],
+    "owner": {"login": "octo-org", "id": 6811672, "type": "Organization"}
+  },
+  "organization": {"login": "octo-org", "id": 6811672},
+  "sender": {"login": "octocat", "id": 583231, "type": "User"}
+}`
+
+func TestParseWorkflowJobPayload(t *testing.T) {
+
+	payload := pkg.Payload{}
+	assert.Nil(t, json.Unmarshal([]byte(workflowJobPayload), &payload))
+	job := payload.WorkflowJob()
+
+	assert.Equal(t, pkg.COMPLETED, payload.Action)
+	assert.Equal(t, int64(10464024513), job.RunId)
+	assert.Equal(t, int64(2), job.RunAttempt)
+	assert.Equal(t, "CI", job.WorkflowName)
+	assert.Equal(t, "main", job.HeadBranch)
+	assert.Equal(t, "success", job.Conclusion)
+	assert.Equal(t, time.Date(2024, 8, 19, 21, 40, 20, 0, time.UTC), *job.StartedAt)
+	assert.Equal(t, 5*time.Minute+11*time.Second, job.CompletedAt.Sub(*job.StartedAt))
+	assert.Equal(t, "octo-org/example-workflow", job.Repository.FullName)
+	assert.Equal(t, "public", job.Repository.Visibility)
+	assert.Equal(t, []string{"ci"}, job.Repository.Topics)
+	assert.Equal(t, "octo-org", job.Organization.Login)
+	assert.Equal(t, "octocat", job.Sender.Login)
+
+	// the repository, organization and sender survive the round trip through the cloud task payload
+	data, _ := json.Marshal(pkg.RunnerTask{Job: job})
+	task := pkg.RunnerTask{}
+	assert.Nil(t, json.Unmarshal(data, &task))
+	assert.Equal(t, "octo-org/example-workflow", task.Repository.FullName)
+	assert.Equal(t, "octocat", task.Sender.Login)
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityPolicyDefaultsToAllow(t *testing.T) {
+
+	policy := pkg.SecurityPolicy{}
+	assert.Nil(t, policy.Validate(nil))
+	decision := policy.Evaluate(pkg.RunFacts{PublicRepository: true, ForkPullRequest: true, Actor: "stranger"})
+	assert.Equal(t, pkg.PolicyAllow, decision.Action)
+}
+
+func TestSecurityPolicyStrictestActionWins(t *testing.T) {
+
+	profiles := []pkg.RunnerProfile{{Name: "locked-down", Isolated: true}}
+	policy := pkg.SecurityPolicy{PublicRepositories: pkg.PolicyIsolate, ForkPullRequests: pkg.PolicyDeny, UntrustedActors: pkg.PolicyIsolate, TrustedActors: []string{"octocat", "*[bot]"}, IsolatedProfile: "locked-down"}
+	assert.Nil(t, policy.Validate(profiles))
+
+	decision := policy.Evaluate(pkg.RunFacts{PublicRepository: true, Actor: "octocat", TrustedActor: true})
+	assert.Equal(t, pkg.PolicyIsolate, decision.Action)
+	assert.Equal(t, "public repository", decision.Reason)
+
+	decision = policy.Evaluate(pkg.RunFacts{PublicRepository: true, ForkPullRequest: true, Actor: "stranger"})
+	assert.Equal(t, pkg.PolicyDeny, decision.Action)
+	assert.Contains(t, decision.Reason, "pull request from a fork")
+	assert.Contains(t, decision.Reason, "untrusted actor \"stranger\"")
+
+	decision = policy.Evaluate(pkg.RunFacts{Actor: "octocat", TrustedActor: true})
+	assert.Equal(t, pkg.PolicyAllow, decision.Action)
+}
+
+func TestSecurityPolicyValidation(t *testing.T) {
+
+	policy := pkg.SecurityPolicy{PublicRepositories: "block"}
+	assert.NotNil(t, policy.Validate(nil))
+	// isolating requires an existing isolated profile
+	policy = pkg.SecurityPolicy{ForkPullRequests: pkg.PolicyIsolate}
+	assert.NotNil(t, policy.Validate(nil))
+	policy = pkg.SecurityPolicy{ForkPullRequests: pkg.PolicyIsolate, IsolatedProfile: "missing"}
+	assert.NotNil(t, policy.Validate([]pkg.RunnerProfile{{Name: "default"}}))
+}
+
+func TestIsolatedProfileIsNotMatchedByLabels(t *testing.T) {
+
+	profiles := []pkg.RunnerProfile{{Name: "locked-down", Labels: []string{"self-hosted"}, Isolated: true}, {Name: "default", Labels: []string{"self-hosted"}}}
+	for i := range profiles {
+		assert.Nil(t, profiles[i].Compile())
+	}
+	profile, _ := pkg.MatchProfile(profiles, pkg.Job{Labels: []string{"self-hosted"}})
+	assert.Equal(t, "default", profile.Name)
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollBatch(t *testing.T) {
+
+	repos := []string{"org/a", "org/b", "org/c", "org/d", "org/e"}
+	batch, next := pkg.PollBatch(repos, 0, 2)
+	assert.Equal(t, []string{"org/a", "org/b"}, batch)
+	assert.Equal(t, 2, next)
+	batch, next = pkg.PollBatch(repos, next, 2)
+	assert.Equal(t, []string{"org/c", "org/d"}, batch)
+	assert.Equal(t, 4, next)
+	batch, next = pkg.PollBatch(repos, next, 2)
+	assert.Equal(t, []string{"org/e"}, batch)
+	assert.Equal(t, 0, next, "the next round starts from the beginning")
+
+	batch, next = pkg.PollBatch(repos, 0, 10)
+	assert.Equal(t, repos, batch)
+	assert.Equal(t, 0, next)
+	batch, next = pkg.PollBatch(repos, 7, 2)
+	assert.Equal(t, []string{"org/a", "org/b"}, batch, "a cursor beyond the repositories starts a new round")
+	assert.Equal(t, 2, next)
+	batch, next = pkg.PollBatch([]string(nil), 0, 2)
+	assert.Empty(t, batch)
+	assert.Equal(t, 0, next)
+}
+
+func TestPollRecordsRejectedJobs(t *testing.T) {
+
+	jobRequests := 0
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	scaler := newGitHubScaler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/my-org/my-repo/actions/runs" && r.URL.Query().Get("status") == "queued":
+			w.Write([]byte(`{"workflow_runs": [{"id": 7, "repository": {"full_name": "my-org/my-repo"}}]}`))
+		case r.URL.Path == "/repos/my-org/my-repo/actions/runs":
+			w.Write([]byte(`{"workflow_runs": []}`))
+		case r.URL.Path == "/repos/my-org/my-repo/actions/runs/7/jobs":
+			jobRequests++
+			// no runner profile matches the job
+			w.Write([]byte(`{"jobs": [{"id": 11, "status": "queued", "labels": ["ubuntu-latest"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}), func(config *pkg.AutoscalerConfig) {
+		config.CallbackHost = "autoscaler.example.com"
+		config.AuditSink = "file://" + auditLog
+		config.RegisteredSources = map[string]pkg.Source{
+			"my-org/my-repo": {Name: "my-org/my-repo", SourceType: pkg.TypeRepository, Secret: PUBLIC_SECRET},
+		}
+	})
+
+	scaler.PollOnce(context.Background(), time.Minute)
+	scaler.PollOnce(context.Background(), time.Minute)
+	assert.Equal(t, 2, jobRequests)
+
+	audit, err := os.ReadFile(auditLog)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(audit), `"type":"job.rejected"`), "the rejected job is not evaluated again by the next poll")
+}
+
+func TestPollAppliesRepositoryFilterToListedRepositories(t *testing.T) {
+
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	scaler := newGitHubScaler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/orgs/my-org/repos":
+			w.Write([]byte(`[
+				{"id": 1, "full_name": "my-org/runner-repo", "topics": ["self-hosted-runner"], "visibility": "internal"},
+				{"id": 2, "full_name": "my-org/other-repo", "topics": ["docs"], "visibility": "internal"},
+				{"id": 3, "full_name": "my-org/public-repo", "topics": ["self-hosted-runner"], "visibility": "public"}
+			]`))
+		case strings.HasSuffix(r.URL.Path, "/actions/runs") && r.URL.Query().Get("status") == "queued":
+			// the workflow runs only carry a minimal repository
+			repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/"), "/actions/runs")
+			w.Write([]byte(`{"workflow_runs": [{"id": 7, "repository": {"full_name": "` + repo + `"}}]}`))
+		case strings.HasSuffix(r.URL.Path, "/actions/runs"):
+			w.Write([]byte(`{"workflow_runs": []}`))
+		case r.URL.Path == "/repos/my-org/runner-repo/actions/runs/7/jobs":
+			w.Write([]byte(`{"jobs": [{"id": 21, "status": "queued", "labels": ["self-hosted"]}]}`))
+		case r.URL.Path == "/repos/my-org/other-repo/actions/runs/7/jobs":
+			w.Write([]byte(`{"jobs": [{"id": 22, "status": "queued", "labels": ["self-hosted"]}]}`))
+		case r.URL.Path == "/repos/my-org/public-repo/actions/runs/7/jobs":
+			w.Write([]byte(`{"jobs": [{"id": 23, "status": "queued", "labels": ["self-hosted"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}), func(config *pkg.AutoscalerConfig) {
+		config.CallbackHost = "autoscaler.example.com"
+		config.CreateVmDelay = 3600
+		config.AuditSink = "file://" + auditLog
+		config.RegisteredSources = map[string]pkg.Source{
+			"my-org": {Name: "my-org", SourceType: pkg.TypeOrganization, Secret: PUBLIC_SECRET, SourceSettings: pkg.SourceSettings{
+				Repositories: &pkg.RepositoryFilter{
+					Include: []pkg.RepositoryRule{{Topics: []string{"self-hosted-runner"}}},
+					Exclude: []pkg.RepositoryRule{{Visibility: "public"}},
+				},
+			}},
+		}
+	})
+
+	scaler.PollOnce(context.Background(), time.Minute)
+	data, err := os.ReadFile(auditLog)
+	assert.Nil(t, err)
+	events := map[int64]pkg.AuditEventType{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		event := pkg.AuditEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &event))
+		events[event.JobId] = event.Type
+	}
+	// the topics and the visibility are taken from the listed repositories
+	assert.Equal(t, map[int64]pkg.AuditEventType{21: pkg.AuditJobQueued, 22: pkg.AuditJobRejected, 23: pkg.AuditJobRejected}, events)
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func newProfile(t *testing.T, name string, match pkg.LabelMatchMode, labels ...string) pkg.RunnerProfile {
+
+	profile := pkg.RunnerProfile{Name: name, Match: match, Labels: labels}
+	assert.Nil(t, profile.Compile())
+	return profile
+}
+
+func TestProfileMatchAll(t *testing.T) {
+
+	profile := newProfile(t, "default", pkg.MatchAll, "self-hosted", "linux")
+	ok, _ := profile.Matches(pkg.Job{Labels: []string{"self-hosted", "Linux", "x64"}})
+	assert.True(t, ok)
+	ok, reason := profile.Matches(pkg.Job{Labels: []string{"self-hosted"}})
+	assert.False(t, ok)
+	assert.Contains(t, reason, "linux")
+}
+
+func TestProfileMatchSubset(t *testing.T) {
+
+	profile := newProfile(t, "default", pkg.MatchSubset, "self-hosted", "linux", "x64")
+	ok, _ := profile.Matches(pkg.Job{Labels: []string{"self-hosted", "linux", "@machine:e2-standard-4"}})
+	assert.True(t, ok)
+	// a runner advertising the labels would never be assigned a job requiring "gpu"
+	ok, reason := profile.Matches(pkg.Job{Labels: []string{"self-hosted", "gpu"}})
+	assert.False(t, ok)
+	assert.Contains(t, reason, "gpu")
+}
+
+func TestProfileMatchExactWithPatterns(t *testing.T) {
+
+	profile := newProfile(t, "ubuntu", pkg.MatchExact, "self-hosted", "/^ubuntu-2[24]\\.04$/", "x64-*")
+	ok, _ := profile.Matches(pkg.Job{Labels: []string{"self-hosted", "ubuntu-22.04", "x64-large"}})
+	assert.True(t, ok)
+	ok, _ = profile.Matches(pkg.Job{Labels: []string{"self-hosted", "ubuntu-20.04", "x64-large"}})
+	assert.False(t, ok)
+	ok, _ = profile.Matches(pkg.Job{Labels: []string{"self-hosted", "ubuntu-24.04", "x64-large", "docker"}})
+	assert.False(t, ok)
+}
+
+func TestProfileRouting(t *testing.T) {
+
+	profiles := []pkg.RunnerProfile{
+		newProfile(t, "gpu", pkg.MatchAll, "self-hosted", "gpu"),
+		newProfile(t, "default", pkg.MatchAll, "self-hosted"),
+	}
+	profile, _ := pkg.MatchProfile(profiles, pkg.Job{Labels: []string{"self-hosted", "gpu"}})
+	assert.Equal(t, "gpu", profile.Name)
+	profile, _ = pkg.MatchProfile(profiles, pkg.Job{Labels: []string{"self-hosted", "linux"}})
+	assert.Equal(t, "default", profile.Name)
+	profile, reason := pkg.MatchProfile(profiles, pkg.Job{Labels: []string{"ubuntu-latest"}})
+	assert.Nil(t, profile)
+	assert.Contains(t, reason, "gpu: job is missing")
+	assert.Contains(t, reason, "default: job is missing")
+}
+
+func TestProfileInvalid(t *testing.T) {
+
+	profile := pkg.RunnerProfile{Name: "broken", Labels: []string{"/([a-z/"}}
+	assert.NotNil(t, profile.Compile())
+	profile = pkg.RunnerProfile{Name: "broken", Match: "any"}
+	assert.NotNil(t, profile.Compile())
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// an autoscaler (not serving) whose GitHub API requests are sent to the api handler
+func newGitHubScaler(t *testing.T, api http.Handler, modify func(config *pkg.AutoscalerConfig)) *pkg.Autoscaler {
+
+	github := httptest.NewServer(api)
+	t.Cleanup(github.Close)
+	docker := httptest.NewServer((&fakeDocker{containers: map[string]map[string]any{}}).handler())
+	t.Cleanup(docker.Close)
+	config := pkg.AutoscalerConfig{
+		RouteWebhook:     "/webhook",
+		RouteCreateVm:    "/create",
+		RouteDeleteVm:    "/delete",
+		TaskQueue:        pkg.LOCAL_TASK_QUEUE,
+		GitHubPat:        "test-pat",
+		GitHubApiUrl:     github.URL,
+		GitHubMaxRetries: 0,
+		Backend:          pkg.BackendDocker,
+		DockerHost:       docker.URL,
+		RunnerImage:      "ghcr.io/actions/actions-runner:2.320.0",
+		RunnerLabels:     []string{"self-hosted"},
+		SourceQueryParam: SOURCE_QUERY_PARAM_NAME,
+	}
+	if modify != nil {
+		modify(&config)
+	}
+	scaler := pkg.NewAutoscaler(config)
+	t.Cleanup(func() { scaler.Close() })
+	return scaler
+}
+
+func TestGenerateRunnerRegistrationToken(t *testing.T) {
+
+	mu := sync.Mutex{}
+	paths := []string{}
+	scaler := newGitHubScaler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		assert.Equal(t, "Bearer test-pat", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "registration-token", "expires_at": "2024-08-01T10:00:00Z"}`))
+	}), nil)
+
+	for _, src := range []pkg.Source{
+		{Name: "my-org/my-repo", SourceType: pkg.TypeRepository},
+		{Name: "my-org", SourceType: pkg.TypeOrganization},
+		{Name: "my-enterprise", SourceType: pkg.TypeEnterprise},
+	} {
+		token, err := scaler.GenerateRunnerRegistrationToken(context.Background(), src.RegistrationTokenEndpoint())
+		assert.Nil(t, err)
+		assert.Equal(t, "registration-token", token)
+	}
+	assert.Equal(t, []string{
+		"POST /repos/my-org/my-repo/actions/runners/registration-token",
+		"POST /orgs/my-org/actions/runners/registration-token",
+		"POST /enterprises/my-enterprise/actions/runners/registration-token",
+	}, paths)
+}
+
+func TestGenerateRunnerRegistrationTokenEmpty(t *testing.T) {
+
+	scaler := newGitHubScaler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}), nil)
+
+	src := pkg.Source{Name: "my-org", SourceType: pkg.TypeOrganization}
+	_, err := scaler.GenerateRunnerRegistrationToken(context.Background(), src.RegistrationTokenEndpoint())
+	assert.True(t, errors.Is(err, pkg.ErrUnexpectedResponse))
+}
+
+func TestGetRunnerGroupName(t *testing.T) {
+
+	mu := sync.Mutex{}
+	paths := []string{}
+	scaler := newGitHubScaler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/runner-groups/404") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		w.Write([]byte(`{"id": 2, "name": "linux-runners"}`))
+	}), nil)
+	ctx := context.Background()
+
+	name, err := scaler.GetRunnerGroupName(ctx, pkg.Source{Name: "my-org", SourceType: pkg.TypeOrganization}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "linux-runners", name)
+	name, err = scaler.GetRunnerGroupName(ctx, pkg.Source{Name: "my-enterprise", SourceType: pkg.TypeEnterprise}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "linux-runners", name)
+	name, err = scaler.GetRunnerGroupName(ctx, pkg.Source{Name: "my-org/my-repo", SourceType: pkg.TypeRepository}, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, name, "repositories have no runner groups")
+
+	_, err = scaler.GetRunnerGroupName(ctx, pkg.Source{Name: "my-org", SourceType: pkg.TypeOrganization}, 404)
+	assert.True(t, errors.Is(err, pkg.ErrRunnerGroupNotFound))
+	var ghErr *pkg.GitHubError
+	assert.True(t, errors.As(err, &ghErr))
+	assert.True(t, ghErr.Permanent(), "a missing runner group is not retried")
+
+	assert.Equal(t, []string{
+		"GET /orgs/my-org/actions/runner-groups/2",
+		"GET /enterprises/my-enterprise/actions/runner-groups/2",
+		"GET /orgs/my-org/actions/runner-groups/404",
+	}, paths, "the runner group of a repository is not requested")
+}
+
+func TestRegistrationTokenMetadata(t *testing.T) {
+
+	src := pkg.Source{Name: "my-org", SourceType: pkg.TypeOrganization, SourceSettings: pkg.SourceSettings{ConfigFlags: "--disableupdate"}}
+	vmMetadata := make([]*computepb.Items, 1, 4)
+	vmMetadata[0] = &computepb.Items{Key: proto.String("gh-job-id"), Value: proto.String("42")}
+	metadata := pkg.RegistrationTokenMetadata(src, vmMetadata, "registration-token", "linux-runners", []string{"self-hosted", "linux"})
+
+	items := map[string]string{}
+	tokenAttr := ""
+	for _, item := range metadata {
+		items[item.GetKey()] = item.GetValue()
+		if strings.HasPrefix(item.GetKey(), pkg.RUNNER_REGISTRATION_TOKEN_ATTR+"_") {
+			tokenAttr = item.GetKey()
+		}
+	}
+	assert.Len(t, metadata, 7)
+	assert.Equal(t, "42", items["gh-job-id"], "the metadata of the VM is kept")
+	assert.Equal(t, "registration-token", items[tokenAttr])
+	assert.Equal(t, "https://github.com/my-org", items[pkg.RUNNER_URL_ATTR])
+	assert.Equal(t, "self-hosted,linux", items[pkg.RUNNER_LABELS_ATTR])
+	assert.Equal(t, "linux-runners", items[pkg.RUNNER_GROUP_ATTR])
+	assert.Equal(t, "--disableupdate", items[pkg.RUNNER_CONFIG_FLAGS_ATTR])
+
+	script := items["startup-script"]
+	assert.Contains(t, script, `token=$(attr "`+tokenAttr+`")`, "the startup script reads the token from its (random) attribute")
+	assert.Contains(t, script, "project/attributes/"+pkg.RUNNER_SCRIPT_REGISTER_RUNNER_ATTR)
+	for _, attr := range []string{pkg.RUNNER_URL_ATTR, pkg.RUNNER_LABELS_ATTR, pkg.RUNNER_GROUP_ATTR, pkg.RUNNER_CONFIG_FLAGS_ATTR} {
+		assert.Contains(t, script, "$(attr "+attr+")")
+	}
+	assert.Len(t, vmMetadata, 1, "the metadata of the VM is not modified")
+	assert.Len(t, vmMetadata[:cap(vmMetadata)][1].GetKey(), 0, "the metadata of the VM is copied before appending")
+}
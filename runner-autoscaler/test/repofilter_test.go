@@ -0,0 +1,59 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepositoryFilter(t *testing.T) {
+
+	filter := pkg.RepositoryFilter{
+		Include: []pkg.RepositoryRule{
+			{Repository: "octo-org/runner-*"},
+			{Topics: []string{"self-hosted-*"}},
+			{Visibility: "internal"},
+		},
+		Exclude: []pkg.RepositoryRule{
+			{Repository: "monorepo"},
+			{Visibility: "public", Topics: []string{"self-hosted-runners"}},
+		},
+	}
+	assert.Nil(t, filter.Validate())
+
+	ok, _ := filter.Accepts(pkg.Repository{Name: "runner-test", FullName: "octo-org/Runner-Test", Visibility: "private"})
+	assert.True(t, ok)
+	ok, _ = filter.Accepts(pkg.Repository{Name: "website", FullName: "octo-org/website", Private: true, Topics: []string{"self-hosted-runners"}})
+	assert.True(t, ok)
+	ok, _ = filter.Accepts(pkg.Repository{Name: "tools", FullName: "octo-org/tools", Visibility: "internal"})
+	assert.True(t, ok)
+
+	ok, reason := filter.Accepts(pkg.Repository{Name: "docs", FullName: "octo-org/docs", Visibility: "private"})
+	assert.False(t, ok)
+	assert.Equal(t, "repository octo-org/docs is not included", reason)
+	// exclude rules take precedence
+	ok, reason = filter.Accepts(pkg.Repository{Name: "monorepo", FullName: "octo-org/monorepo", Visibility: "internal"})
+	assert.False(t, ok)
+	assert.Equal(t, "repository octo-org/monorepo is excluded", reason)
+	// without visibility the private flag is used
+	ok, _ = filter.Accepts(pkg.Repository{Name: "website", FullName: "octo-org/website", Topics: []string{"self-hosted-runners"}})
+	assert.False(t, ok)
+}
+
+func TestRepositoryFilterWithoutInclude(t *testing.T) {
+
+	filter := pkg.RepositoryFilter{Exclude: []pkg.RepositoryRule{{Repository: "octo-org/legacy-*"}}}
+	assert.Nil(t, filter.Validate())
+	ok, _ := filter.Accepts(pkg.Repository{FullName: "octo-org/website"})
+	assert.True(t, ok)
+	ok, _ = filter.Accepts(pkg.Repository{FullName: "octo-org/legacy-app"})
+	assert.False(t, ok)
+}
+
+func TestRepositoryFilterInvalid(t *testing.T) {
+
+	assert.NotNil(t, (&pkg.RepositoryFilter{Include: []pkg.RepositoryRule{{}}}).Validate())
+	assert.NotNil(t, (&pkg.RepositoryFilter{Include: []pkg.RepositoryRule{{Visibility: "secret"}}}).Validate())
+	assert.NotNil(t, (&pkg.RepositoryFilter{Exclude: []pkg.RepositoryRule{{Repository: "octo-org/["}}}).Validate())
+}
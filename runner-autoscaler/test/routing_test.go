@@ -0,0 +1,39 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteRunnerGroup(t *testing.T) {
+
+	routes := []pkg.RunnerGroupRoute{
+		{Repository: "octo-org/internal-*", RunnerGroupId: 2},
+		{Labels: []string{"gpu"}, RunnerGroupId: 3},
+		{Source: "other-org", Profile: "untrusted", RunnerGroupId: 4},
+	}
+	for i := range routes {
+		assert.Nil(t, routes[i].Compile())
+	}
+	org := pkg.Source{Name: "octo-org", SourceType: pkg.TypeOrganization}
+	internal := pkg.Job{Labels: []string{"self-hosted", "gpu"}, Repository: &pkg.Repository{FullName: "octo-org/Internal-tools"}}
+	public := pkg.Job{Labels: []string{"self-hosted"}, Repository: &pkg.Repository{FullName: "octo-org/website"}}
+	gpu := pkg.Job{Labels: []string{"self-hosted", "GPU"}, Repository: &pkg.Repository{FullName: "octo-org/website"}}
+
+	assert.Equal(t, int64(2), pkg.RouteRunnerGroup(routes, 1, org, internal, "default"))
+	assert.Equal(t, int64(3), pkg.RouteRunnerGroup(routes, 1, org, gpu, "default"))
+	assert.Equal(t, int64(1), pkg.RouteRunnerGroup(routes, 1, org, public, "default"))
+	assert.Equal(t, int64(4), pkg.RouteRunnerGroup(routes, 1, pkg.Source{Name: "other-org", SourceType: pkg.TypeOrganization}, public, "untrusted"))
+	// repositories only have the implicit runner group 1
+	assert.Equal(t, int64(1), pkg.RouteRunnerGroup(routes, 5, pkg.Source{Name: "octo-org/internal-tools", SourceType: pkg.TypeRepository}, internal, "default"))
+}
+
+func TestRouteRunnerGroupInvalid(t *testing.T) {
+
+	route := pkg.RunnerGroupRoute{Source: "octo-org"}
+	assert.NotNil(t, route.Compile())
+	route = pkg.RunnerGroupRoute{Repository: "octo-org/[", RunnerGroupId: 2}
+	assert.NotNil(t, route.Compile())
+}
@@ -0,0 +1,215 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func pendingJob(id int64, source string, repo string, priority int64, queuedAt time.Time) pkg.PendingJob {
+
+	return pkg.PendingJob{
+		Source:   source,
+		Task:     pkg.RunnerTask{Job: pkg.Job{Id: id, Repository: &pkg.Repository{FullName: repo}}},
+		Priority: priority,
+		QueuedAt: queuedAt,
+	}
+}
+
+func releasedIds(jobs []pkg.PendingJob) []int64 {
+
+	ids := []int64{}
+	for _, job := range jobs {
+		ids = append(ids, job.Task.Id)
+	}
+	return ids
+}
+
+func TestJobPriority(t *testing.T) {
+
+	rules := []pkg.PriorityRule{
+		{Branch: "main", Priority: 10},
+		{Repository: "octo-org/critical-*", Priority: 5},
+		{Labels: []string{"gpu"}, Priority: -5},
+	}
+	for i := range rules {
+		assert.Nil(t, rules[i].Compile())
+	}
+	assert.Equal(t, int64(10), pkg.JobPriority(rules, pkg.Job{HeadBranch: "main"}))
+	assert.Equal(t, int64(5), pkg.JobPriority(rules, pkg.Job{HeadBranch: "feature", Repository: &pkg.Repository{FullName: "octo-org/Critical-Service"}}))
+	assert.Equal(t, int64(-5), pkg.JobPriority(rules, pkg.Job{HeadBranch: "feature", Labels: []string{"self-hosted", "GPU"}}))
+	assert.Equal(t, int64(0), pkg.JobPriority(rules, pkg.Job{HeadBranch: "feature"}))
+
+	invalid := pkg.PriorityRule{Branch: "release/["}
+	assert.NotNil(t, invalid.Compile())
+}
+
+func TestSchedulerPriorityAndFairShare(t *testing.T) {
+
+	now := time.Now()
+	scheduler := pkg.NewScheduler(map[string]float64{"big-org": 2})
+	// a large matrix of one repository was queued first
+	for i := int64(1); i <= 4; i++ {
+		scheduler.Push(pendingJob(i, "big-org", "big-org/monorepo", 0, now.Add(time.Duration(i)*time.Second)))
+	}
+	scheduler.Push(pendingJob(5, "big-org", "big-org/website", 0, now.Add(10*time.Second)))
+	scheduler.Push(pendingJob(6, "small-org", "small-org/app", 0, now.Add(11*time.Second)))
+	scheduler.Push(pendingJob(7, "small-org", "small-org/app", 1, now.Add(12*time.Second)))
+
+	// no free slot
+	active := []pkg.JobRecord{{Source: "big-org"}, {Source: "big-org"}}
+	assert.Empty(t, scheduler.Next(active, 2))
+
+	// the higher priority wins, then the source with the smallest weighted share, then the repository with the fewest active VMs
+	assert.Equal(t, []int64{7, 1, 6, 5}, releasedIds(scheduler.Next(active, 6)))
+	assert.Len(t, scheduler.Pending(), 3)
+
+	assert.True(t, scheduler.Remove(3))
+	assert.False(t, scheduler.Remove(3))
+	assert.Equal(t, []int64{2, 4}, releasedIds(scheduler.Next(nil, 10)))
+	assert.Empty(t, scheduler.Pending())
+}
+
+func TestSchedulerDeferredJobs(t *testing.T) {
+
+	scheduler := pkg.NewScheduler(nil)
+	deferred := pendingJob(1, "octo-org", "octo-org/app", 10, time.Now())
+	deferred.NotBefore = time.Now().Add(time.Hour)
+	scheduler.Push(deferred)
+	scheduler.Push(pendingJob(2, "octo-org", "octo-org/app", 0, time.Now()))
+
+	// the deferred job is not released before its scaling window starts, even if its priority is higher
+	assert.Equal(t, []int64{2}, releasedIds(scheduler.Next(nil, 10)))
+	assert.Len(t, scheduler.Pending(), 1)
+}
+
+func TestSchedulerPausedSource(t *testing.T) {
+
+	scheduler := pkg.NewScheduler(nil)
+	scheduler.Push(pendingJob(1, "octo-org", "octo-org/app", 0, time.Now()))
+	scheduler.Push(pendingJob(2, "other-org", "other-org/app", 0, time.Now()))
+
+	scheduler.Pause("octo-org")
+	assert.True(t, scheduler.IsPaused("octo-org"))
+	assert.Equal(t, []int64{2}, releasedIds(scheduler.Next(nil, 10)))
+	scheduler.Resume("octo-org")
+	assert.Equal(t, []int64{1}, releasedIds(scheduler.Next(nil, 10)))
+}
+
+func TestSchedulerReleaseFailure(t *testing.T) {
+
+	now := time.Now()
+	scheduler := pkg.NewScheduler(nil)
+	for i := int64(1); i <= 3; i++ {
+		scheduler.Push(pendingJob(i, "octo-org", "octo-org/app", 0, now.Add(time.Duration(i)*time.Second)))
+	}
+
+	released := []int64{}
+	err := scheduler.Release(nil, 10, func(job pkg.PendingJob) error {
+		if job.Task.Id == 2 {
+			return errors.New("could not enqueue")
+		}
+		released = append(released, job.Task.Id)
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []int64{1}, released)
+	// the failed job and the job released after it are pending again (with the time they were queued)
+	assert.Equal(t, []int64{2, 3}, releasedIds(scheduler.Pending()))
+	assert.Equal(t, now.Add(2*time.Second), scheduler.Pending()[0].QueuedAt)
+
+	assert.Nil(t, scheduler.Release(nil, 10, func(job pkg.PendingJob) error { return nil }))
+	assert.Empty(t, scheduler.Pending())
+}
+
+func getQueue(t *testing.T, port int) pkg.QueueStatus {
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/queue", port), nil)
+	req.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	status := pkg.QueueStatus{}
+	if resp, err := http.DefaultClient.Do(req); assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	}
+	return status
+}
+
+func TestCreateVmWithoutVmFreesSlot(t *testing.T) {
+
+	// GitHub refuses every runner (permanent error)
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "Resource not accessible by personal access token"}`))
+	}))
+	defer github.Close()
+	port := PORT - 4
+	startDockerScaler(t, port, &fakeDocker{containers: map[string]map[string]any{}}, func(config *pkg.AutoscalerConfig) {
+		config.MaxConcurrency = 1
+		config.PollInterval = 3600
+		config.ApiToken = API_TOKEN
+		config.GitHubApiUrl = github.URL
+	})
+	queue := func(id int64) {
+		queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: id, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+		assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	}
+	slots := func(active int, pending int) func() bool {
+		return func() bool {
+			status := getQueue(t, port)
+			return status.Active == active && status.Pending == pending
+		}
+	}
+
+	queue(1)
+	assert.Eventually(t, slots(1, 0), 5*time.Second, 50*time.Millisecond)
+	queue(2)
+	assert.Eventually(t, slots(1, 1), 5*time.Second, 50*time.Millisecond)
+
+	// the permanent GitHub error is acknowledged - job 1 won't get a VM
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/create", "", pkg.RunnerTask{Job: pkg.Job{Id: 1, Labels: []string{"self-hosted"}}}))
+	assert.Eventually(t, slots(1, 0), 5*time.Second, 50*time.Millisecond, "job 2 takes the slot of the failed job 1")
+
+	queue(3)
+	assert.Eventually(t, slots(1, 1), 5*time.Second, 50*time.Millisecond)
+	// the runner profile of job 2 is gone - the job is rejected
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/create", "", pkg.RunnerTask{Job: pkg.Job{Id: 2, Labels: []string{"self-hosted"}}, Profile: "removed"}))
+	assert.Eventually(t, slots(1, 0), 5*time.Second, 50*time.Millisecond, "job 3 takes the slot of the rejected job 2")
+}
+
+func TestHeldJobsRequirePolling(t *testing.T) {
+
+	limit := int64(2)
+	config := pkg.AutoscalerConfig{
+		RouteWebhook:      "/webhook",
+		RouteCreateVm:     "/create",
+		RouteDeleteVm:     "/delete",
+		Zones:             []string{ZONE},
+		RunnerLabels:      []string{"self-hosted"},
+		RegisteredSources: map[string]pkg.Source{},
+	}
+	for name, modify := range map[string]func(config *pkg.AutoscalerConfig){
+		"max concurrency": func(config *pkg.AutoscalerConfig) { config.MaxConcurrency = 1 },
+		"defer": func(config *pkg.AutoscalerConfig) {
+			config.ScalingSchedule = pkg.ScalingSchedule{OffHours: pkg.OffHours{Action: pkg.OffHoursDefer}}
+		},
+		"window max concurrency": func(config *pkg.AutoscalerConfig) {
+			config.ScalingSchedule = pkg.ScalingSchedule{Windows: []pkg.ScalingWindow{{Start: "08:00", End: "20:00", WindowSettings: pkg.WindowSettings{MaxConcurrency: &limit}}}}
+		},
+	} {
+		held := config
+		modify(&held)
+		assert.Panics(t, func() { pkg.NewAutoscaler(held) }, "%s: held jobs would be lost on restart without polling", name)
+		held.PollInterval = 60
+		assert.NotPanics(t, func() { pkg.NewAutoscaler(held).Close() }, name)
+	}
+
+	config.ScalingSchedule = pkg.ScalingSchedule{OffHours: pkg.OffHours{Action: pkg.OffHoursBlock}}
+	assert.NotPanics(t, func() { pkg.NewAutoscaler(config).Close() }, "blocked jobs are not held")
+}
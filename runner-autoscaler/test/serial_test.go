@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+const SERIAL_OUTPUT = "runner started\nrunner failed\n"
+
+func getSerialOutput(t *testing.T, port int, id int64) string {
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/jobs/%d/serial_output", port, id), nil)
+	req.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	if resp, err := http.DefaultClient.Do(req); assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+	return ""
+}
+
+func TestSerialOutputInMemory(t *testing.T) {
+
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-stuck": {}}}
+	port := PORT - 8
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) { config.ApiToken = API_TOKEN })
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 1}, VmName: "runner-stuck"}))
+
+	assert.Equal(t, "/jobs/1/serial_output", getJob(t, port, 1).SerialOutputUrl, "without a sink the output is linked to the job status API")
+	assert.Equal(t, SERIAL_OUTPUT, getSerialOutput(t, port, 1))
+}
+
+func TestSerialOutputFileSink(t *testing.T) {
+
+	dir := filepath.Join(t.TempDir(), "serial")
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-stuck": {}}}
+	port := PORT - 9
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) {
+		config.ApiToken = API_TOKEN
+		config.SerialOutputSink = "file://" + dir
+	})
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 1}, VmName: "runner-stuck"}))
+
+	file := filepath.Join(dir, "1-runner-stuck.log")
+	assert.Equal(t, "file://"+file, getJob(t, port, 1).SerialOutputUrl)
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, SERIAL_OUTPUT, string(data))
+	assert.Equal(t, SERIAL_OUTPUT, getSerialOutput(t, port, 1), "the output is also kept in the job record")
+}
+
+func TestSerialOutputGcsSink(t *testing.T) {
+
+	mu := sync.Mutex{}
+	objects := map[string]string{}
+	// a fake of the multipart upload of the Cloud Storage JSON API
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/upload/storage/v1/b/my-bucket/o", r.URL.Path)
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if !assert.Nil(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		reader.NextPart() // the object metadata
+		part, err := reader.NextPart()
+		if !assert.Nil(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(part)
+		name := r.URL.Query().Get("name")
+		mu.Lock()
+		objects[name] = string(data)
+		mu.Unlock()
+		fmt.Fprintf(w, `{"bucket": "my-bucket", "name": %q, "contentType": "text/plain"}`, name)
+	}))
+	defer gcs.Close()
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(gcs.URL+"/storage/v1/"), option.WithoutAuthentication())
+	assert.Nil(t, err)
+	defer client.Close()
+	clientCalls := 0
+	sink, err := pkg.NewSerialOutputSink("gs://my-bucket/serial/", func() *storage.Client {
+		clientCalls++
+		return client
+	})
+	assert.Nil(t, err)
+
+	link, err := sink.Store(context.Background(), 1, "runner-stuck", SERIAL_OUTPUT)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://storage.cloud.google.com/my-bucket/serial/1-runner-stuck.log", link)
+	link, err = sink.Store(context.Background(), 2, "runner-other", SERIAL_OUTPUT)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(link, "/serial/2-runner-other.log"))
+
+	mu.Lock()
+	assert.Equal(t, map[string]string{"serial/1-runner-stuck.log": SERIAL_OUTPUT, "serial/2-runner-other.log": SERIAL_OUTPUT}, objects)
+	mu.Unlock()
+	assert.Equal(t, 2, clientCalls, "the sink uses the shared client")
+}
+
+func TestNewSerialOutputSink(t *testing.T) {
+
+	sink, err := pkg.NewSerialOutputSink("", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, sink, "without a sink the output is only kept in the job record")
+	_, err = pkg.NewSerialOutputSink("s3://bucket", nil)
+	assert.NotNil(t, err)
+}
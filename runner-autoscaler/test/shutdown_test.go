@@ -0,0 +1,127 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+
+	port := PORT - 1
+	scaler := pkg.NewAutoscaler(pkg.AutoscalerConfig{
+		RouteWebhook:      "/webhook",
+		RouteCreateVm:     "/create",
+		RouteDeleteVm:     "/delete",
+		Zones:             []string{ZONE},
+		RunnerLabels:      []string{"self-hosted"},
+		RegisteredSources: map[string]pkg.Source{},
+		ShutdownTimeout:   1,
+		Drain:             true,
+	})
+	assert.True(t, scaler.IsDraining())
+
+	done := make(chan struct{})
+	go func() {
+		scaler.Srv(port)
+		close(done)
+	}()
+	url := fmt.Sprintf("http://127.0.0.1:%d/healthcheck", port)
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(url)
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	scaler.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Srv did not return after the shutdown")
+	}
+	assert.True(t, scaler.IsShuttingDown())
+	_, err := http.Get(url)
+	assert.NotNil(t, err)
+}
+
+func TestShutdownFlushesAuditEvents(t *testing.T) {
+
+	received := atomic.Int64{}
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond) // a slow sink does not delay the webhook
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sink.Close()
+
+	// the scaler is shut down when the subtest ends
+	t.Run("serve", func(t *testing.T) {
+		port := PORT - 11
+		startDockerScaler(t, port, &fakeDocker{containers: map[string]map[string]any{}}, func(config *pkg.AutoscalerConfig) { config.AuditSink = sink.URL })
+		for id := int64(1); id <= 3; id++ {
+			queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: id, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+			start := time.Now()
+			assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+			assert.Less(t, time.Since(start), 200*time.Millisecond)
+		}
+	})
+	assert.Equal(t, int64(3), received.Load(), "the audit events are delivered before the shutdown completes")
+}
+
+func TestShutdownHandsBackPendingJobs(t *testing.T) {
+
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	// the scaler is shut down when the subtest ends
+	t.Run("serve", func(t *testing.T) {
+		port := PORT - 13
+		startDockerScaler(t, port, &fakeDocker{containers: map[string]map[string]any{}}, func(config *pkg.AutoscalerConfig) {
+			config.Drain = true
+			config.ApiToken = API_TOKEN
+			config.AuditSink = "file://" + auditLog
+		})
+		queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+		assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+		assert.Equal(t, 1, getQueue(t, port).Pending)
+	})
+
+	data, err := os.ReadFile(auditLog)
+	assert.Nil(t, err)
+	events := []pkg.AuditEventType{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		event := pkg.AuditEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &event))
+		assert.Equal(t, pkg.OutcomeSuccess, event.Outcome)
+		events = append(events, event.Type)
+	}
+	assert.Equal(t, []pkg.AuditEventType{pkg.AuditJobPending, pkg.AuditJobQueued}, events, "the create-vm callback of the held job is enqueued on shutdown")
+}
+
+func TestHandedBackJobIsHeldAgain(t *testing.T) {
+
+	port := PORT - 14
+	startDockerScaler(t, port, &fakeDocker{containers: map[string]map[string]any{}}, func(config *pkg.AutoscalerConfig) {
+		config.MaxConcurrency = 1
+		config.PollInterval = 3600
+		config.ApiToken = API_TOKEN
+	})
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Equal(t, 1, getQueue(t, port).Active)
+
+	// the create-vm callback handed back by an instance that shut down does not bypass MAX_CONCURRENCY
+	task := pkg.RunnerTask{Job: pkg.Job{Id: 2, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}, HandedBack: true}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/create", "", task))
+	status := getQueue(t, port)
+	assert.Equal(t, 1, status.Active)
+	assert.Equal(t, 1, status.Pending)
+	assert.Equal(t, pkg.JobPending, getJob(t, port, 2).State)
+}
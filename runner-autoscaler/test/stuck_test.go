@@ -0,0 +1,216 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+// the sources are keyed by their name (like main does), the scheduler refers to the sources by name
+const STUCK_SOURCE_KEY = "my-org/my-repo"
+
+// an autoscaler with the docker backend (backed by the fake Docker Engine) and the local task queue, so no GCP services are needed
+func startDockerScaler(t *testing.T, port int, docker *fakeDocker, modify func(config *pkg.AutoscalerConfig)) *pkg.Autoscaler {
+
+	server := httptest.NewServer(docker.handler())
+	t.Cleanup(server.Close)
+	config := pkg.AutoscalerConfig{
+		RouteWebhook:     "/webhook",
+		RouteCreateVm:    "/create",
+		RouteDeleteVm:    "/delete",
+		RouteCheckJob:    "/check_job",
+		RouteVerifyVm:    "/verify_vm",
+		TaskQueue:        pkg.LOCAL_TASK_QUEUE,
+		TaskTimeout:      10,
+		GitHubPat:        "test-pat",
+		Backend:          pkg.BackendDocker,
+		DockerHost:       server.URL,
+		RunnerImage:      "ghcr.io/actions/actions-runner:2.320.0",
+		RunnerLabels:     []string{"self-hosted"},
+		SourceQueryParam: SOURCE_QUERY_PARAM_NAME,
+		CreateVmDelay:    3600,
+		StuckJobTimeout:  600,
+		StuckJobAttempts: 1,
+		ShutdownTimeout:  1,
+		RegisteredSources: map[string]pkg.Source{
+			STUCK_SOURCE_KEY: {Name: "my-org/my-repo", SourceType: pkg.TypeRepository, Secret: PUBLIC_SECRET},
+		},
+	}
+	if modify != nil {
+		modify(&config)
+	}
+	scaler := pkg.NewAutoscaler(config)
+	done := make(chan struct{})
+	go func() {
+		scaler.Srv(port)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		scaler.Shutdown()
+		<-done
+	})
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthcheck", port))
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+	return scaler
+}
+
+// sends a signed webhook event (event is not empty) or Cloud Task callback
+func postSigned(t *testing.T, port int, path string, event string, payload any) int {
+
+	data, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s?%s=%s", port, path, SOURCE_QUERY_PARAM_NAME, url.QueryEscape(STUCK_SOURCE_KEY)), bytes.NewReader(data))
+	req.Header.Set("x-hub-signature-256", "sha256="+pkg.CalcSigHex([]byte(PUBLIC_SECRET), data))
+	if len(event) > 0 {
+		req.Header.Set("x-github-event", event)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCheckJobKeepsBusyRunner(t *testing.T) {
+
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-busy": {}, "runner-idle": {}}}
+	port := PORT - 2
+	startDockerScaler(t, port, docker, nil)
+
+	for _, id := range []int64{1, 3} {
+		queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: id, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+		assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	}
+	// the runner created for job 1 picked up job 2 (same labels) - job 1 is still queued
+	inProgress := pkg.Payload{Action: pkg.IN_PROGRESS, Job: pkg.Job{Id: 2, Status: string(pkg.IN_PROGRESS), Labels: []string{"self-hosted"}, RunnerName: "runner-busy"}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", inProgress))
+
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 1}, VmName: "runner-busy"}))
+	docker.mu.Lock()
+	assert.Contains(t, docker.containers, "runner-busy", "a runner that runs another job is not deleted")
+	docker.mu.Unlock()
+
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 3}, VmName: "runner-idle"}))
+	docker.mu.Lock()
+	assert.NotContains(t, docker.containers, "runner-idle", "an idle runner of a stuck job is deleted")
+	docker.mu.Unlock()
+}
+
+func TestStuckJobDeleteClosesCostLedger(t *testing.T) {
+
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-stuck": {}}}
+	port := PORT - 3
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) { config.AuditSink = "file://" + auditLog })
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 1}, VmName: "runner-stuck"}))
+
+	ledger := pkg.NewCostLedger(0)
+	ledger.Record(pkg.AuditEvent{Time: time.Now().Add(-time.Hour), Type: pkg.AuditVmCreated, Outcome: pkg.OutcomeSuccess, VmName: "runner-stuck", JobId: 1})
+	file, err := os.Open(auditLog)
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.Nil(t, ledger.ReadAuditLog(file))
+	usages := ledger.Usages()
+	assert.Len(t, usages, 1)
+	assert.NotNil(t, usages[0].DeletedAt, "the stuck job's VM is no longer billed")
+}
+
+// the job record as reported by the job status API (requires the API_TOKEN)
+func getJob(t *testing.T, port int, id int64) pkg.JobRecord {
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/jobs/%d", port, id), nil)
+	req.Header.Set("Authorization", "Bearer "+API_TOKEN)
+	record := pkg.JobRecord{}
+	if resp, err := http.DefaultClient.Do(req); assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&record))
+	}
+	return record
+}
+
+func TestCheckJobReadsJobStateFromGitHub(t *testing.T) {
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/my-org/my-repo/actions/jobs/1", r.URL.Path)
+		w.Write([]byte(`{"id": 1, "status": "in_progress", "labels": ["self-hosted"]}`))
+	}))
+	defer github.Close()
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-1": {}}}
+	port := PORT - 5
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) {
+		config.ApiToken = API_TOKEN
+		config.GitHubApiUrl = github.URL
+	})
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	// the in_progress webhook event got lost - GitHub knows better
+	task := pkg.RunnerTask{Job: pkg.Job{Id: 1, Url: pkg.GITHUB_API_URL + "/repos/my-org/my-repo/actions/jobs/1"}, VmName: "runner-1"}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", task))
+	docker.mu.Lock()
+	assert.Contains(t, docker.containers, "runner-1", "the runner of a job that was picked up is kept")
+	docker.mu.Unlock()
+	assert.Equal(t, pkg.JobQueued, getJob(t, port, 1).State)
+}
+
+func TestStuckJobGivesUp(t *testing.T) {
+
+	docker := &fakeDocker{containers: map[string]map[string]any{"runner-stuck": {}}}
+	port := PORT - 6
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) { config.ApiToken = API_TOKEN })
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", pkg.RunnerTask{Job: pkg.Job{Id: 1}, VmName: "runner-stuck"}))
+	docker.mu.Lock()
+	assert.Empty(t, docker.containers, "no replacement after STUCK_JOB_ATTEMPTS VMs")
+	docker.mu.Unlock()
+	assert.Equal(t, pkg.JobFailed, getJob(t, port, 1).State)
+}
+
+func TestStuckJobReplacement(t *testing.T) {
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/my-org/my-repo/actions/runners/generate-jitconfig", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"encoded_jit_config": "jit-config"}`))
+	}))
+	defer github.Close()
+	docker := &fakeDocker{pulled: true, containers: map[string]map[string]any{"runner-stuck": {}}}
+	port := PORT - 7
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) {
+		config.ApiToken = API_TOKEN
+		config.GitHubApiUrl = github.URL
+		config.StuckJobAttempts = 2
+	})
+
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: 1, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	task := pkg.RunnerTask{Job: pkg.Job{Id: 1, Labels: []string{"self-hosted"}}, VmName: "runner-stuck"}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/check_job", "", task))
+
+	docker.mu.Lock()
+	assert.NotContains(t, docker.containers, "runner-stuck", "the runner of the stuck job is deleted")
+	assert.Len(t, docker.containers, 1, "a replacement runner is created")
+	docker.mu.Unlock()
+	record := getJob(t, port, 1)
+	assert.Equal(t, pkg.JobQueued, record.State)
+	assert.Equal(t, int64(2), record.Attempts)
+	assert.NotEqual(t, "runner-stuck", record.VmName)
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var recorderOnce sync.Once
+var recorder *tracetest.SpanRecorder
+
+// records the spans of all autoscalers of the test package. The global trace provider can only be set once
+func spanRecorder(t *testing.T) *tracetest.SpanRecorder {
+
+	recorderOnce.Do(func() {
+		// sets the propagator, no spans are exported without an OTLP endpoint
+		_, err := pkg.InitTracing(context.Background(), pkg.SERVICE_NAME, "test")
+		assert.Nil(t, err)
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+	return recorder
+}
+
+func spanJobId(span sdktrace.ReadOnlySpan) int64 {
+
+	for _, attr := range span.Attributes() {
+		if attr.Key == pkg.ATTR_JOB_ID {
+			return attr.Value.AsInt64()
+		}
+	}
+	return 0
+}
+
+// the ended spans of the job with the given name
+func jobSpans(recorder *tracetest.SpanRecorder, jobId int64, name string) []sdktrace.ReadOnlySpan {
+
+	ret := []sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.Name() == name && spanJobId(span) == jobId {
+			ret = append(ret, span)
+		}
+	}
+	return ret
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+
+	recorder := spanRecorder(t)
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"encoded_jit_config": "jit-config"}`))
+	}))
+	defer github.Close()
+	docker := &fakeDocker{containers: map[string]map[string]any{}}
+	port := PORT - 10
+	startDockerScaler(t, port, docker, func(config *pkg.AutoscalerConfig) {
+		config.GitHubApiUrl = github.URL
+		config.CreateVmDelay = 0
+	})
+
+	// a job id no other test uses, the spans of all tests end up in the same recorder
+	const jobId = 4711
+	queued := pkg.Payload{Action: pkg.QUEUED, Job: pkg.Job{Id: jobId, Status: string(pkg.QUEUED), Labels: []string{"self-hosted"}}}
+	assert.Equal(t, http.StatusOK, postSigned(t, port, "/webhook", "workflow_job", queued))
+	assert.Eventually(t, func() bool { return len(jobSpans(recorder, jobId, "create-vm")) == 1 }, 5*time.Second, 50*time.Millisecond)
+
+	spans := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.SpanContext().SpanID()] = span
+	}
+	webhook := jobSpans(recorder, jobId, "webhook.queued")
+	createTask := jobSpans(recorder, jobId, "cloudtasks.CreateTask")
+	createVm := jobSpans(recorder, jobId, "create-vm")
+	if !assert.Len(t, webhook, 1) || !assert.NotEmpty(t, createTask) {
+		return
+	}
+
+	// the create-vm callback continues the trace of the webhook through the headers of the Cloud Task
+	assert.Equal(t, webhook[0].SpanContext().TraceID(), createVm[0].SpanContext().TraceID())
+	ancestors := []string{}
+	for parent := createVm[0].Parent(); parent.IsValid(); {
+		span, ok := spans[parent.SpanID()]
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, span.Name())
+		parent = span.Parent()
+	}
+	assert.Contains(t, ancestors, "cloudtasks.CreateTask", "the callback is a child of the span that created the Cloud Task")
+	assert.Contains(t, ancestors, "webhook.queued")
+
+	// the child spans of the handler inherit the job id
+	for _, name := range []string{"github.GenerateJitConfig", "docker.CreateContainer"} {
+		children := jobSpans(recorder, jobId, name)
+		if assert.Len(t, children, 1, name) {
+			assert.Equal(t, createVm[0].SpanContext().TraceID(), children[0].SpanContext().TraceID())
+		}
+	}
+}
+
+func TestTraceHook(t *testing.T) {
+
+	hook := &pkg.TraceHook{ProjectId: "my-project"}
+	logger := log.New()
+	traceId, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanId, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceId, SpanID: spanId, TraceFlags: trace.FlagsSampled})
+
+	entry := logger.WithContext(trace.ContextWithSpanContext(context.Background(), spanCtx))
+	assert.Nil(t, hook.Fire(entry))
+	assert.Equal(t, "projects/my-project/traces/0af7651916cd43dd8448eb211c80319c", entry.Data["logging.googleapis.com/trace"])
+	assert.Equal(t, "b7ad6b7169203331", entry.Data["logging.googleapis.com/spanId"])
+	assert.Equal(t, true, entry.Data["logging.googleapis.com/trace_sampled"])
+
+	for _, entry := range []*log.Entry{log.NewEntry(logger), logger.WithContext(context.Background())} {
+		assert.Nil(t, hook.Fire(entry))
+		for key := range entry.Data {
+			assert.False(t, strings.HasPrefix(key, "logging.googleapis.com/"), "entries without a span get no trace fields")
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeLabelValue(t *testing.T) {
+
+	assert.Equal(t, "octo-org_example-workflow", pkg.SanitizeLabelValue("Octo-Org/example-workflow"))
+	assert.Equal(t, "build_test", pkg.SanitizeLabelValue("Build & Test"))
+	assert.Equal(t, "_machine_e2-standard-4", pkg.SanitizeLabelValue("@machine:e2-standard-4"))
+	assert.Equal(t, "", pkg.SanitizeLabelValue(""))
+	assert.Len(t, pkg.SanitizeLabelValue(strings.Repeat("a", 100)), 63)
+}
+
+func TestSanitizeLabelKey(t *testing.T) {
+
+	assert.Equal(t, "gh-repository", pkg.SanitizeLabelKey("gh-repository"))
+	assert.Equal(t, "l1st", pkg.SanitizeLabelKey("1st"))
+	assert.Equal(t, "l", pkg.SanitizeLabelKey(""))
+	assert.Len(t, pkg.SanitizeLabelKey("_"+strings.Repeat("a", 100)), 63)
+}
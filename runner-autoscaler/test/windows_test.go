@@ -0,0 +1,62 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Tereius/gcp-hosted-github-runner/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScalingScheduleActiveWindow(t *testing.T) {
+
+	night := int64(2)
+	schedule := pkg.ScalingSchedule{
+		Timezone: "Europe/Berlin",
+		Windows: []pkg.ScalingWindow{
+			{Name: "office", Days: []string{"mon", "tue", "wed", "thu", "Friday"}, Start: "08:00", End: "20:00"},
+			{Name: "nightly", Start: "22:00", End: "02:00", WindowSettings: pkg.WindowSettings{MaxConcurrency: &night, SpotOnly: true}},
+		},
+	}
+	assert.Nil(t, schedule.Compile(nil))
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	// Wednesday 2024-09-04
+	assert.Equal(t, "office", schedule.Active(time.Date(2024, 9, 4, 8, 0, 0, 0, berlin)).Name)
+	assert.Equal(t, "office", schedule.Active(time.Date(2024, 9, 4, 17, 59, 0, 0, time.UTC)).Name)
+	assert.True(t, schedule.Active(time.Date(2024, 9, 4, 20, 0, 0, 0, berlin)).OffHours)
+	// the nightly window spans midnight
+	nightly := schedule.Active(time.Date(2024, 9, 5, 1, 30, 0, 0, berlin))
+	assert.Equal(t, "nightly", nightly.Name)
+	assert.Equal(t, int64(2), *nightly.MaxConcurrency)
+	assert.True(t, nightly.SpotOnly)
+	// Saturday
+	assert.True(t, schedule.Active(time.Date(2024, 9, 7, 12, 0, 0, 0, berlin)).OffHours)
+}
+
+func TestScalingScheduleNextWindowStart(t *testing.T) {
+
+	schedule := pkg.ScalingSchedule{
+		Timezone: "America/New_York",
+		Windows:  []pkg.ScalingWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "20:00"}},
+	}
+	assert.Nil(t, schedule.Compile(nil))
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	// Friday evening -> Monday morning
+	next := schedule.NextWindowStart(time.Date(2024, 9, 6, 21, 0, 0, 0, newYork))
+	assert.True(t, next.Equal(time.Date(2024, 9, 9, 8, 0, 0, 0, newYork)))
+	// Tuesday early morning -> Tuesday morning
+	next = schedule.NextWindowStart(time.Date(2024, 9, 10, 6, 0, 0, 0, newYork))
+	assert.True(t, next.Equal(time.Date(2024, 9, 10, 8, 0, 0, 0, newYork)))
+}
+
+func TestScalingScheduleInvalid(t *testing.T) {
+
+	assert.NotNil(t, (&pkg.ScalingSchedule{Timezone: "Mars/Olympus"}).Compile(nil))
+	assert.NotNil(t, (&pkg.ScalingSchedule{Windows: []pkg.ScalingWindow{{Start: "8", End: "20:00"}}}).Compile(nil))
+	assert.NotNil(t, (&pkg.ScalingSchedule{Windows: []pkg.ScalingWindow{{Days: []string{"someday"}, Start: "08:00", End: "20:00"}}}).Compile(nil))
+	assert.NotNil(t, (&pkg.ScalingSchedule{Windows: []pkg.ScalingWindow{{Start: "08:00", End: "20:00", WindowSettings: pkg.WindowSettings{Profiles: []string{"gpu"}}}}}).Compile(nil))
+	assert.NotNil(t, (&pkg.ScalingSchedule{OffHours: pkg.OffHours{Action: "sleep"}}).Compile(nil))
+	assert.Nil(t, (&pkg.ScalingSchedule{Windows: []pkg.ScalingWindow{{Start: "08:00", End: "24:00"}}}).Compile(nil))
+}
@@ -62,6 +62,18 @@ variable "autoscaler_timeout" {
   default     = 180
 }
 
+variable "stuck_job_timeout" {
+  type        = number
+  description = "If greater than 0, a VM instance whose workflow job is still queued stuck_job_timeout seconds after the VM instance was created is replaced by a new one (e.g. because the startup script failed). Should be longer than it takes to boot the VM and to register the runner."
+  default     = 0
+}
+
+variable "poll_interval" {
+  type        = number
+  description = "If greater than 0, queued workflow jobs are additionally polled from the GitHub REST API every poll_interval seconds (useful if webhooks can't be installed). Keeps one Cloud Run instance running. Required if MAX_CONCURRENCY or SCALING_SCHEDULE hold workflow jobs (see runner-autoscaler/README.md)."
+  default     = 0
+}
+
 variable "enable_ssh" {
   type        = bool
   description = "Enable SSH access to the VM instances."
@@ -80,6 +92,12 @@ variable "subnet_ip_cidr_range" {
   default     = "10.0.1.0/24"
 }
 
+variable "autoscaler_extra_env" {
+  type        = map(string)
+  description = "Additional environment variables of the autoscaler Cloud Run (see runner-autoscaler/README.md for all available options), e.g. { SERIAL_OUTPUT_SINK = \"gs://my-bucket/serial\" }"
+  default     = {}
+}
+
 variable "enable_debug" {
   type        = bool
   description = "Enable debug messages of github-runner-autoscaler Cloud Run (WARNING: secrets will be leaked in log files)."
@@ -104,6 +122,12 @@ variable "github_repositories" {
   default     = []
 }
 
+variable "github_source_settings" {
+  type        = any
+  description = "Optional settings per GitHub enterprise, organization or repository (key). See the autoscaler README for all available settings. E.g. { \"my-org\" = { registration_mode = \"token\" } }"
+  default     = {}
+}
+
 variable "github_runner_group_id" {
   type        = number
   description = "The ID of the GitHub runner group the runner will join."